@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"k8s.io/klog/v2"
+	"kope.io/networking/pkg/cni"
+	"kope.io/networking/pkg/policy"
+	"kope.io/networking/pkg/routing"
+	"kope.io/networking/pkg/routing/netutil"
+)
+
+// runCleanup implements `networking-agent cleanup`, which removes everything the agent installs on the node,
+// so that the node can be moved to another CNI without a reboot.
+// It does not need to reach the apiserver, so it can run as an init container or from a node shell.
+// We remove the state of every registered provider, as the node may have been running a different provider in the past;
+// the exception is ipsec, whose cleanup flushes all xfrm state, so we only do that if ipsec is configured.
+func runCleanup(args []string) error {
+	options, _, err := loadOptions(configPath, args, flag.ExitOnError)
+	if err != nil {
+		return err
+	}
+	setLogLevel(options.LogLevel)
+
+	klog.Infof("removing networking configuration from this node")
+
+	var errs []error
+
+	// The devices and other state of each provider; the routes via their devices are removed with them.
+	// The state of providers whose cleanup is not limited to our own state is only removed if they are configured.
+	selected := []string{options.Provider}
+	if options.Migration.FromProvider != "" {
+		selected = append(selected, options.Migration.FromProvider)
+	}
+	if err := routing.CleanupProviders(selected, options.ProviderSections()); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Routes we installed via other links: layer2 routes, and vxlan host routes pinning peers to an underlay link
+	if err := (&netutil.RouteTable{}).Ensure(nil, nil, true); err != nil {
+		errs = append(errs, fmt.Errorf("error removing routes: %w", err))
+	}
+
+	masqueradeTable, err := netutil.NewMasqueradeTable(nil)
+	if err == nil {
+		err = masqueradeTable.Delete()
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("error removing masquerade rules: %w", err))
+	}
+
+	if err := policy.Cleanup(); err != nil {
+		errs = append(errs, fmt.Errorf("error removing network policy rules: %w", err))
+	}
+
+	if options.CNIConfigPath != "" {
+		cniWriter := &cni.SimpleConfigWriter{Path: options.CNIConfigPath}
+		if err := cniWriter.RemoveCNIConfig(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// The bridge is created by the CNI bridge plugin, using the name in our CNI config
+	if err := netutil.DeleteLink(cni.BridgeName); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := netutil.UnregisterRouteProtocol(netutil.RouteProtocolsDir); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("cleanup was incomplete: %w", err)
+	}
+	klog.Infof("cleanup complete")
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+	"kope.io/networking/pkg/apis/config/v1alpha1"
+	networkingv1alpha1 "kope.io/networking/pkg/apis/networking/v1alpha1"
+	"kope.io/networking/pkg/ipam"
+	"kope.io/networking/pkg/routing"
+)
+
+// ipamLeaseName is the Lease the agents use to elect the one that allocates node CIDRs
+const ipamLeaseName = "kopeio-networking-ipam"
+
+// defaultNamespace is used for the Lease if POD_NAMESPACE is not set
+const defaultNamespace = "kube-system"
+
+// buildIPAMController builds the ipam controller, allocating from podCIDR and any IPPools
+func buildIPAMController(kubeClient kubernetes.Interface, options *Options) (*ipam.Controller, error) {
+	// podCIDR has been validated
+	_, clusterCIDR, err := net.ParseCIDR(options.PodCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing podCIDR %q: %w", options.PodCIDR, err)
+	}
+	controller, err := ipam.NewController(kubeClient, clusterCIDR, options.IPAM.MaskSize(clusterCIDR), options.ResyncPeriod.Duration)
+	if err != nil {
+		return nil, fmt.Errorf("error building ipam controller: %w", err)
+	}
+	return controller, nil
+}
+
+// runIPAM runs the ipam controller whenever this agent holds the ipam lease, until ctx is cancelled
+func runIPAM(ctx context.Context, kubeClient kubernetes.Interface, controller *ipam.Controller) error {
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	identity := os.Getenv("NODE_NAME")
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("error getting hostname: %w", err)
+		}
+		identity = hostname
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      ipamLeaseName,
+			Namespace: namespace,
+		},
+		Client: kubeClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	// RunOrDie returns when we lose the lease; we then stand for election again
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   15 * time.Second,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			ReleaseOnCancel: true,
+			Name:            "ipam",
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: controller.Run,
+				OnStoppedLeading: func() {
+					klog.Infof("no longer allocating node CIDRs")
+				},
+				OnNewLeader: func(leader string) {
+					klog.Infof("node CIDRs are allocated by %q", leader)
+				},
+			},
+		})
+	}
+	return ctx.Err()
+}
+
+// poolPublisher publishes the IPPools: their CIDRs are routed and not masqueraded, and ipamController (if not nil) allocates from them.
+// Pools that overlap the podCIDR are ignored, so we publish them again when the podCIDR changes.
+type poolPublisher struct {
+	nodeMap        *routing.NodeMap
+	ipamController *ipam.Controller
+	// ipam only changes when we restart, as does ipamController
+	ipam v1alpha1.IPAMConfiguration
+
+	// mutex guards pools and podCIDR, which are set by the pool controller and the config reloader
+	mutex   sync.Mutex
+	pools   []networkingv1alpha1.IPPool
+	podCIDR string
+}
+
+// newPoolPublisher builds a poolPublisher; ipamController is optional
+func newPoolPublisher(options *Options, nodeMap *routing.NodeMap, ipamController *ipam.Controller) *poolPublisher {
+	return &poolPublisher{
+		nodeMap:        nodeMap,
+		ipamController: ipamController,
+		ipam:           options.IPAM,
+		podCIDR:        options.PodCIDR,
+	}
+}
+
+// SetPools publishes pools, which are all the IPPools in the cluster
+func (p *poolPublisher) SetPools(pools []networkingv1alpha1.IPPool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.pools = pools
+	p.publish()
+}
+
+// SetPodCIDR publishes the pools again when the podCIDR is changed
+func (p *poolPublisher) SetPodCIDR(podCIDR string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.podCIDR = podCIDR
+	p.publish()
+}
+
+func (p *poolPublisher) publish() {
+	// podCIDR has been validated
+	_, podCIDR, err := net.ParseCIDR(p.podCIDR)
+	if err != nil {
+		klog.Warningf("error parsing podCIDR %q: %v", p.podCIDR, err)
+		return
+	}
+
+	var ipamPools []ipam.Pool
+	for i := range p.pools {
+		pool, err := ipam.PoolFromAPI(&p.pools[i], p.ipam.MaskSize)
+		if err != nil {
+			klog.Warningf("ignoring pool: %v", err)
+			continue
+		}
+		ipamPools = append(ipamPools, pool)
+	}
+	ipamPools = ipam.NonOverlapping(podCIDR, ipamPools)
+
+	var cidrs []*net.IPNet
+	for _, pool := range ipamPools {
+		cidrs = append(cidrs, pool.CIDR)
+	}
+
+	if p.nodeMap.SetPoolCIDRs(cidrs) {
+		klog.Infof("pool CIDRs are now %v", cidrs)
+	}
+	if p.ipamController != nil {
+		p.ipamController.SetPools(ipamPools)
+	}
+}
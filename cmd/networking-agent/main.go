@@ -27,19 +27,20 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 	"kope.io/networking"
 	"kope.io/networking/pkg/cni"
+	"kope.io/networking/pkg/ipam"
+	"kope.io/networking/pkg/policy"
 	"kope.io/networking/pkg/routing"
-	"kope.io/networking/pkg/routing/gre"
-	"kope.io/networking/pkg/routing/ipsec"
-	"kope.io/networking/pkg/routing/layer2"
-	"kope.io/networking/pkg/routing/vxlan"
-	"kope.io/networking/pkg/routing/vxlan2"
+	"kope.io/networking/pkg/routing/netutil"
+	_ "kope.io/networking/pkg/routing/providers"
 	"kope.io/networking/pkg/watchers"
 )
 
@@ -47,16 +48,28 @@ import (
 //	healthPort = 10249
 //)
 
+// configPath is where the kopeio-networking ConfigMap is mounted
+const configPath = "/config/config.yaml"
+
+// pathMTUProbeInterval is how often we re-measure the path MTU to each peer, if enabled
+const pathMTUProbeInterval = 10 * time.Minute
+
 func main() {
 	ctx := context.Background()
 
-	if err := run(ctx); err != nil {
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == "cleanup" {
+		err = runCleanup(os.Args[2:])
+	} else {
+		err = run(ctx, os.Args[1:])
+	}
+	if err != nil {
 		klog.Fatalf("unexpected error: %v", err)
 		os.Exit(1)
 	}
 }
 
-func run(ctx context.Context) error {
+func run(ctx context.Context, args []string) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -70,25 +83,14 @@ func run(ctx context.Context) error {
 
 	fmt.Fprintf(os.Stdout, "kopeio-networking %v %v\n", networking.Version, gitVersion)
 
-	options := &Options{}
-	options.InitDefaults()
-
-	err := options.LoadFrom("/config/config.yaml")
-	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("error reading config file: %v", err)
+	options, flagsSet, err := loadOptions(configPath, args, flag.ExitOnError)
+	if err != nil {
+		return err
 	}
-
-	flags := flag.NewFlagSet("", flag.ExitOnError)
-	options.AddFlags(flags)
-
-	klog.InitFlags(flags)
-
-	if options.LogLevel != nil {
-		flags.Set("v", strconv.Itoa(*options.LogLevel))
+	if !flagsSet["v"] {
+		setLogLevel(options.LogLevel)
 	}
 
-	flags.Parse(os.Args)
-
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		return fmt.Errorf("error building client configuration: %v", err)
@@ -99,6 +101,11 @@ func run(ctx context.Context) error {
 		return fmt.Errorf("error building REST client: %v", err)
 	}
 
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("error building dynamic client: %v", err)
+	}
+
 	var matcher func(node *corev1.Node) bool
 	if nodeName := os.Getenv("NODE_NAME"); nodeName != "" {
 		// Passing NODE_NAME via downward API is preferred
@@ -106,12 +113,12 @@ func run(ctx context.Context) error {
 		matcher = func(node *corev1.Node) bool {
 			return node.Name == nodeName
 		}
-	} else if options.MachineIDPath != "" {
+	} else if options.NodeIdentity.MachineIDPath != "" {
 		klog.Warningf("using MachineIDPath is deprecated - prefer passing NODE_NAME via downward API")
 
-		b, err := ioutil.ReadFile(options.MachineIDPath)
+		b, err := ioutil.ReadFile(options.NodeIdentity.MachineIDPath)
 		if err != nil {
-			return fmt.Errorf("error reading machine-id file %q: %v", options.MachineIDPath, err)
+			return fmt.Errorf("error reading machine-id file %q: %v", options.NodeIdentity.MachineIDPath, err)
 		}
 		machineID := string(b)
 		machineID = strings.TrimSpace(machineID)
@@ -120,12 +127,12 @@ func run(ctx context.Context) error {
 		matcher = func(node *corev1.Node) bool {
 			return node.Status.NodeInfo.MachineID == machineID
 		}
-	} else if options.SystemUUIDPath != "" {
+	} else if options.NodeIdentity.SystemUUIDPath != "" {
 		klog.Warningf("using SystemUUIDPath is deprecated - prefer passing NODE_NAME via downward API")
 
-		b, err := ioutil.ReadFile(options.SystemUUIDPath)
+		b, err := ioutil.ReadFile(options.NodeIdentity.SystemUUIDPath)
 		if err != nil {
-			return fmt.Errorf("error reading system-uuid file %q: %v", options.SystemUUIDPath, err)
+			return fmt.Errorf("error reading system-uuid file %q: %v", options.NodeIdentity.SystemUUIDPath, err)
 		}
 		systemUUID := string(b)
 		systemUUID = strings.TrimSpace(systemUUID)
@@ -139,12 +146,12 @@ func run(ctx context.Context) error {
 		matcher = func(node *corev1.Node) bool {
 			return node.Status.NodeInfo.SystemUUID == systemUUID
 		}
-	} else if options.BootIDPath != "" {
+	} else if options.NodeIdentity.BootIDPath != "" {
 		klog.Warningf("using BootIDPath is deprecated - prefer passing NODE_NAME via downward API")
 
-		b, err := ioutil.ReadFile(options.BootIDPath)
+		b, err := ioutil.ReadFile(options.NodeIdentity.BootIDPath)
 		if err != nil {
-			return fmt.Errorf("error reading boot-id file %q: %v", options.BootIDPath, err)
+			return fmt.Errorf("error reading boot-id file %q: %v", options.NodeIdentity.BootIDPath, err)
 		}
 		bootID := string(b)
 		bootID = strings.TrimSpace(bootID)
@@ -156,7 +163,7 @@ func run(ctx context.Context) error {
 	} else {
 		klog.Warningf("using NodeName is deprecated - prefer passing NODE_NAME via downward API")
 
-		matchNodeName := options.NodeName
+		matchNodeName := options.NodeIdentity.NodeName
 		if matchNodeName == "" {
 			hostname, err := os.Hostname()
 			if err != nil {
@@ -171,86 +178,43 @@ func run(ctx context.Context) error {
 		}
 	}
 
-	nodeMap := routing.NewNodeMap(matcher)
-
-	var targetLinkNames []string
-	if options.TargetLinkName != "" {
-		targetLinkNames = append(targetLinkNames, options.TargetLinkName)
+	addressSelector, err := routing.ParseAddressSelector(options.UnderlayAddressPriority)
+	if err != nil {
+		return fmt.Errorf("invalid underlayAddressPriority: %w", err)
 	}
-	if len(targetLinkNames) == 0 {
-		links, err := findTargetLinks()
-		if len(links) == 0 || err != nil {
-			return fmt.Errorf("unable to determine network device; pass --target to specify: %w", err)
-		}
-		targetLinkNames = links
+	nodeMap := routing.NewNodeMap(matcher, addressSelector)
+
+	// We start watching nodes early, because we use our node's address to find the target link
+	c, err := watchers.NewNodeController(kubeClient, nodeMap, options.ResyncPeriod.Duration)
+	if err != nil {
+		return fmt.Errorf("Failed to build node controller: %v", err)
 	}
+	go c.Run(ctx)
 
-	var provider routing.Provider
-	switch options.Provider {
-	case "layer2":
-		if len(targetLinkNames) != 1 {
-			return fmt.Errorf("expected exactly one target link with layer2; got %v", targetLinkNames)
-		}
-		provider, err = layer2.NewLayer2RoutingProvider(targetLinkNames[0])
-	case "gre":
-		provider, err = gre.NewGreRoutingProvider()
-	case "vxlan-legacy":
-		if len(targetLinkNames) != 1 {
-			return fmt.Errorf("expected exactly one target link with layer2; got %v", targetLinkNames)
-		}
-		_, overlayCIDR, _ := net.ParseCIDR(options.PodCIDR)
-		provider, err = vxlan.NewVxlanRoutingProvider(overlayCIDR, targetLinkNames[0])
-	case "vxlan":
-		_, overlayCIDR, _ := net.ParseCIDR(options.PodCIDR)
-		provider, err = vxlan2.NewVxlanRoutingProvider(overlayCIDR, targetLinkNames)
-	case "ipsec":
-		var authenticationStrategy ipsec.AuthenticationStrategy
-		var encryptionStrategy ipsec.EncryptionStrategy
-		var encapsulationStrategy ipsec.EncapsulationStrategy
-
-		switch options.IPSEC.Encryption {
-		case "none":
-			encryptionStrategy = &ipsec.PlaintextEncryptionStrategy{}
-		case "aes":
-			encryptionStrategy = &ipsec.AesEncryptionStrategy{}
-		default:
-			return fmt.Errorf("unknown ipsec-encryption: %v", options.IPSEC.Encryption)
-		}
-		switch options.IPSEC.Authentication {
-		case "none":
-			authenticationStrategy = &ipsec.PlaintextAuthenticationStrategy{}
-		case "sha1":
-			authenticationStrategy = &ipsec.HmacSha1AuthenticationStrategy{}
-		default:
-			return fmt.Errorf("unknown ipsec-authentication: %v", options.IPSEC.Authentication)
-		}
-		switch options.IPSEC.Encapsulation {
-		case "udp":
-			encapsulationStrategy = &ipsec.UdpEncapsulationStrategy{}
-		case "esp":
-			encapsulationStrategy = &ipsec.EspEncapsulationStrategy{}
-		default:
-			return fmt.Errorf("unknown ipsec-encapsulation: %v", options.IPSEC.Encapsulation)
+	// We allocate node CIDRs before building the provider, as the provider needs our own CIDR
+	var ipamController *ipam.Controller
+	if options.IPAM.Enabled {
+		ipamController, err = buildIPAMController(kubeClient, options)
+		if err != nil {
+			return err
 		}
-
-		var ipsecProvider *ipsec.IpsecRoutingProvider
-		ipsecProvider, err = ipsec.NewIpsecRoutingProvider(authenticationStrategy, encryptionStrategy, encapsulationStrategy)
-		if err == nil {
-			// TODO: This is only because state update is not working
-			klog.Warningf("TODO Doing ip xfrm flush; remove!!")
-			err := ipsecProvider.Flush()
-			if err != nil {
-				return fmt.Errorf("cannot flush tables")
+		go func() {
+			if err := runIPAM(ctx, kubeClient, ipamController); err != nil && ctx.Err() == nil {
+				klog.Errorf("ipam controller failed: %v", err)
 			}
-		}
-		provider = ipsecProvider
+		}()
+	}
 
-	default:
-		return fmt.Errorf("provider not known: %q", options.Provider)
+	pools := newPoolPublisher(options, nodeMap, ipamController)
+	pc, err := watchers.NewPoolController(dynamicClient, pools.SetPools)
+	if err != nil {
+		return fmt.Errorf("Failed to build pool controller: %v", err)
 	}
+	go pc.Run(ctx)
 
+	provider, stopProvider, err := buildProvider(ctx, options, nodeMap)
 	if err != nil {
-		return fmt.Errorf("failed to build provider %q: %v", options.Provider, err)
+		return err
 	}
 
 	//c, err := newRouteController(kubeClient, *resyncPeriod, *nodeName, bootID, systemUUID, machineID, provider)
@@ -263,21 +227,38 @@ func run(ctx context.Context) error {
 		cniWriter = &cni.SimpleConfigWriter{Path: options.CNIConfigPath}
 	}
 
-	c, err := watchers.NewNodeController(kubeClient, nodeMap)
+	masqueradeTable, err := buildMasqueradeTable(options)
 	if err != nil {
-		return fmt.Errorf("Failed to build node controller: %v", err)
+		return err
 	}
-	go c.Run(ctx)
 
-	rc, err := routing.NewController(kubeClient, nodeMap, provider, cniWriter)
+	if err := netutil.RegisterRouteProtocol(netutil.RouteProtocolsDir); err != nil {
+		klog.Warningf("unable to register route protocol name: %v", err)
+	}
+
+	rc, err := routing.NewController(kubeClient, nodeMap, options.Provider, provider, cniWriter, masqueradeTable)
 	if err != nil {
 		return fmt.Errorf("Failed to build routing controller: %v", err)
 	}
 	go rc.Run(ctx)
+
+	reloader := newConfigReloader(configPath, args, nodeMap, c, rc, pools, options, stopProvider)
+	go reloader.Run(ctx)
+
+	if options.NetworkPolicy {
+		pc, err := policy.NewController(kubeClient, nodeMap, cni.BridgeName)
+		if err != nil {
+			return fmt.Errorf("Failed to build network policy controller: %v", err)
+		}
+		go pc.Run(ctx)
+	} else if err := policy.Cleanup(); err != nil {
+		// Policy may have been enabled before; we do not want to leave pods isolated by rules that are no longer updated
+		klog.Warningf("error removing network policy rules: %v", err)
+	}
 	//go registerHandlers(c)
 
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP)
 
 	for {
 		select {
@@ -287,6 +268,11 @@ func run(ctx context.Context) error {
 			os.Exit(0)
 
 		case sig := <-signalChan:
+			if sig == syscall.SIGHUP {
+				klog.Infof("got signal %s, reloading configuration", sig.String())
+				reloader.Trigger()
+				continue
+			}
 			klog.Infof("got signal %s, exiting", sig.String())
 			cancel()
 		}
@@ -320,42 +306,178 @@ func run(ctx context.Context) error {
 //	klog.Fatal(server.ListenAndServe())
 //}
 
-// findTargetLinks attempts to discover the correct network interface(s)
-func findTargetLinks() ([]string, error) {
-	networkInterfaces, err := net.Interfaces()
+// loadOptions reads the config file at configPath, if it exists, and then applies the command line flags in args.
+// It returns the names of the flags that were set on the command line, which take precedence over the config file.
+func loadOptions(configPath string, args []string, errorHandling flag.ErrorHandling) (*Options, map[string]bool, error) {
+	options := &Options{}
+	options.InitDefaults()
+
+	err := options.LoadFrom(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	flags := flag.NewFlagSet("", errorHandling)
+	options.AddFlags(flags)
+
+	klog.InitFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	flagsSet := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		flagsSet[f.Name] = true
+	})
+
+	if err := options.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return options, flagsSet, nil
+}
+
+// setLogLevel sets the klog verbosity; it can be called while we are running
+func setLogLevel(logLevel *int) {
+	if logLevel == nil {
+		return
+	}
+	var level klog.Level
+	if err := level.Set(strconv.Itoa(*logLevel)); err != nil {
+		klog.Warningf("unable to set log level %d: %v", *logLevel, err)
+	}
+}
+
+// buildProvider discovers the target links and builds the routing provider.
+// The returned function stops the goroutines started for the provider, such as the path MTU prober.
+func buildProvider(ctx context.Context, options *Options, nodeMap *routing.NodeMap) (routing.Provider, context.CancelFunc, error) {
+	env, cancel, err := buildEnvironment(ctx, options, nodeMap)
 	if err != nil {
-		return nil, fmt.Errorf("error querying interfaces to determine primary network interface: %v", err)
+		return nil, nil, err
 	}
 
-	var candidates []*net.Interface
-	for i := range networkInterfaces {
-		networkInterface := &networkInterfaces[i]
-		flags := networkInterface.Flags
-		name := networkInterface.Name
+	provider, err := newProvider(options, env)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return provider, cancel, nil
+}
 
-		if (flags & net.FlagLoopback) != 0 {
-			klog.V(2).Infof("Ignoring interface %s - loopback", name)
-			continue
+// buildEnvironment discovers the target links and starts the path MTU prober, if enabled.
+// The returned function stops the prober.
+func buildEnvironment(ctx context.Context, options *Options, nodeMap *routing.NodeMap) (*routing.ProviderEnvironment, context.CancelFunc, error) {
+	var targetLinkNames []string
+	if options.TargetLinks.Name != "" {
+		targetLinkNames = append(targetLinkNames, options.TargetLinks.Name)
+	}
+	if len(targetLinkNames) == 0 {
+		filter, err := newTargetLinkFilter(options.TargetLinks.Include, options.TargetLinks.Exclude)
+		if err != nil {
+			return nil, nil, err
+		}
+		var nodeAddress net.IP
+		if filter.include == nil {
+			nodeAddress = waitForNodeAddress(ctx, nodeMap, nodeAddressTimeout)
+		}
+		links, err := findTargetLinks(nodeAddress, filter)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to determine network device; pass --target to specify: %w", err)
 		}
+		targetLinkNames = links
+	}
 
-		// Not a lot else to go on...
-		if !strings.HasPrefix(name, "eth") && !strings.HasPrefix(name, "en") {
-			klog.V(2).Infof("Ignoring interface %s - name does not look like ethernet device", name)
-			continue
+	// podCIDR has been validated
+	_, overlayCIDR, err := net.ParseCIDR(options.PodCIDR)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing podCIDR %q: %w", options.PodCIDR, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	var mtuProber *netutil.PathMTUProber
+	if options.PathMTUDiscovery {
+		// The probes are sent to the vxlan port, which peers accept whichever provider they run
+		vxlan, err := decodeVxlanConfig(options.ProviderSections()("vxlan"))
+		if err != nil {
+			cancel()
+			return nil, nil, err
 		}
+		mtuProber = netutil.NewPathMTUProber(vxlan.Port, pathMTUProbeInterval)
+		go mtuProber.Run(ctx)
+	}
 
-		candidates = append(candidates, networkInterface)
+	env := &routing.ProviderEnvironment{
+		OverlayCIDR:     overlayCIDR,
+		TargetLinkNames: targetLinkNames,
+		MTUProber:       mtuProber,
 	}
+	return env, cancel, nil
+}
 
-	if len(candidates) == 0 {
-		return nil, fmt.Errorf("unable to determine interface (no interfaces found)")
+// newProvider builds the routing provider named in options, for the environment env
+func newProvider(options *Options, env *routing.ProviderEnvironment) (routing.Provider, error) {
+	var provider routing.Provider
+	if options.Migration.FromProvider == "" {
+		var err error
+		provider, err = routing.NewProvider(options.Provider, options.ProviderSections(), env)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		klog.Infof("migrating from provider %q to provider %q", options.Migration.FromProvider, options.Provider)
+		from, err := routing.NewProvider(options.Migration.FromProvider, options.MigrationFromSections(), env)
+		if err != nil {
+			return nil, err
+		}
+		to, err := routing.NewProvider(options.Provider, options.ProviderSections(), env)
+		if err != nil {
+			return nil, err
+		}
+		provider = routing.NewMigrationProvider(options.Migration.FromProvider, from, options.Provider, to)
 	}
 
-	candidateNames := transform(candidates, func(i *net.Interface) string {
-		return i.Name
-	})
+	if options.MTU != 0 {
+		if configurable, ok := provider.(routing.MTUConfigurable); ok {
+			configurable.SetMTU(options.MTU)
+		} else {
+			klog.Warningf("provider %q does not support setting the MTU; ignoring mtu %d", options.Provider, options.MTU)
+		}
+	}
+	return provider, nil
+}
+
+// buildMasqueradeTable builds the masquerade configuration, returning nil if masquerade is disabled
+func buildMasqueradeTable(options *Options) (*netutil.MasqueradeTable, error) {
+	if !options.Masquerade.IsEnabled() {
+		return nil, nil
+	}
+	nonMasqueradeCIDRs, err := parseCIDRs(append([]string{options.PodCIDR}, options.Masquerade.NonMasqueradeCIDRs...))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing non-masquerade CIDRs: %w", err)
+	}
+	masqueradeTable, err := netutil.NewMasqueradeTable(nonMasqueradeCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("error building masquerade table: %w", err)
+	}
+	return masqueradeTable, nil
+}
 
-	return candidateNames, nil
+// parseCIDRs parses a list of CIDRs, ignoring empty values
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, s := range values {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing CIDR %q: %w", s, err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
 }
 
 func transform[T, V any](in []T, fn func(t T) V) []V {
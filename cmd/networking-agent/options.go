@@ -17,62 +17,34 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"time"
+	"strconv"
+	"strings"
 
-	"sigs.k8s.io/yaml"
+	"kope.io/networking/pkg/apis/config/v1alpha1"
 )
 
+// Options is the agent configuration, loaded from the config file and then overridden by flags
 type Options struct {
-	Provider       string `json:"provider"`
-	TargetLinkName string `json:"targetLinkName"`
-
-	ResyncPeriod time.Duration `json:"resyncPeriod"`
-
-	NodeName       string `json:"nodeName"`
-	MachineIDPath  string `json:"machineIDPath"`
-	SystemUUIDPath string `json:"systemUUIDPath"`
-	BootIDPath     string `json:"bootIDPath"`
-
-	IPSEC IPSECOptions `json:"ipsec"`
-
-	LogLevel *int `json:"logLevel"`
-
-	// PodCIDR is the address space allocated to pod networking
-	PodCIDR string `json:"podCIDR"`
-
-	// CNIConfigPath is the path to which we should write our CNI config
-	CNIConfigPath string `json:"cniConfigPath"`
-}
-
-type IPSECOptions struct {
-	Authentication string `json:"authentication"`
-	Encryption     string `json:"encryption"`
-	Encapsulation  string `json:"encapsulation"`
+	v1alpha1.AgentConfiguration
 }
 
 func (o *Options) InitDefaults() {
-	logLevel := 1
-	o.LogLevel = &logLevel
-
-	o.ResyncPeriod = 30 * time.Second
-	o.TargetLinkName = ""
-	o.Provider = "vxlan"
-
-	o.PodCIDR = "100.96.0.0/12"
-
-	o.SystemUUIDPath = "/sys/class/dmi/id/product_uuid"
+	o.AgentConfiguration = *v1alpha1.NewDefaultConfiguration()
+}
 
-	o.IPSEC.Authentication = "sha1"
-	o.IPSEC.Encapsulation = "udp"
-	o.IPSEC.Encryption = "aes"
+// Validate checks the options, returning all the problems found
+func (o *Options) Validate() error {
+	errs := v1alpha1.Validate(&o.AgentConfiguration)
+	errs = append(errs, validateAgentConfiguration(&o.AgentConfiguration)...)
+	return errs.ToAggregate()
 }
 
 func (options *Options) AddFlags(flags *flag.FlagSet) {
-	flags.DurationVar(&options.ResyncPeriod, "sync-period", options.ResyncPeriod,
+	flags.DurationVar(&options.ResyncPeriod.Duration, "sync-period", options.ResyncPeriod.Duration,
 		`Relist and confirm cloud resources this often.`)
 
 	//healthzPort = flags.Int("healthz-port", healthPort, "port for healthz endpoint.")
@@ -81,22 +53,55 @@ func (options *Options) AddFlags(flags *flag.FlagSet) {
 
 	flags.StringVar(&options.PodCIDR, "pod-cidr", options.PodCIDR, "CIDR for pod address space")
 
-	flags.StringVar(&options.NodeName, "node-name", options.NodeName, "name of this node")
+	flags.StringVar(&options.NodeIdentity.NodeName, "node-name", options.NodeIdentity.NodeName, "name of this node")
 
-	flags.StringVar(&options.MachineIDPath, "machine-id", options.MachineIDPath, "path to file containing machine id (as set in node status)")
-	flags.StringVar(&options.SystemUUIDPath, "system-uuid", options.SystemUUIDPath, "path to file containing system-uuid (as set in node status)")
-	flags.StringVar(&options.BootIDPath, "boot-id", options.BootIDPath, "path to file containing boot-id (as set in node status)")
+	flags.StringVar(&options.NodeIdentity.MachineIDPath, "machine-id", options.NodeIdentity.MachineIDPath, "path to file containing machine id (as set in node status)")
+	flags.StringVar(&options.NodeIdentity.SystemUUIDPath, "system-uuid", options.NodeIdentity.SystemUUIDPath, "path to file containing system-uuid (as set in node status)")
+	flags.StringVar(&options.NodeIdentity.BootIDPath, "boot-id", options.NodeIdentity.BootIDPath, "path to file containing boot-id (as set in node status)")
 
 	flags.StringVar(&options.Provider, "provider", options.Provider, "route backend to use")
 
-	flags.StringVar(&options.TargetLinkName, "target", options.TargetLinkName, "network link to use for actual packet transport")
+	flags.StringVar(&options.TargetLinks.Name, "target", options.TargetLinks.Name, "network link to use for actual packet transport")
+	flags.StringVar(&options.TargetLinks.Include, "target-include", options.TargetLinks.Include, "regular expression selecting the network links to use for packet transport, instead of discovering them")
+	flags.StringVar(&options.TargetLinks.Exclude, "target-exclude", options.TargetLinks.Exclude, "regular expression for network links that should not be used for packet transport")
+
+	flags.Func("underlay-address-priority", "comma-separated priority list for choosing node addresses: Annotation, InternalIP, ExternalIP or CIDRs", func(s string) error {
+		options.UnderlayAddressPriority = strings.Split(s, ",")
+		return nil
+	})
 
-	flags.StringVar(&options.IPSEC.Encryption, "ipsec-encryption", options.IPSEC.Encryption, "encryption method to use (for IPSEC)")
-	flags.StringVar(&options.IPSEC.Authentication, "ipsec-authentication", options.IPSEC.Authentication, "authentication method to use (for IPSEC)")
-	flags.StringVar(&options.IPSEC.Encapsulation, "ipsec-encapsulation", options.IPSEC.Encapsulation, "encapsulation method to use (for IPSEC)")
+	flags.Func("ipsec-encryption", "encryption method to use (for IPSEC)", options.providerConfigStringFlag("ipsec", "encryption"))
+	flags.Func("ipsec-authentication", "authentication method to use (for IPSEC)", options.providerConfigStringFlag("ipsec", "authentication"))
+	flags.Func("ipsec-encapsulation", "encapsulation method to use (for IPSEC)", options.providerConfigStringFlag("ipsec", "encapsulation"))
+
+	flags.Func("vxlan-vni", "VXLAN network identifier (for vxlan)", options.providerConfigIntFlag("vxlan", "vni"))
+	flags.Func("vxlan-port", "UDP port for VXLAN traffic (for vxlan)", options.providerConfigIntFlag("vxlan", "port"))
+	flags.Func("vxlan-device", "name of the vxlan device; defaults to vxlan<vni> (for vxlan)", options.providerConfigStringFlag("vxlan", "deviceName"))
 
 	flags.StringVar(&options.CNIConfigPath, "cni-config", options.CNIConfigPath, "path where we should write CNI configuration")
 
+	flags.BoolFunc("masquerade", "masquerade pod traffic to destinations outside the pod network", func(s string) error {
+		enabled, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		options.Masquerade.Enabled = &enabled
+		return nil
+	})
+	flags.Func("non-masquerade-cidrs", "comma-separated CIDRs that pods should reach without masquerade", func(s string) error {
+		options.Masquerade.NonMasqueradeCIDRs = strings.Split(s, ",")
+		return nil
+	})
+
+	flags.IntVar(&options.MTU, "mtu", options.MTU, "MTU of the overlay device; if zero it is computed from the underlay MTU (for vxlan)")
+
+	flags.BoolVar(&options.PathMTUDiscovery, "path-mtu-discovery", options.PathMTUDiscovery, "probe the path MTU to each peer (for vxlan and gre)")
+
+	flags.BoolVar(&options.IPAM.Enabled, "ipam", options.IPAM.Enabled, "allocate node PodCIDRs from the pod CIDR, if kube-controller-manager does not")
+	flags.IntVar(&options.IPAM.NodeMaskSize, "ipam-node-mask-size", options.IPAM.NodeMaskSize, "prefix length of allocated node PodCIDRs; if zero, 24 for IPv4 or 64 for IPv6")
+
+	flags.BoolVar(&options.NetworkPolicy, "network-policy", options.NetworkPolicy, "enforce NetworkPolicy for pods on this node")
+
 	// I can't figure out how to get a serviceaccount in a manifest-controlled pod
 	//inCluster = flags.Bool("running-in-cluster", true,
 	//	`Optional, if this controller is running in a kubernetes cluster, use the
@@ -105,8 +110,48 @@ func (options *Options) AddFlags(flags *flag.FlagSet) {
 	//flags.BoolVar(options.Profiling, "profiling", options.Profiling, `Enable profiling via web interface host:port/debug/pprof/`)
 }
 
+// providerConfigStringFlag returns a flag function that sets a string field in a providerConfig section
+func (options *Options) providerConfigStringFlag(section, name string) func(string) error {
+	return func(s string) error {
+		return options.setProviderConfigField(section, name, s)
+	}
+}
+
+// providerConfigIntFlag returns a flag function that sets an integer field in a providerConfig section
+func (options *Options) providerConfigIntFlag(section, name string) func(string) error {
+	return func(s string) error {
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		return options.setProviderConfigField(section, name, v)
+	}
+}
+
+// setProviderConfigField sets one field in a providerConfig section, keeping the other fields of the section
+func (options *Options) setProviderConfigField(section, name string, value interface{}) error {
+	fields := make(map[string]interface{})
+	if raw := options.ProviderConfig[section]; len(raw) != 0 {
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return fmt.Errorf("error parsing providerConfig.%s: %w", section, err)
+		}
+	}
+	fields[name] = value
+
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Errorf("error building providerConfig.%s: %w", section, err)
+	}
+	if options.ProviderConfig == nil {
+		options.ProviderConfig = make(map[string]json.RawMessage)
+	}
+	options.ProviderConfig[section] = raw
+	return nil
+}
+
+// LoadFrom replaces the options with the config file at p, in either the versioned or the legacy format
 func (options *Options) LoadFrom(p string) error {
-	data, err := ioutil.ReadFile(p)
+	data, err := os.ReadFile(p)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return err
@@ -114,9 +159,10 @@ func (options *Options) LoadFrom(p string) error {
 		return fmt.Errorf("error reading file %q: %v", p, err)
 	}
 
-	err = yaml.Unmarshal(data, options)
+	c, err := v1alpha1.Load(data)
 	if err != nil {
 		return fmt.Errorf("error parsing file %q: %v", p, err)
 	}
+	options.AgentConfiguration = *c
 	return nil
 }
@@ -16,7 +16,14 @@ limitations under the License.
 
 package main
 
-import "testing"
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
 
 func TestDefaultOptions(t *testing.T) {
 	o := &Options{}
@@ -25,3 +32,62 @@ func TestDefaultOptions(t *testing.T) {
 		t.Errorf("unexpected default provider %q", o.Provider)
 	}
 }
+
+func TestVXLANOptions(t *testing.T) {
+	o := &Options{}
+	o.InitDefaults()
+	if err := o.Validate(); err != nil {
+		t.Fatalf("default options are not valid: %v", err)
+	}
+
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	config := "vxlan:\n  vni: 42\n  port: 8472\n  sourcePortLow: 1000\n"
+	if err := os.WriteFile(p, []byte(config), 0644); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+	if err := o.LoadFrom(p); err != nil {
+		t.Fatalf("error loading config: %v", err)
+	}
+	vxlan, err := decodeVxlanConfig(o.ProviderConfig["vxlan"])
+	if err != nil {
+		t.Fatalf("error decoding vxlan options: %v", err)
+	}
+	if vxlan.VNI != 42 || vxlan.Port != 8472 || vxlan.Name() != "vxlan42" {
+		t.Errorf("unexpected vxlan options %+v", vxlan)
+	}
+
+	err = o.Validate()
+	if err == nil || !strings.Contains(err.Error(), "source port range") {
+		t.Errorf("expected source port range error, got %v", err)
+	}
+}
+
+func TestProviderConfigFlags(t *testing.T) {
+	o := &Options{}
+	o.InitDefaults()
+	o.ProviderConfig = map[string]json.RawMessage{"vxlan": json.RawMessage(`{"port":8472}`)}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	o.AddFlags(flags)
+	if err := flags.Parse([]string{"--vxlan-vni=42", "--ipsec-encryption=none"}); err != nil {
+		t.Fatalf("error parsing flags: %v", err)
+	}
+
+	vxlan, err := decodeVxlanConfig(o.ProviderConfig["vxlan"])
+	if err != nil {
+		t.Fatalf("error decoding vxlan options: %v", err)
+	}
+	if vxlan.VNI != 42 || vxlan.Port != 8472 {
+		t.Errorf("unexpected vxlan options %+v", vxlan)
+	}
+	if ipsec := string(o.ProviderConfig["ipsec"]); ipsec != `{"encryption":"none"}` {
+		t.Errorf("unexpected ipsec options %s", ipsec)
+	}
+	if err := o.Validate(); err != nil {
+		t.Errorf("unexpected validation error: %v", err)
+	}
+
+	if err := flags.Parse([]string{"--vxlan-port=udp"}); err == nil {
+		t.Errorf("expected an error for a non-numeric vxlan port")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"k8s.io/klog/v2"
+	"kope.io/networking/pkg/apis/config/v1alpha1"
+	"kope.io/networking/pkg/routing"
+	"kope.io/networking/pkg/watchers"
+)
+
+// configPollInterval is how often we check the config file for changes.
+// The kubelet updates a mounted ConfigMap by swapping a symlink, so we compare contents rather than watching the file.
+const configPollInterval = 10 * time.Second
+
+// configChanges describes the differences between two configurations, grouped by how we apply them
+type configChanges struct {
+	// logLevel, resyncPeriod, masquerade, pools and mtu are applied in place
+	logLevel     bool
+	resyncPeriod bool
+	masquerade   bool
+	pools        bool
+	mtu          bool
+
+	// environment is set if the target links or path MTU discovery changed, which most providers can apply in place;
+	// if the running provider cannot, we tear it down and build a new one
+	environment bool
+
+	// provider is set if we must tear down the routing provider and build a new one
+	provider bool
+
+	// restartRequired lists the changed fields that only take effect when the agent restarts
+	restartRequired []string
+}
+
+// isEmpty is true if there are no changes
+func (c *configChanges) isEmpty() bool {
+	return !c.logLevel && !c.resyncPeriod && !c.masquerade && !c.pools && !c.mtu && !c.environment && !c.provider && len(c.restartRequired) == 0
+}
+
+// diffConfig compares the running configuration with a new configuration
+func diffConfig(running, next *v1alpha1.AgentConfiguration) *configChanges {
+	changes := &configChanges{}
+
+	// The ipam allocator cannot change its CIDR while it is running, so with ipam the PodCIDR only changes when we restart
+	podCIDRChanged := running.PodCIDR != next.PodCIDR
+	if podCIDRChanged && running.IPAM.Enabled {
+		changes.restartRequired = append(changes.restartRequired, "podCIDR")
+		podCIDRChanged = false
+	}
+
+	changes.logLevel = !reflect.DeepEqual(running.LogLevel, next.LogLevel)
+	changes.resyncPeriod = running.ResyncPeriod != next.ResyncPeriod
+	// The PodCIDR is never masqueraded, so it is part of the masquerade configuration
+	changes.masquerade = !reflect.DeepEqual(running.Masquerade, next.Masquerade) || podCIDRChanged
+	// IPPools that overlap the PodCIDR are ignored
+	changes.pools = podCIDRChanged
+	changes.mtu = running.MTU != next.MTU
+
+	changes.environment = running.TargetLinks != next.TargetLinks ||
+		running.PathMTUDiscovery != next.PathMTUDiscovery
+
+	changes.provider = running.Provider != next.Provider ||
+		podCIDRChanged ||
+		!reflect.DeepEqual(running.ProviderConfig, next.ProviderConfig) ||
+		!reflect.DeepEqual(running.Migration, next.Migration)
+
+	if running.NodeIdentity != next.NodeIdentity {
+		changes.restartRequired = append(changes.restartRequired, "nodeIdentity")
+	}
+	if !reflect.DeepEqual(running.UnderlayAddressPriority, next.UnderlayAddressPriority) {
+		changes.restartRequired = append(changes.restartRequired, "underlayAddressPriority")
+	}
+	if running.CNIConfigPath != next.CNIConfigPath {
+		changes.restartRequired = append(changes.restartRequired, "cniConfigPath")
+	}
+	if running.NetworkPolicy != next.NetworkPolicy {
+		changes.restartRequired = append(changes.restartRequired, "networkPolicy")
+	}
+	if running.IPAM != next.IPAM {
+		changes.restartRequired = append(changes.restartRequired, "ipam")
+	}
+
+	return changes
+}
+
+// configReloader applies changes to the config file while the agent is running.
+// Changes are applied all-or-nothing: if we cannot build the new provider we keep running with the old configuration,
+// and retry on the next poll.  An invalid config file is ignored until it changes again.
+type configReloader struct {
+	configPath string
+	// args are the command line arguments, which take precedence over the config file
+	args []string
+
+	nodeMap         *routing.NodeMap
+	nodeController  *watchers.NodeController
+	routeController *routing.Controller
+	pools           *poolPublisher
+
+	// current is the running configuration
+	current *Options
+
+	// stopProvider stops the goroutines started for the current provider
+	stopProvider context.CancelFunc
+
+	// lastData is the contents of the config file we last loaded
+	lastData []byte
+
+	trigger chan struct{}
+}
+
+// newConfigReloader builds a configReloader, starting from the running configuration in current
+func newConfigReloader(configPath string, args []string, nodeMap *routing.NodeMap, nodeController *watchers.NodeController, routeController *routing.Controller, pools *poolPublisher, current *Options, stopProvider context.CancelFunc) *configReloader {
+	return &configReloader{
+		configPath:      configPath,
+		args:            args,
+		nodeMap:         nodeMap,
+		nodeController:  nodeController,
+		routeController: routeController,
+		pools:           pools,
+		current:         current,
+		stopProvider:    stopProvider,
+		trigger:         make(chan struct{}, 1),
+	}
+}
+
+// Trigger requests that we reload the config file now, even if it has not changed
+func (r *configReloader) Trigger() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run polls the config file, applying changes, until ctx is cancelled
+func (r *configReloader) Run(ctx context.Context) {
+	data, err := os.ReadFile(r.configPath)
+	if err != nil && !os.IsNotExist(err) {
+		klog.Warningf("error reading config file %q: %v", r.configPath, err)
+	}
+	r.lastData = data
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		force := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.trigger:
+			force = true
+		}
+
+		if err := r.reload(ctx, force); err != nil {
+			klog.Warningf("error reloading configuration, will retry: %v", err)
+		}
+	}
+}
+
+// reload applies the config file if it has changed since we last loaded it, or if force is set
+func (r *configReloader) reload(ctx context.Context, force bool) error {
+	data, err := os.ReadFile(r.configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading config file %q: %w", r.configPath, err)
+	}
+	if !force && bytes.Equal(data, r.lastData) {
+		return nil
+	}
+
+	options, flagsSet, err := loadOptions(r.configPath, r.args, flag.ContinueOnError)
+	if err != nil {
+		// Retrying will not help until the file is fixed, so we don't retry until it changes again
+		r.lastData = data
+		klog.Warningf("ignoring changed config file; continuing with the running configuration: %v", err)
+		return nil
+	}
+
+	changes := diffConfig(&r.current.AgentConfiguration, &options.AgentConfiguration)
+	if changes.isEmpty() {
+		klog.V(2).Infof("config file changed, but the configuration is unchanged")
+		r.lastData = data
+		return nil
+	}
+
+	if err := r.apply(ctx, options, flagsSet, changes); err != nil {
+		return err
+	}
+	r.lastData = data
+	return nil
+}
+
+// apply moves the agent from the running configuration to options
+func (r *configReloader) apply(ctx context.Context, options *Options, flagsSet map[string]bool, changes *configChanges) error {
+	// We build the new environment and provider first, so that a failure leaves everything as it was.
+	// If only the environment changed we change it in place if we can, because rebuilding the provider would recreate
+	// its devices and interrupt traffic; we only build a new provider if the running provider cannot change it.
+	var env *routing.ProviderEnvironment
+	var provider routing.Provider
+	var stopProvider context.CancelFunc
+	environmentInPlace := false
+	if changes.provider || changes.environment {
+		var err error
+		env, stopProvider, err = buildEnvironment(ctx, options, r.nodeMap)
+		if err != nil {
+			return fmt.Errorf("error discovering target links: %w", err)
+		}
+
+		if !changes.provider {
+			if err := r.routeController.SetEnvironment(env); err != nil {
+				klog.Infof("rebuilding routing provider to change target links or path MTU discovery: %v", err)
+			} else {
+				environmentInPlace = true
+			}
+		} else {
+			klog.Infof("configuration change requires switching routing provider from %q to %q", r.current.Provider, options.Provider)
+		}
+
+		if !environmentInPlace {
+			provider, err = newProvider(options, env)
+			if err != nil {
+				stopProvider()
+				return fmt.Errorf("error building new routing provider: %w", err)
+			}
+		}
+	}
+
+	if len(changes.restartRequired) != 0 {
+		klog.Warningf("changes to %v take effect only when the agent is restarted", changes.restartRequired)
+		options.NodeIdentity = r.current.NodeIdentity
+		options.UnderlayAddressPriority = r.current.UnderlayAddressPriority
+		options.CNIConfigPath = r.current.CNIConfigPath
+		options.NetworkPolicy = r.current.NetworkPolicy
+		options.IPAM = r.current.IPAM
+		if r.current.IPAM.Enabled {
+			options.PodCIDR = r.current.PodCIDR
+		}
+	}
+
+	if changes.logLevel {
+		if flagsSet["v"] {
+			klog.Infof("log level is set on the command line; ignoring logLevel in config file")
+		} else {
+			klog.Infof("changing log level to %d", *options.LogLevel)
+			setLogLevel(options.LogLevel)
+		}
+	}
+
+	if changes.resyncPeriod {
+		klog.Infof("changing resync period to %v", options.ResyncPeriod.Duration)
+		r.nodeController.SetResyncPeriod(options.ResyncPeriod.Duration)
+	}
+
+	if changes.masquerade {
+		masqueradeTable, err := buildMasqueradeTable(options)
+		if err == nil {
+			klog.Infof("changing masquerade configuration: enabled=%v, nonMasqueradeCIDRs=%v", options.Masquerade.IsEnabled(), options.Masquerade.NonMasqueradeCIDRs)
+			err = r.routeController.SetMasqueradeTable(masqueradeTable)
+		}
+		if err != nil {
+			// The configuration was validated, so this is unexpected; we keep going so the provider is consistent
+			klog.Warningf("error changing masquerade configuration: %v", err)
+		}
+	}
+
+	if changes.pools {
+		klog.Infof("changing the pod CIDR that IPPools must not overlap to %s", options.PodCIDR)
+		r.pools.SetPodCIDR(options.PodCIDR)
+	}
+
+	if environmentInPlace {
+		klog.Infof("changed target links to %v and path MTU discovery to %v in place", env.TargetLinkNames, options.PathMTUDiscovery)
+		r.routeController.SetMTU(options.MTU)
+		r.stopProvider()
+		r.stopProvider = stopProvider
+	} else if provider != nil {
+		r.routeController.SwitchProvider(options.Provider, provider)
+		r.stopProvider()
+		r.stopProvider = stopProvider
+		klog.Infof("switched to routing provider %q", options.Provider)
+	} else if changes.mtu {
+		if r.routeController.SetMTU(options.MTU) {
+			klog.Infof("changing MTU to %d", options.MTU)
+		} else {
+			klog.Warningf("provider %q does not support setting the MTU; ignoring mtu %d", options.Provider, options.MTU)
+		}
+	}
+
+	r.current = options
+	return nil
+}
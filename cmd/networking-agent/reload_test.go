@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+	"kope.io/networking/pkg/apis/config/v1alpha1"
+	"kope.io/networking/pkg/routing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	grid := []struct {
+		name string
+		// ipam enables ipam in both configurations
+		ipam     bool
+		mutate   func(c *v1alpha1.AgentConfiguration)
+		expected configChanges
+	}{
+		{
+			name:     "unchanged",
+			mutate:   func(c *v1alpha1.AgentConfiguration) {},
+			expected: configChanges{},
+		},
+		{
+			name: "log level",
+			mutate: func(c *v1alpha1.AgentConfiguration) {
+				logLevel := 4
+				c.LogLevel = &logLevel
+			},
+			expected: configChanges{logLevel: true},
+		},
+		{
+			name: "resync period",
+			mutate: func(c *v1alpha1.AgentConfiguration) {
+				c.ResyncPeriod.Duration = time.Minute
+			},
+			expected: configChanges{resyncPeriod: true},
+		},
+		{
+			name: "non-masquerade CIDRs",
+			mutate: func(c *v1alpha1.AgentConfiguration) {
+				c.Masquerade.NonMasqueradeCIDRs = []string{"10.0.0.0/8"}
+			},
+			expected: configChanges{masquerade: true},
+		},
+		{
+			name: "mtu",
+			mutate: func(c *v1alpha1.AgentConfiguration) {
+				c.MTU = 1400
+			},
+			expected: configChanges{mtu: true},
+		},
+		{
+			name: "provider",
+			mutate: func(c *v1alpha1.AgentConfiguration) {
+				c.Provider = "ipsec"
+			},
+			expected: configChanges{provider: true},
+		},
+		{
+			name: "target links",
+			mutate: func(c *v1alpha1.AgentConfiguration) {
+				c.TargetLinks.Name = "eth1"
+			},
+			expected: configChanges{environment: true},
+		},
+		{
+			name: "path MTU discovery",
+			mutate: func(c *v1alpha1.AgentConfiguration) {
+				c.PathMTUDiscovery = true
+			},
+			expected: configChanges{environment: true},
+		},
+		{
+			name: "vxlan port",
+			mutate: func(c *v1alpha1.AgentConfiguration) {
+				c.ProviderConfig = map[string]json.RawMessage{"vxlan": json.RawMessage(`{"port":8472}`)}
+			},
+			expected: configChanges{provider: true},
+		},
+		{
+			name: "pod CIDR",
+			mutate: func(c *v1alpha1.AgentConfiguration) {
+				c.PodCIDR = "10.96.0.0/12"
+			},
+			expected: configChanges{provider: true, masquerade: true, pools: true},
+		},
+		{
+			name: "pod CIDR with ipam",
+			ipam: true,
+			mutate: func(c *v1alpha1.AgentConfiguration) {
+				c.PodCIDR = "10.96.0.0/12"
+			},
+			expected: configChanges{restartRequired: []string{"podCIDR"}},
+		},
+		{
+			name: "restart required",
+			mutate: func(c *v1alpha1.AgentConfiguration) {
+				c.NetworkPolicy = true
+				c.UnderlayAddressPriority = []string{"ExternalIP"}
+			},
+			expected: configChanges{restartRequired: []string{"underlayAddressPriority", "networkPolicy"}},
+		},
+	}
+	for _, g := range grid {
+		t.Run(g.name, func(t *testing.T) {
+			running := v1alpha1.NewDefaultConfiguration()
+			next := v1alpha1.NewDefaultConfiguration()
+			running.IPAM.Enabled = g.ipam
+			next.IPAM.Enabled = g.ipam
+			g.mutate(next)
+
+			actual := diffConfig(running, next)
+			if !reflect.DeepEqual(*actual, g.expected) {
+				t.Errorf("unexpected changes %+v, expected %+v", *actual, g.expected)
+			}
+			if actual.isEmpty() != reflect.DeepEqual(g.expected, configChanges{}) {
+				t.Errorf("unexpected isEmpty %v", actual.isEmpty())
+			}
+		})
+	}
+}
+
+// recordingProvider stands in for the running provider, recording whether the reloader tore it down
+type recordingProvider struct {
+	tornDown bool
+	// onTeardown is called when we are torn down; optional
+	onTeardown func()
+}
+
+func (p *recordingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
+	return nil
+}
+
+func (p *recordingProvider) Teardown() error {
+	p.tornDown = true
+	if p.onTeardown != nil {
+		p.onTeardown()
+	}
+	return nil
+}
+
+// configurableProvider is a recordingProvider that can change its environment in place
+type configurableProvider struct {
+	recordingProvider
+	env *routing.ProviderEnvironment
+}
+
+func (p *configurableProvider) SetEnvironment(env *routing.ProviderEnvironment) error {
+	p.env = env
+	return nil
+}
+
+// buildTestReloader builds a configReloader running provider with the configuration in current
+func buildTestReloader(t *testing.T, current *Options, provider routing.Provider) (*configReloader, *bool) {
+	nodeMap := routing.NewNodeMap(nil, nil)
+	routeController, err := routing.NewController(fake.NewSimpleClientset(), nodeMap, current.Provider, provider, nil, nil)
+	if err != nil {
+		t.Fatalf("error building controller: %v", err)
+	}
+	stopped := false
+	pools := newPoolPublisher(current, nodeMap, nil)
+	r := newConfigReloader("", nil, nodeMap, nil, routeController, pools, current, func() { stopped = true })
+	return r, &stopped
+}
+
+func buildTestOptions(provider string) *Options {
+	options := &Options{}
+	options.InitDefaults()
+	options.Provider = provider
+	// Naming the target link means we don't wait for our node's address
+	options.TargetLinks.Name = "lo"
+	return options
+}
+
+func TestReloadIpsecToIpsec(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The running provider holds the UDP encapsulation port until it is torn down
+	listener, err := net.ListenPacket("udp4", ":4500")
+	if err != nil {
+		t.Skipf("cannot listen on the UDP encapsulation port: %v", err)
+	}
+	running := &recordingProvider{onTeardown: func() { listener.Close() }}
+	defer listener.Close()
+
+	current := buildTestOptions("ipsec")
+	r, stopped := buildTestReloader(t, current, running)
+
+	next := buildTestOptions("ipsec")
+	next.ProviderConfig = map[string]json.RawMessage{"ipsec": json.RawMessage(`{"encryption":"none"}`)}
+	changes := diffConfig(&current.AgentConfiguration, &next.AgentConfiguration)
+	if !changes.provider {
+		t.Fatalf("expected a provider change, got %+v", *changes)
+	}
+	if err := r.apply(ctx, next, nil, changes); err != nil {
+		t.Fatalf("error from apply: %v", err)
+	}
+	if !running.tornDown || !*stopped {
+		t.Errorf("expected the running provider to be torn down and stopped")
+	}
+	if r.current != next {
+		t.Errorf("expected the new configuration to be running")
+	}
+}
+
+func TestReloadEnvironment(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := buildTestOptions("gre")
+	next.PathMTUDiscovery = true
+
+	// A provider that can change its environment is not rebuilt
+	configurable := &configurableProvider{}
+	current := buildTestOptions("gre")
+	r, stopped := buildTestReloader(t, current, configurable)
+	if err := r.apply(ctx, next, nil, diffConfig(&current.AgentConfiguration, &next.AgentConfiguration)); err != nil {
+		t.Fatalf("error from apply: %v", err)
+	}
+	if configurable.tornDown {
+		t.Errorf("provider was torn down")
+	}
+	if configurable.env == nil || configurable.env.MTUProber == nil || !reflect.DeepEqual(configurable.env.TargetLinkNames, []string{"lo"}) {
+		t.Errorf("unexpected environment %+v", configurable.env)
+	}
+	if !*stopped {
+		t.Errorf("expected the goroutines of the previous environment to be stopped")
+	}
+
+	// Other providers are rebuilt
+	running := &recordingProvider{}
+	current = buildTestOptions("gre")
+	r, stopped = buildTestReloader(t, current, running)
+	if err := r.apply(ctx, next, nil, diffConfig(&current.AgentConfiguration, &next.AgentConfiguration)); err != nil {
+		t.Fatalf("error from apply: %v", err)
+	}
+	if !running.tornDown || !*stopped {
+		t.Errorf("expected the running provider to be torn down and stopped")
+	}
+}
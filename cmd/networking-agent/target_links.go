@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"kope.io/networking/pkg/routing"
+)
+
+// nodeAddressTimeout is how long we wait for our node to appear with an address, before falling back to the default route
+const nodeAddressTimeout = 30 * time.Second
+
+// targetLinkCandidate is a network interface we could use for packet transport
+type targetLinkCandidate struct {
+	Name  string
+	Addrs []*net.IPNet
+	// DefaultRoute is true if an IPv4 default route in the main table goes via this link
+	DefaultRoute bool
+}
+
+func (c *targetLinkCandidate) String() string {
+	var addrs []string
+	for _, addr := range c.Addrs {
+		addrs = append(addrs, addr.String())
+	}
+	s := c.Name + " [" + strings.Join(addrs, " ") + "]"
+	if c.DefaultRoute {
+		s += " (default route)"
+	}
+	return s
+}
+
+// targetLinkFilter restricts the interfaces considered for packet transport
+type targetLinkFilter struct {
+	// include, if set, selects the interfaces to use, skipping discovery
+	include *regexp.Regexp
+	// exclude, if set, removes interfaces from consideration
+	exclude *regexp.Regexp
+}
+
+// newTargetLinkFilter builds a targetLinkFilter from regular expressions; empty expressions are ignored
+func newTargetLinkFilter(include, exclude string) (*targetLinkFilter, error) {
+	f := &targetLinkFilter{}
+	if include != "" {
+		r, err := regexp.Compile(include)
+		if err != nil {
+			return nil, fmt.Errorf("invalid targetLinks.include %q: %w", include, err)
+		}
+		f.include = r
+	}
+	if exclude != "" {
+		r, err := regexp.Compile(exclude)
+		if err != nil {
+			return nil, fmt.Errorf("invalid targetLinks.exclude %q: %w", exclude, err)
+		}
+		f.exclude = r
+	}
+	return f, nil
+}
+
+func (f *targetLinkFilter) matches(name string) bool {
+	if f.include != nil && !f.include.MatchString(name) {
+		return false
+	}
+	if f.exclude != nil && f.exclude.MatchString(name) {
+		return false
+	}
+	return true
+}
+
+// findTargetLinks attempts to discover the correct network interface(s).
+// nodeAddress is the address of our node, if known.
+func findTargetLinks(nodeAddress net.IP, filter *targetLinkFilter) ([]string, error) {
+	candidates, err := listTargetLinkCandidates()
+	if err != nil {
+		return nil, err
+	}
+	return chooseTargetLinks(candidates, nodeAddress, filter)
+}
+
+// chooseTargetLinks picks the interfaces for packet transport from candidates:
+// every interface matching the include filter if one is set,
+// otherwise the interface holding nodeAddress, otherwise the interface(s) with the default route.
+func chooseTargetLinks(candidates []*targetLinkCandidate, nodeAddress net.IP, filter *targetLinkFilter) ([]string, error) {
+	var filtered []*targetLinkCandidate
+	for _, candidate := range candidates {
+		if !filter.matches(candidate.Name) {
+			klog.V(2).Infof("Ignoring interface %s - excluded by configuration", candidate.Name)
+			continue
+		}
+		filtered = append(filtered, candidate)
+	}
+
+	names := transform(filtered, func(c *targetLinkCandidate) string {
+		return c.Name
+	})
+
+	if filter.include != nil {
+		if len(filtered) == 0 {
+			return nil, fmt.Errorf("no interfaces match targetLinks.include %q; candidates are: %s", filter.include, describeCandidates(candidates))
+		}
+		klog.Infof("using interfaces %v, matching targetLinks.include", names)
+		return names, nil
+	}
+
+	if nodeAddress != nil {
+		for _, candidate := range filtered {
+			for _, addr := range candidate.Addrs {
+				if addr.IP.Equal(nodeAddress) {
+					klog.Infof("using interface %s, which holds node address %s", candidate.Name, nodeAddress)
+					return []string{candidate.Name}, nil
+				}
+			}
+		}
+		klog.Warningf("no interface holds node address %s; falling back to the default route", nodeAddress)
+	}
+
+	var defaultRoute []string
+	for _, candidate := range filtered {
+		if candidate.DefaultRoute {
+			defaultRoute = append(defaultRoute, candidate.Name)
+		}
+	}
+	if len(defaultRoute) != 0 {
+		klog.Infof("using interfaces %v, which have the default route", defaultRoute)
+		return defaultRoute, nil
+	}
+
+	nodeAddressDescription := "unknown"
+	if nodeAddress != nil {
+		nodeAddressDescription = nodeAddress.String()
+	}
+	return nil, fmt.Errorf("no interface holds the node address (%s) or has a default route; candidates are: %s", nodeAddressDescription, describeCandidates(filtered))
+}
+
+func describeCandidates(candidates []*targetLinkCandidate) string {
+	if len(candidates) == 0 {
+		return "none"
+	}
+	return strings.Join(transform(candidates, func(c *targetLinkCandidate) string {
+		return c.String()
+	}), ", ")
+}
+
+// listTargetLinkCandidates returns the interfaces that are up and are not loopback, with their addresses
+func listTargetLinkCandidates() ([]*targetLinkCandidate, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("error listing interfaces: %w", err)
+	}
+
+	defaultRouteLinks := make(map[int]bool)
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: syscall.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("error listing routes: %w", err)
+	}
+	for _, route := range routes {
+		if route.Dst != nil {
+			if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		defaultRouteLinks[route.LinkIndex] = true
+		for _, nexthop := range route.MultiPath {
+			defaultRouteLinks[nexthop.LinkIndex] = true
+		}
+	}
+
+	var candidates []*targetLinkCandidate
+	for _, link := range links {
+		attrs := link.Attrs()
+		if attrs.Flags&net.FlagLoopback != 0 {
+			klog.V(2).Infof("Ignoring interface %s - loopback", attrs.Name)
+			continue
+		}
+		if attrs.Flags&net.FlagUp == 0 {
+			klog.V(2).Infof("Ignoring interface %s - not up", attrs.Name)
+			continue
+		}
+
+		candidate := &targetLinkCandidate{
+			Name:         attrs.Name,
+			DefaultRoute: defaultRouteLinks[attrs.Index],
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("error listing addresses on %s: %w", attrs.Name, err)
+		}
+		for _, addr := range addrs {
+			if addr.IPNet == nil || addr.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			candidate.Addrs = append(candidate.Addrs, addr.IPNet)
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates, nil
+}
+
+// waitForNodeAddress waits for our node to be found with an address, returning nil if that does not happen within timeout
+func waitForNodeAddress(ctx context.Context, nodeMap *routing.NodeMap, timeout time.Duration) net.IP {
+	var address net.IP
+	err := wait.PollUntilContextTimeout(ctx, time.Second, timeout, true, func(ctx context.Context) (bool, error) {
+		me := nodeMap.Self()
+		if me == nil || me.Address == nil {
+			return false, nil
+		}
+		address = me.Address
+		return true, nil
+	})
+	if err != nil {
+		klog.Warningf("did not find our node's address: %v", err)
+		return nil
+	}
+	return address
+}
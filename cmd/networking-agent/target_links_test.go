@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func buildTestCandidate(name string, defaultRoute bool, addrs ...string) *targetLinkCandidate {
+	c := &targetLinkCandidate{Name: name, DefaultRoute: defaultRoute}
+	for _, addr := range addrs {
+		ip, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			panic(err)
+		}
+		ipnet.IP = ip
+		c.Addrs = append(c.Addrs, ipnet)
+	}
+	return c
+}
+
+func TestChooseTargetLinks(t *testing.T) {
+	candidates := []*targetLinkCandidate{
+		buildTestCandidate("bond0", true, "10.0.0.5/24"),
+		buildTestCandidate("bond0.100", false, "192.168.10.5/24"),
+		buildTestCandidate("cbr0", false, "100.96.0.1/24"),
+		buildTestCandidate("ib0", false, "172.16.0.5/16"),
+	}
+
+	grid := []struct {
+		name        string
+		nodeAddress string
+		include     string
+		exclude     string
+		expected    []string
+		err         string
+	}{
+		{name: "node address", nodeAddress: "172.16.0.5", expected: []string{"ib0"}},
+		{name: "default route", expected: []string{"bond0"}},
+		{name: "node address not on any link", nodeAddress: "10.9.9.9", expected: []string{"bond0"}},
+		{name: "include", include: `^bond0`, expected: []string{"bond0", "bond0.100"}},
+		{name: "include and exclude", include: `^bond0`, exclude: `\.100$`, expected: []string{"bond0"}},
+		{name: "excluded node address", nodeAddress: "172.16.0.5", exclude: `^ib`, expected: []string{"bond0"}},
+		{name: "no include match", include: `^eth`, err: "no interfaces match targetLinks.include"},
+		{name: "nothing found", nodeAddress: "10.9.9.9", exclude: `^bond0$`, err: "candidates are: bond0.100 [192.168.10.5/24], cbr0 [100.96.0.1/24], ib0 [172.16.0.5/16]"},
+	}
+	for _, g := range grid {
+		t.Run(g.name, func(t *testing.T) {
+			filter, err := newTargetLinkFilter(g.include, g.exclude)
+			if err != nil {
+				t.Fatalf("error building filter: %v", err)
+			}
+			actual, err := chooseTargetLinks(candidates, net.ParseIP(g.nodeAddress), filter)
+			if g.err != "" {
+				if err == nil || !strings.Contains(err.Error(), g.err) {
+					t.Fatalf("expected error containing %q, got %v", g.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(actual, g.expected) {
+				t.Errorf("unexpected links %v, expected %v", actual, g.expected)
+			}
+		})
+	}
+}
+
+func TestTargetLinkOptions(t *testing.T) {
+	o := &Options{}
+	o.InitDefaults()
+	o.TargetLinks.Exclude = "("
+	err := o.Validate()
+	if err == nil || !strings.Contains(err.Error(), "targetLinks.exclude") {
+		t.Errorf("expected targetLinks.exclude error, got %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"kope.io/networking/pkg/apis/config/v1alpha1"
+	"kope.io/networking/pkg/ipam"
+	"kope.io/networking/pkg/routing"
+	"kope.io/networking/pkg/routing/netutil"
+)
+
+// validateAgentConfiguration makes the checks that need the provider registry and the other implementations,
+// which v1alpha1 does not depend on
+func validateAgentConfiguration(c *v1alpha1.AgentConfiguration) field.ErrorList {
+	var errs field.ErrorList
+
+	if providers := routing.ProviderNames(); c.Provider != "" && !contains(providers, c.Provider) {
+		errs = append(errs, field.NotSupported(field.NewPath("provider"), c.Provider, providers))
+	}
+
+	if _, err := routing.ParseAddressSelector(c.UnderlayAddressPriority); err != nil {
+		errs = append(errs, field.Invalid(field.NewPath("underlayAddressPriority"), c.UnderlayAddressPriority, err.Error()))
+	}
+
+	errs = append(errs, validateProviderConfig(c)...)
+
+	if c.IPAM.Enabled {
+		errs = append(errs, validateIPAM(c)...)
+	}
+
+	if c.Migration.FromProvider != "" {
+		errs = append(errs, validateMigration(c)...)
+	}
+
+	return errs
+}
+
+// validateProviderConfig checks every provider section, whether or not its provider is selected
+func validateProviderConfig(c *v1alpha1.AgentConfiguration) field.ErrorList {
+	var errs field.ErrorList
+
+	providerConfigPath := field.NewPath("providerConfig")
+	knownSections := routing.ProviderConfigSectionNames()
+	for _, section := range knownSections {
+		errs = append(errs, routing.ValidateProviderConfig(section, c.ProviderConfig[section], providerConfigPath.Key(section))...)
+	}
+
+	var configured []string
+	for section := range c.ProviderConfig {
+		configured = append(configured, section)
+	}
+	sort.Strings(configured)
+	for _, section := range configured {
+		if !contains(knownSections, section) {
+			errs = append(errs, field.NotSupported(providerConfigPath.Key(section), section, knownSections))
+		}
+	}
+	return errs
+}
+
+func validateIPAM(c *v1alpha1.AgentConfiguration) field.ErrorList {
+	_, podCIDR, err := net.ParseCIDR(strings.TrimSpace(c.PodCIDR))
+	if err != nil {
+		// Reported as a podCIDR error
+		return nil
+	}
+	maskSize := c.IPAM.MaskSize(podCIDR)
+	if _, err := ipam.NewCIDRAllocator(podCIDR, maskSize); err != nil {
+		return field.ErrorList{field.Invalid(field.NewPath("ipam", "nodeMaskSize"), maskSize, err.Error())}
+	}
+	return nil
+}
+
+func validateMigration(c *v1alpha1.AgentConfiguration) field.ErrorList {
+	var errs field.ErrorList
+
+	migrationPath := field.NewPath("migration")
+	migratableProviders := routing.MigratableProviderNames()
+	if !contains(migratableProviders, c.Migration.FromProvider) {
+		errs = append(errs, field.NotSupported(migrationPath.Child("fromProvider"), c.Migration.FromProvider, migratableProviders))
+	}
+	if !contains(migratableProviders, c.Provider) {
+		errs = append(errs, field.Forbidden(field.NewPath("provider"), fmt.Sprintf("cannot migrate to %q; supported providers are %v", c.Provider, migratableProviders)))
+	}
+
+	fromVXLANPath := migrationPath.Child("fromVXLAN")
+	errs = append(errs, routing.ValidateProviderConfig("vxlan", c.Migration.FromVXLAN, fromVXLANPath)...)
+
+	// The two vxlan devices must not clash, as each provider owns its device
+	if routing.ProviderConfigSection(c.Migration.FromProvider) == "vxlan" && routing.ProviderConfigSection(c.Provider) == "vxlan" {
+		from, fromErr := decodeVxlanConfig(c.Migration.FromVXLAN)
+		to, toErr := decodeVxlanConfig(c.ProviderConfig["vxlan"])
+		// Sections that cannot be decoded are reported above
+		if fromErr == nil && toErr == nil {
+			if from.Name() == to.Name() {
+				errs = append(errs, field.Invalid(fromVXLANPath.Child("deviceName"), from.Name(), "must differ from the name of the vxlan device"))
+			}
+			if from.VNI == to.VNI && from.Port == to.Port {
+				errs = append(errs, field.Invalid(fromVXLANPath.Child("vni"), from.VNI, "must differ from providerConfig.vxlan.vni, unless the ports differ"))
+			}
+		}
+	}
+
+	return errs
+}
+
+// decodeVxlanConfig decodes a vxlan section, filling in the defaults
+func decodeVxlanConfig(raw json.RawMessage) (netutil.VxlanConfig, error) {
+	var c netutil.VxlanConfig
+	if len(raw) != 0 {
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return c, fmt.Errorf("error parsing vxlan config: %w", err)
+		}
+	}
+	c.SetDefaults()
+	return c, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"kope.io/networking/pkg/apis/config/v1alpha1"
+)
+
+func TestValidateAgentConfiguration(t *testing.T) {
+	c := v1alpha1.NewDefaultConfiguration()
+	c.Provider = "carrier-pigeon"
+	c.UnderlayAddressPriority = []string{"CarrierIP"}
+	c.ProviderConfig = map[string]json.RawMessage{
+		"ipsec":     json.RawMessage(`{"encryption":"rot13"}`),
+		"vxlan":     json.RawMessage(`{"vni":16777216}`),
+		"wireguard": json.RawMessage(`{}`),
+	}
+
+	err := validateAgentConfiguration(c).ToAggregate()
+	for _, expected := range []string{"provider", "underlayAddressPriority", "providerConfig[ipsec].encryption", "providerConfig[vxlan]", "providerConfig[wireguard]"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error containing %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestValidateMigration(t *testing.T) {
+	grid := []struct {
+		provider     string
+		fromProvider string
+		fromVXLAN    string
+		expected     []string
+	}{
+		{provider: "vxlan", fromProvider: "ipsec"},
+		{provider: "vxlan", fromProvider: "vxlan-legacy", fromVXLAN: `{"vni":2}`},
+		{provider: "vxlan", fromProvider: "vxlan-legacy", fromVXLAN: `{"vni":-1}`, expected: []string{"migration.fromVXLAN"}},
+		{provider: "vxlan", fromProvider: "vxlan-legacy", fromVXLAN: `{"port":8472}`, expected: []string{"migration.fromVXLAN.deviceName"}},
+		{provider: "vxlan", fromProvider: "vxlan-legacy", fromVXLAN: `{"deviceName":"vxlan-old"}`, expected: []string{"migration.fromVXLAN.vni"}},
+		{provider: "vxlan", fromProvider: "vxlan-legacy", expected: []string{"migration.fromVXLAN.deviceName", "migration.fromVXLAN.vni"}},
+		{provider: "vxlan", fromProvider: "vxlan", fromVXLAN: `{"vni":2}`, expected: []string{"must differ from provider"}},
+		{provider: "layer2", fromProvider: "gre", expected: []string{"migration.fromProvider", "cannot migrate to \"layer2\""}},
+	}
+	for _, g := range grid {
+		o := &Options{}
+		o.InitDefaults()
+		o.Provider = g.provider
+		o.Migration.FromProvider = g.fromProvider
+		if g.fromVXLAN != "" {
+			o.Migration.FromVXLAN = json.RawMessage(g.fromVXLAN)
+		}
+
+		err := o.Validate()
+		if len(g.expected) == 0 {
+			if err != nil {
+				t.Errorf("migrating from %q %s to %q: unexpected error: %v", g.fromProvider, g.fromVXLAN, g.provider, err)
+			}
+			continue
+		}
+		for _, expected := range g.expected {
+			if err == nil || !strings.Contains(err.Error(), expected) {
+				t.Errorf("migrating from %q %s to %q: expected error containing %q, got %v", g.fromProvider, g.fromVXLAN, g.provider, expected, err)
+			}
+		}
+	}
+}
+
+func TestValidateIPAM(t *testing.T) {
+	grid := []struct {
+		podCIDR      string
+		nodeMaskSize int
+		valid        bool
+	}{
+		{podCIDR: "100.96.0.0/12", valid: true},
+		{podCIDR: "100.96.0.0/12", nodeMaskSize: 26, valid: true},
+		{podCIDR: "fd00:10:96::/48", valid: true},
+		{podCIDR: "100.96.0.0/12", nodeMaskSize: 8},
+		{podCIDR: "100.96.0.0/12", nodeMaskSize: 33},
+		{podCIDR: "fd00:10:96::/48", nodeMaskSize: 120},
+	}
+	for _, g := range grid {
+		c := v1alpha1.NewDefaultConfiguration()
+		c.PodCIDR = g.podCIDR
+		c.IPAM.Enabled = true
+		c.IPAM.NodeMaskSize = g.nodeMaskSize
+
+		err := validateAgentConfiguration(c).ToAggregate()
+		if g.valid && err != nil {
+			t.Errorf("%s with nodeMaskSize %d: unexpected error: %v", g.podCIDR, g.nodeMaskSize, err)
+		}
+		if !g.valid && (err == nil || !strings.Contains(err.Error(), "ipam.nodeMaskSize")) {
+			t.Errorf("%s with nodeMaskSize %d: expected ipam.nodeMaskSize error, got %v", g.podCIDR, g.nodeMaskSize, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package v1alpha1
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	c, err := Load([]byte(`
+apiVersion: config.networking.kope.io/v1alpha1
+kind: AgentConfiguration
+provider: ipsec
+resyncPeriod: 1m
+targetLinks:
+  include: ^bond
+masquerade:
+  enabled: false
+  nonMasqueradeCIDRs: [10.0.0.0/8]
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := Validate(c).ToAggregate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	if c.Provider != "ipsec" {
+		t.Errorf("unexpected provider %q", c.Provider)
+	}
+	if c.ResyncPeriod.Duration != time.Minute {
+		t.Errorf("unexpected resyncPeriod %v", c.ResyncPeriod.Duration)
+	}
+	if c.TargetLinks.Include != "^bond" {
+		t.Errorf("unexpected targetLinks.include %q", c.TargetLinks.Include)
+	}
+	if c.Masquerade.IsEnabled() {
+		t.Errorf("expected masquerade to be disabled")
+	}
+	if c.PodCIDR != "100.96.0.0/12" || *c.LogLevel != 1 {
+		t.Errorf("defaults not applied: %+v", c)
+	}
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	_, err := Load([]byte(`
+apiVersion: config.networking.kope.io/v1alpha1
+kind: AgentConfiguration
+targetLinkName: eth0
+`))
+	if err == nil || !strings.Contains(err.Error(), "targetLinkName") {
+		t.Errorf("expected unknown field error, got %v", err)
+	}
+}
+
+func TestLoadUnsupportedVersion(t *testing.T) {
+	_, err := Load([]byte(`
+apiVersion: config.networking.kope.io/v1beta9
+kind: AgentConfiguration
+`))
+	if err == nil || !strings.Contains(err.Error(), "unsupported config apiVersion") {
+		t.Errorf("expected unsupported apiVersion error, got %v", err)
+	}
+}
+
+func TestLoadLegacy(t *testing.T) {
+	c, err := Load([]byte(`
+provider: layer2
+targetLinkName: eth1
+resyncPeriod: 60000000000
+nodeName: node-a
+masquerade: false
+nonMasqueradeCIDRs: [10.0.0.0/8]
+ipsec:
+  encapsulation: esp
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := Validate(c).ToAggregate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	if c.APIVersion != GroupVersion.String() || c.Kind != Kind {
+		t.Errorf("unexpected apiVersion/kind %q/%q", c.APIVersion, c.Kind)
+	}
+	if c.Provider != "layer2" || c.TargetLinks.Name != "eth1" || c.NodeIdentity.NodeName != "node-a" {
+		t.Errorf("fields not converted: %+v", c)
+	}
+	if c.NodeIdentity.SystemUUIDPath != "/sys/class/dmi/id/product_uuid" {
+		t.Errorf("expected legacy systemUUIDPath default, got %q", c.NodeIdentity.SystemUUIDPath)
+	}
+	if c.ResyncPeriod.Duration != time.Minute {
+		t.Errorf("unexpected resyncPeriod %v", c.ResyncPeriod.Duration)
+	}
+	if c.Masquerade.IsEnabled() || len(c.Masquerade.NonMasqueradeCIDRs) != 1 {
+		t.Errorf("masquerade not converted: %+v", c.Masquerade)
+	}
+	if ipsec := string(c.ProviderConfig["ipsec"]); !strings.Contains(ipsec, `"encapsulation":"esp"`) {
+		t.Errorf("ipsec not converted: %s", ipsec)
+	}
+}
+
+func TestLoadLegacySections(t *testing.T) {
+	c, err := Load([]byte(`
+apiVersion: config.networking.kope.io/v1alpha1
+kind: AgentConfiguration
+ipsec:
+  encryption: none
+vxlan:
+  vni: 42
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := Validate(c).ToAggregate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	if len(c.IPSec) != 0 || len(c.VXLAN) != 0 {
+		t.Errorf("legacy sections not cleared: %s %s", c.IPSec, c.VXLAN)
+	}
+	if ipsec := string(c.ProviderConfig["ipsec"]); !strings.Contains(ipsec, `"encryption":"none"`) {
+		t.Errorf("ipsec not moved to providerConfig: %s", ipsec)
+	}
+	if vxlan := string(c.ProviderConfig["vxlan"]); !strings.Contains(vxlan, `"vni":42`) {
+		t.Errorf("vxlan not moved to providerConfig: %s", vxlan)
+	}
+
+	_, err = Load([]byte(`
+apiVersion: config.networking.kope.io/v1alpha1
+kind: AgentConfiguration
+vxlan:
+  vni: 42
+providerConfig:
+  vxlan:
+    vni: 43
+`))
+	if err == nil || !strings.Contains(err.Error(), "vxlan may not be combined with providerConfig.vxlan") {
+		t.Errorf("expected conflict error, got %v", err)
+	}
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	c := NewDefaultConfiguration()
+	c.Provider = ""
+	c.PodCIDR = "100.96.0.0"
+	c.VXLAN = json.RawMessage(`{"vni":42}`)
+	c.TargetLinks.Name = "eth0"
+	c.TargetLinks.Include = "("
+	c.MTU = 100
+
+	err := Validate(c).ToAggregate()
+	if err == nil {
+		t.Fatalf("expected validation errors")
+	}
+	for _, expected := range []string{"provider", "podCIDR", "vxlan: Forbidden", "targetLinks.name", "targetLinks.include", "mtu"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error for %s, got %v", expected, err)
+		}
+	}
+}
+
+func TestDefaultConfigurationIsValid(t *testing.T) {
+	if err := Validate(NewDefaultConfiguration()).ToAggregate(); err != nil {
+		t.Errorf("default configuration is not valid: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package v1alpha1
+
+import (
+	"time"
+)
+
+// NewDefaultConfiguration returns the configuration used when there is no config file
+func NewDefaultConfiguration() *AgentConfiguration {
+	c := &AgentConfiguration{}
+	SetDefaults(c)
+	return c
+}
+
+// SetDefaults fills in the fields of c that are not set
+func SetDefaults(c *AgentConfiguration) {
+	c.APIVersion = GroupVersion.String()
+	c.Kind = Kind
+
+	if c.Provider == "" {
+		c.Provider = "vxlan"
+	}
+	if c.PodCIDR == "" {
+		c.PodCIDR = "100.96.0.0/12"
+	}
+	if c.ResyncPeriod.Duration == 0 {
+		c.ResyncPeriod.Duration = 30 * time.Second
+	}
+	if c.LogLevel == nil {
+		logLevel := 1
+		c.LogLevel = &logLevel
+	}
+
+	if c.NodeIdentity == (NodeIdentity{}) {
+		c.NodeIdentity.SystemUUIDPath = "/sys/class/dmi/id/product_uuid"
+	}
+
+	// UnderlayAddressPriority and the provider sections are defaulted by the agent, when it parses them
+
+	if c.Masquerade.Enabled == nil {
+		enabled := true
+		c.Masquerade.Enabled = &enabled
+	}
+}
@@ -0,0 +1,102 @@
+package v1alpha1
+
+import (
+	"encoding/json"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LegacyOptions is the unversioned config file format, with no apiVersion or kind
+type LegacyOptions struct {
+	Provider          string `json:"provider"`
+	TargetLinkName    string `json:"targetLinkName"`
+	TargetLinkInclude string `json:"targetLinkInclude"`
+	TargetLinkExclude string `json:"targetLinkExclude"`
+
+	// ResyncPeriod is in nanoseconds, as it is a time.Duration
+	ResyncPeriod time.Duration `json:"resyncPeriod"`
+
+	NodeName       string `json:"nodeName"`
+	MachineIDPath  string `json:"machineIDPath"`
+	SystemUUIDPath string `json:"systemUUIDPath"`
+	BootIDPath     string `json:"bootIDPath"`
+
+	UnderlayAddressPriority []string `json:"underlayAddressPriority"`
+
+	IPSEC struct {
+		Authentication string `json:"authentication"`
+		Encryption     string `json:"encryption"`
+		Encapsulation  string `json:"encapsulation"`
+	} `json:"ipsec"`
+
+	// VXLAN is the vxlan section, which is unchanged in providerConfig
+	VXLAN json.RawMessage `json:"vxlan"`
+
+	LogLevel *int `json:"logLevel"`
+
+	PodCIDR            string   `json:"podCIDR"`
+	CNIConfigPath      string   `json:"cniConfigPath"`
+	Masquerade         bool     `json:"masquerade"`
+	NonMasqueradeCIDRs []string `json:"nonMasqueradeCIDRs"`
+	PathMTUDiscovery   bool     `json:"pathMTUDiscovery"`
+	NetworkPolicy      bool     `json:"networkPolicy"`
+}
+
+// NewLegacyOptions returns the defaults of the legacy format, onto which a legacy config file is read
+func NewLegacyOptions() *LegacyOptions {
+	logLevel := 1
+	o := &LegacyOptions{
+		Provider:       "vxlan",
+		ResyncPeriod:   30 * time.Second,
+		SystemUUIDPath: "/sys/class/dmi/id/product_uuid",
+		LogLevel:       &logLevel,
+		PodCIDR:        "100.96.0.0/12",
+		Masquerade:     true,
+	}
+	o.IPSEC.Authentication = "sha1"
+	o.IPSEC.Encryption = "aes"
+	o.IPSEC.Encapsulation = "udp"
+	return o
+}
+
+// ConvertLegacy converts the legacy format to an AgentConfiguration, which is then defaulted
+func ConvertLegacy(o *LegacyOptions) *AgentConfiguration {
+	masquerade := o.Masquerade
+
+	// The ipsec section only holds strings, so it always serializes
+	ipsecSection, _ := json.Marshal(o.IPSEC)
+	providerConfig := map[string]json.RawMessage{"ipsec": ipsecSection}
+	if len(o.VXLAN) != 0 {
+		providerConfig["vxlan"] = o.VXLAN
+	}
+
+	c := &AgentConfiguration{
+		Provider:     o.Provider,
+		PodCIDR:      o.PodCIDR,
+		ResyncPeriod: metav1.Duration{Duration: o.ResyncPeriod},
+		LogLevel:     o.LogLevel,
+		NodeIdentity: NodeIdentity{
+			NodeName:       o.NodeName,
+			MachineIDPath:  o.MachineIDPath,
+			SystemUUIDPath: o.SystemUUIDPath,
+			BootIDPath:     o.BootIDPath,
+		},
+		TargetLinks: TargetLinks{
+			Name:    o.TargetLinkName,
+			Include: o.TargetLinkInclude,
+			Exclude: o.TargetLinkExclude,
+		},
+		UnderlayAddressPriority: o.UnderlayAddressPriority,
+		ProviderConfig:          providerConfig,
+		CNIConfigPath:           o.CNIConfigPath,
+		Masquerade: MasqueradeConfiguration{
+			Enabled:            &masquerade,
+			NonMasqueradeCIDRs: o.NonMasqueradeCIDRs,
+		},
+		PathMTUDiscovery: o.PathMTUDiscovery,
+		NetworkPolicy:    o.NetworkPolicy,
+	}
+	SetDefaults(c)
+	return c
+}
@@ -0,0 +1,41 @@
+package v1alpha1
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// Load parses a config file, in either the versioned or the legacy format, and applies defaults.
+// Unknown fields are rejected in the versioned format; the result still needs to be validated.
+func Load(data []byte) (*AgentConfiguration, error) {
+	var typeMeta metav1.TypeMeta
+	if err := yaml.Unmarshal(data, &typeMeta); err != nil {
+		return nil, fmt.Errorf("error parsing config: %w", err)
+	}
+
+	if typeMeta.APIVersion == "" && typeMeta.Kind == "" {
+		klog.Warningf("config has no apiVersion; converting from the legacy format. Use apiVersion: %s, kind: %s", GroupVersion, Kind)
+		legacy := NewLegacyOptions()
+		if err := yaml.Unmarshal(data, legacy); err != nil {
+			return nil, fmt.Errorf("error parsing legacy config: %w", err)
+		}
+		return ConvertLegacy(legacy), nil
+	}
+
+	if typeMeta.APIVersion != GroupVersion.String() || typeMeta.Kind != Kind {
+		return nil, fmt.Errorf("unsupported config apiVersion %q, kind %q; expected apiVersion %q, kind %q", typeMeta.APIVersion, typeMeta.Kind, GroupVersion, Kind)
+	}
+
+	c := &AgentConfiguration{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("error parsing config: %w", err)
+	}
+	if err := c.convertLegacySections(); err != nil {
+		return nil, fmt.Errorf("error parsing config: %w", err)
+	}
+	SetDefaults(c)
+	return c, nil
+}
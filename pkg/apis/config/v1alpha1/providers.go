@@ -0,0 +1,48 @@
+package v1alpha1
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ProviderSections looks up the provider sections of the configuration, for building providers
+func (c *AgentConfiguration) ProviderSections() func(section string) json.RawMessage {
+	return func(section string) json.RawMessage {
+		return c.ProviderConfig[section]
+	}
+}
+
+// MigrationFromSections is ProviderSections for Migration.FromProvider, which uses Migration.FromVXLAN for its vxlan device
+func (c *AgentConfiguration) MigrationFromSections() func(section string) json.RawMessage {
+	return func(section string) json.RawMessage {
+		if section == "vxlan" {
+			return c.Migration.FromVXLAN
+		}
+		return c.ProviderConfig[section]
+	}
+}
+
+// convertLegacySections moves the sections that predate providerConfig into ProviderConfig
+func (c *AgentConfiguration) convertLegacySections() error {
+	legacySections := []struct {
+		name string
+		raw  *json.RawMessage
+	}{
+		{"ipsec", &c.IPSec},
+		{"vxlan", &c.VXLAN},
+	}
+	for _, legacy := range legacySections {
+		if len(*legacy.raw) == 0 {
+			continue
+		}
+		if _, found := c.ProviderConfig[legacy.name]; found {
+			return fmt.Errorf("%s may not be combined with providerConfig.%s", legacy.name, legacy.name)
+		}
+		if c.ProviderConfig == nil {
+			c.ProviderConfig = make(map[string]json.RawMessage)
+		}
+		c.ProviderConfig[legacy.name] = *legacy.raw
+		*legacy.raw = nil
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Package v1alpha1 contains the versioned configuration of the networking agent
+package v1alpha1
+
+import (
+	"encoding/json"
+	"net"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupVersion is the apiVersion of the agent configuration
+var GroupVersion = schema.GroupVersion{Group: "config.networking.kope.io", Version: "v1alpha1"}
+
+// Kind is the kind of the agent configuration
+const Kind = "AgentConfiguration"
+
+// AgentConfiguration is the configuration of the networking agent, read from /config/config.yaml
+type AgentConfiguration struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Provider is the routing provider: vxlan (the default), vxlan-legacy, layer2, gre, ipsec,
+	// or a provider registered by a custom build
+	Provider string `json:"provider,omitempty"`
+
+	// PodCIDR is the address space allocated to pod networking
+	PodCIDR string `json:"podCIDR,omitempty"`
+
+	// ResyncPeriod is how often we relist and reconcile
+	ResyncPeriod metav1.Duration `json:"resyncPeriod,omitempty"`
+
+	// LogLevel is the klog verbosity
+	LogLevel *int `json:"logLevel,omitempty"`
+
+	// NodeIdentity controls how the agent finds its own Node; NODE_NAME in the environment takes precedence
+	NodeIdentity NodeIdentity `json:"nodeIdentity,omitempty"`
+
+	// TargetLinks controls which network interfaces carry traffic between nodes
+	TargetLinks TargetLinks `json:"targetLinks,omitempty"`
+
+	// UnderlayAddressPriority chooses the address of each node used for tunnels: the first entry that yields an address wins.
+	// Entries are Annotation (the kopeio.io/underlay-address annotation), InternalIP, ExternalIP, or a CIDR matching any node address.
+	// If empty, Annotation then InternalIP.
+	UnderlayAddressPriority []string `json:"underlayAddressPriority,omitempty"`
+
+	// ProviderConfig holds the configuration sections of the providers, keyed by section name: ipsec for the ipsec provider,
+	// vxlan for the vxlan device of the vxlan and vxlan-legacy providers, and the sections of providers registered by custom builds
+	ProviderConfig map[string]json.RawMessage `json:"providerConfig,omitempty"`
+
+	// IPSec is the ipsec section from before providerConfig; Load moves it to providerConfig.
+	//
+	// Deprecated: use providerConfig.ipsec
+	IPSec json.RawMessage `json:"ipsec,omitempty"`
+
+	// VXLAN is the vxlan section from before providerConfig; Load moves it to providerConfig.
+	//
+	// Deprecated: use providerConfig.vxlan
+	VXLAN json.RawMessage `json:"vxlan,omitempty"`
+
+	// CNIConfigPath is the path to which we should write our CNI config; if empty we don't write it
+	CNIConfigPath string `json:"cniConfigPath,omitempty"`
+
+	// Masquerade configures SNAT for pod traffic leaving the pod network
+	Masquerade MasqueradeConfiguration `json:"masquerade,omitempty"`
+
+	// MTU overrides the MTU of the overlay device (for vxlan); if zero it is computed from the underlay MTU
+	MTU int `json:"mtu,omitempty"`
+
+	// PathMTUDiscovery enables probing the path MTU to each peer, lowering the MTU for peers behind smaller links
+	PathMTUDiscovery bool `json:"pathMTUDiscovery,omitempty"`
+
+	// NetworkPolicy enables enforcement of Kubernetes NetworkPolicy for pods on this node
+	NetworkPolicy bool `json:"networkPolicy,omitempty"`
+
+	// IPAM configures allocation of node PodCIDRs by the agents, for clusters where kube-controller-manager does not allocate them
+	IPAM IPAMConfiguration `json:"ipam,omitempty"`
+
+	// Migration runs a second provider alongside Provider, while the cluster migrates to Provider
+	Migration MigrationConfiguration `json:"migration,omitempty"`
+}
+
+// NodeIdentity controls how the agent matches its own Node; the first non-empty field is used
+type NodeIdentity struct {
+	// NodeName is the name of our Node; if no other field is set, the hostname is used
+	NodeName string `json:"nodeName,omitempty"`
+
+	// MachineIDPath, SystemUUIDPath and BootIDPath are files whose contents match a field in the Node status
+	MachineIDPath  string `json:"machineIDPath,omitempty"`
+	SystemUUIDPath string `json:"systemUUIDPath,omitempty"`
+	BootIDPath     string `json:"bootIDPath,omitempty"`
+}
+
+// TargetLinks controls which network interfaces carry traffic between nodes.
+// If none of the fields are set, we use the interface holding the node's InternalIP, or the default route.
+type TargetLinks struct {
+	// Name is the interface to use
+	Name string `json:"name,omitempty"`
+
+	// Include is a regular expression; all interfaces whose names match are used
+	Include string `json:"include,omitempty"`
+
+	// Exclude is a regular expression; interfaces whose names match are never chosen automatically
+	Exclude string `json:"exclude,omitempty"`
+}
+
+// IPAMConfiguration configures allocation of node PodCIDRs from PodCIDR
+type IPAMConfiguration struct {
+	// Enabled runs a leader-elected controller in the agents that gives every node without a PodCIDR a PodCIDR.
+	// Do not enable it if kube-controller-manager runs with --allocate-node-cidrs.
+	Enabled bool `json:"enabled,omitempty"`
+
+	// NodeMaskSize is the prefix length of each node's PodCIDR; if zero, 24 for IPv4 or 64 for IPv6
+	NodeMaskSize int `json:"nodeMaskSize,omitempty"`
+}
+
+// MaskSize returns the prefix length of node PodCIDRs allocated from podCIDR
+func (c *IPAMConfiguration) MaskSize(podCIDR *net.IPNet) int {
+	if c.NodeMaskSize != 0 {
+		return c.NodeMaskSize
+	}
+	if podCIDR.IP.To4() != nil {
+		return 24
+	}
+	return 64
+}
+
+// MigrationConfiguration configures an online migration between providers.
+// Each node reaches a peer with Provider once the peer advertises Provider, and with FromProvider until then;
+// once every node advertises Provider, FromProvider is torn down.
+type MigrationConfiguration struct {
+	// FromProvider is the provider we are migrating from; if empty we are not migrating.
+	// Only migratable providers (vxlan, vxlan-legacy and ipsec) can be migrated between, as other providers own all our routes.
+	FromProvider string `json:"fromProvider,omitempty"`
+
+	// FromVXLAN is the vxlan section of FromProvider, in place of providerConfig.vxlan; its device must not clash with that of Provider
+	FromVXLAN json.RawMessage `json:"fromVXLAN,omitempty"`
+}
+
+// MasqueradeConfiguration configures SNAT for pod traffic leaving the pod network
+type MasqueradeConfiguration struct {
+	// Enabled defaults to true
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// NonMasqueradeCIDRs are destinations that pods reach without masquerade, in addition to PodCIDR
+	NonMasqueradeCIDRs []string `json:"nonMasqueradeCIDRs,omitempty"`
+}
+
+// IsEnabled returns true unless masquerade has been disabled
+func (c *MasqueradeConfiguration) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
@@ -0,0 +1,91 @@
+package v1alpha1
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Bounds of the configured MTU; 576 is the smallest datagram every IPv4 host must accept
+const (
+	minMTU = 576
+	maxMTU = 65535
+)
+
+// Validate checks a defaulted configuration, returning all the problems found.
+// The provider names, provider sections, underlayAddressPriority and ipam depend on the agent's implementation, so the agent checks those.
+func Validate(c *AgentConfiguration) field.ErrorList {
+	var errs field.ErrorList
+
+	if c.APIVersion != GroupVersion.String() {
+		errs = append(errs, field.Invalid(field.NewPath("apiVersion"), c.APIVersion, "expected "+GroupVersion.String()))
+	}
+	if c.Kind != Kind {
+		errs = append(errs, field.Invalid(field.NewPath("kind"), c.Kind, "expected "+Kind))
+	}
+
+	if c.Provider == "" {
+		errs = append(errs, field.Required(field.NewPath("provider"), ""))
+	}
+
+	errs = append(errs, validateCIDR(field.NewPath("podCIDR"), c.PodCIDR)...)
+
+	if c.ResyncPeriod.Duration <= 0 {
+		errs = append(errs, field.Invalid(field.NewPath("resyncPeriod"), c.ResyncPeriod.Duration.String(), "must be positive"))
+	}
+	if c.LogLevel != nil && *c.LogLevel < 0 {
+		errs = append(errs, field.Invalid(field.NewPath("logLevel"), *c.LogLevel, "must not be negative"))
+	}
+
+	targetLinksPath := field.NewPath("targetLinks")
+	if c.TargetLinks.Name != "" && (c.TargetLinks.Include != "" || c.TargetLinks.Exclude != "") {
+		errs = append(errs, field.Forbidden(targetLinksPath.Child("name"), "may not be combined with include or exclude"))
+	}
+	errs = append(errs, validateRegexp(targetLinksPath.Child("include"), c.TargetLinks.Include)...)
+	errs = append(errs, validateRegexp(targetLinksPath.Child("exclude"), c.TargetLinks.Exclude)...)
+
+	// Load moves the sections from before providerConfig into it
+	if len(c.IPSec) != 0 {
+		errs = append(errs, field.Forbidden(field.NewPath("ipsec"), "use providerConfig.ipsec"))
+	}
+	if len(c.VXLAN) != 0 {
+		errs = append(errs, field.Forbidden(field.NewPath("vxlan"), "use providerConfig.vxlan"))
+	}
+
+	if c.MTU != 0 && (c.MTU < minMTU || c.MTU > maxMTU) {
+		errs = append(errs, field.Invalid(field.NewPath("mtu"), c.MTU, fmt.Sprintf("must be between %d and %d", minMTU, maxMTU)))
+	}
+
+	for i, cidr := range c.Masquerade.NonMasqueradeCIDRs {
+		errs = append(errs, validateCIDR(field.NewPath("masquerade", "nonMasqueradeCIDRs").Index(i), cidr)...)
+	}
+
+	if c.Migration.FromProvider != "" && c.Migration.FromProvider == c.Provider {
+		errs = append(errs, field.Invalid(field.NewPath("migration", "fromProvider"), c.Migration.FromProvider, "must differ from provider"))
+	}
+
+	return errs
+}
+
+func validateCIDR(fldPath *field.Path, value string) field.ErrorList {
+	if value == "" {
+		return field.ErrorList{field.Required(fldPath, "")}
+	}
+	if _, _, err := net.ParseCIDR(strings.TrimSpace(value)); err != nil {
+		return field.ErrorList{field.Invalid(fldPath, value, "must be a CIDR, e.g. 100.96.0.0/12")}
+	}
+	return nil
+}
+
+func validateRegexp(fldPath *field.Path, value string) field.ErrorList {
+	if value == "" {
+		return nil
+	}
+	if _, err := regexp.Compile(value); err != nil {
+		return field.ErrorList{field.Invalid(fldPath, value, err.Error())}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Package v1alpha1 contains the cluster-scoped networking API objects read by the agent
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupVersion is the apiVersion of the networking objects
+var GroupVersion = schema.GroupVersion{Group: "networking.kope.io", Version: "v1alpha1"}
+
+// IPPoolResource is the resource of IPPool objects
+var IPPoolResource = GroupVersion.WithResource("ippools")
+
+// IPPool is a block of pod address space, in addition to the podCIDR of the agent configuration.
+// The overlay routes every pool; node PodCIDRs are allocated from pools when the agent allocates them (ipam.enabled).
+type IPPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IPPoolSpec `json:"spec"`
+}
+
+// IPPoolSpec describes an IPPool
+type IPPoolSpec struct {
+	// CIDR is the address space of the pool; it must not overlap podCIDR or other pools
+	CIDR string `json:"cidr"`
+
+	// BlockSize is the prefix length of the node PodCIDRs allocated from the pool; if zero, ipam.nodeMaskSize is used
+	BlockSize int `json:"blockSize,omitempty"`
+
+	// NodeSelector restricts the pool to matching nodes, which are then only allocated from matching pools.
+	// A pool without a NodeSelector adds address space for all nodes that no pool selects, once podCIDR is full.
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+}
+
+// IPPoolList is a list of IPPools
+type IPPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []IPPool `json:"items"`
+}
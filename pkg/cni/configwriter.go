@@ -2,6 +2,9 @@ package cni
 
 import "net"
 
+// BridgeName is the name of the bridge device that pods are attached to
+const BridgeName = "kopeio"
+
 type ConfigWriter interface {
 	WriteCNIConfig(podCIDR *net.IPNet) error
 }
@@ -20,9 +20,8 @@ const cniConfig = `
   "cniVersion":      "0.3.1",
   "name":            "k8s-pod-network",
   "type":            "bridge",
-  "bridge":          "kopeio",
+  "bridge":          "{{BridgeName}}",
   "isDefaultGateway": true,
-  "ipMasq": true,
   "ipam": {
     "type":   "host-local",
     "name":   "kopeio",
@@ -48,6 +47,7 @@ func (w *SimpleConfigWriter) WriteCNIConfig(podCIDR *net.IPNet) error {
 
 	expected := cniConfig
 	expected = strings.ReplaceAll(expected, "{{PodCIDR}}", podCIDRString)
+	expected = strings.ReplaceAll(expected, "{{BridgeName}}", BridgeName)
 
 	existing := string(b)
 	if existing == expected {
@@ -62,3 +62,15 @@ func (w *SimpleConfigWriter) WriteCNIConfig(podCIDR *net.IPNet) error {
 
 	return nil
 }
+
+// RemoveCNIConfig removes the cni config file, if it exists
+func (w *SimpleConfigWriter) RemoveCNIConfig() error {
+	if err := os.Remove(w.Path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error removing cni config %s: %v", w.Path, err)
+	}
+	klog.Infof("removed cni config %s", w.Path)
+	return nil
+}
@@ -0,0 +1,112 @@
+// Package ipam allocates node PodCIDRs, for clusters where kube-controller-manager does not allocate them
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// MaxSubnetBits limits the number of node CIDRs in the cluster CIDR to 2^MaxSubnetBits
+const MaxSubnetBits = 24
+
+// CIDRAllocator hands out non-overlapping node CIDRs of a fixed size from a cluster CIDR
+type CIDRAllocator struct {
+	clusterCIDR *net.IPNet
+	maskSize    int
+
+	// base is the first address of clusterCIDR; the node CIDR with index i starts at base + i<<shift
+	base  *big.Int
+	shift uint
+	count int
+
+	used map[int]bool
+	// next is where we start looking for a free node CIDR, so that we don't immediately reuse a released CIDR
+	next int
+}
+
+// NewCIDRAllocator builds a CIDRAllocator, allocating node CIDRs with prefix length maskSize from clusterCIDR
+func NewCIDRAllocator(clusterCIDR *net.IPNet, maskSize int) (*CIDRAllocator, error) {
+	prefix, bits := clusterCIDR.Mask.Size()
+	if maskSize < prefix || maskSize > bits {
+		return nil, fmt.Errorf("node mask size %d must be between %d and %d for cluster CIDR %s", maskSize, prefix, bits, clusterCIDR)
+	}
+	if maskSize-prefix > MaxSubnetBits {
+		return nil, fmt.Errorf("node mask size %d is too large for cluster CIDR %s; it may be at most %d", maskSize, clusterCIDR, prefix+MaxSubnetBits)
+	}
+
+	return &CIDRAllocator{
+		clusterCIDR: clusterCIDR,
+		maskSize:    maskSize,
+		base:        new(big.Int).SetBytes(normalizeIP(clusterCIDR.IP.Mask(clusterCIDR.Mask))),
+		shift:       uint(bits - maskSize),
+		count:       1 << uint(maskSize-prefix),
+		used:        make(map[int]bool),
+	}, nil
+}
+
+// Occupy marks cidr as allocated, returning an error if it is not a node CIDR within the cluster CIDR
+func (a *CIDRAllocator) Occupy(cidr *net.IPNet) error {
+	index, err := a.indexOf(cidr)
+	if err != nil {
+		return err
+	}
+	a.used[index] = true
+	return nil
+}
+
+// Release marks cidr as free; CIDRs that we do not manage are ignored
+func (a *CIDRAllocator) Release(cidr *net.IPNet) {
+	index, err := a.indexOf(cidr)
+	if err != nil {
+		return
+	}
+	delete(a.used, index)
+}
+
+// Allocate returns a free node CIDR, marking it as allocated
+func (a *CIDRAllocator) Allocate() (*net.IPNet, error) {
+	if len(a.used) >= a.count {
+		return nil, fmt.Errorf("cluster CIDR %s is full: all %d node CIDRs of size /%d are allocated", a.clusterCIDR, a.count, a.maskSize)
+	}
+	for i := 0; i < a.count; i++ {
+		index := (a.next + i) % a.count
+		if a.used[index] {
+			continue
+		}
+		a.used[index] = true
+		a.next = (index + 1) % a.count
+		return a.cidrAt(index), nil
+	}
+	return nil, fmt.Errorf("cluster CIDR %s is full", a.clusterCIDR)
+}
+
+// cidrAt returns the node CIDR with the given index
+func (a *CIDRAllocator) cidrAt(index int) *net.IPNet {
+	ip := new(big.Int).Add(a.base, new(big.Int).Lsh(big.NewInt(int64(index)), a.shift))
+
+	_, bits := a.clusterCIDR.Mask.Size()
+	b := ip.FillBytes(make([]byte, bits/8))
+	return &net.IPNet{IP: net.IP(b), Mask: net.CIDRMask(a.maskSize, bits)}
+}
+
+// indexOf returns the index of cidr, which must be a node CIDR within the cluster CIDR
+func (a *CIDRAllocator) indexOf(cidr *net.IPNet) (int, error) {
+	ones, bits := cidr.Mask.Size()
+	_, clusterBits := a.clusterCIDR.Mask.Size()
+	if ones != a.maskSize || bits != clusterBits || !a.clusterCIDR.Contains(cidr.IP) {
+		return 0, fmt.Errorf("%s is not a /%d within cluster CIDR %s", cidr, a.maskSize, a.clusterCIDR)
+	}
+
+	ip := new(big.Int).SetBytes(normalizeIP(cidr.IP.Mask(cidr.Mask)))
+	offset := new(big.Int).Sub(ip, a.base)
+	return int(offset.Rsh(offset, a.shift).Int64()), nil
+}
+
+// normalizeIP returns the 4-byte form of IPv4 addresses, so that they match the size of their mask
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
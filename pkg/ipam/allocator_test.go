@@ -0,0 +1,85 @@
+package ipam
+
+import (
+	"net"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	_, cidr, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("error parsing %q: %v", s, err)
+	}
+	return cidr
+}
+
+func TestCIDRAllocator(t *testing.T) {
+	a, err := NewCIDRAllocator(mustParseCIDR(t, "100.96.0.0/22"), 24)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := a.Occupy(mustParseCIDR(t, "100.96.1.0/24")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := a.Occupy(mustParseCIDR(t, "10.0.0.0/24")); err == nil {
+		t.Errorf("expected error occupying a CIDR outside the cluster CIDR")
+	}
+	if err := a.Occupy(mustParseCIDR(t, "100.96.2.0/25")); err == nil {
+		t.Errorf("expected error occupying a CIDR of the wrong size")
+	}
+
+	var allocated []string
+	for i := 0; i < 3; i++ {
+		cidr, err := a.Allocate()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		allocated = append(allocated, cidr.String())
+	}
+	expected := []string{"100.96.0.0/24", "100.96.2.0/24", "100.96.3.0/24"}
+	for i := range expected {
+		if allocated[i] != expected[i] {
+			t.Errorf("unexpected allocations %v, expected %v", allocated, expected)
+			break
+		}
+	}
+
+	if _, err := a.Allocate(); err == nil {
+		t.Errorf("expected error when the cluster CIDR is full")
+	}
+
+	a.Release(mustParseCIDR(t, "100.96.2.0/24"))
+	cidr, err := a.Allocate()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cidr.String() != "100.96.2.0/24" {
+		t.Errorf("expected released CIDR to be reallocated, got %s", cidr)
+	}
+}
+
+func TestCIDRAllocatorIPv6(t *testing.T) {
+	a, err := NewCIDRAllocator(mustParseCIDR(t, "fd00:10:96::/48"), 64)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := a.Occupy(mustParseCIDR(t, "fd00:10:96::/64")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cidr, err := a.Allocate()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cidr.String() != "fd00:10:96:1::/64" {
+		t.Errorf("unexpected allocation %s", cidr)
+	}
+}
+
+func TestNewCIDRAllocatorMaskSize(t *testing.T) {
+	for _, maskSize := range []int{8, 33, 40} {
+		if _, err := NewCIDRAllocator(mustParseCIDR(t, "100.96.0.0/12"), maskSize); err == nil {
+			t.Errorf("expected error for mask size %d", maskSize)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// Controller allocates a PodCIDR to every node that does not have one, from the default pool or an IPPool.
+// Only one Controller should run in the cluster at a time, so it is run under leader election.
+type Controller struct {
+	kubeClient   kubernetes.Interface
+	defaultPool  Pool
+	resyncPeriod time.Duration
+
+	// mutex guards pools, which are replaced when the IPPools change
+	mutex sync.Mutex
+	pools []Pool
+	// poolsChanged is signalled when pools changes, so that we relist
+	poolsChanged chan struct{}
+
+	// allocators is rebuilt from the node list every time we relist
+	allocators *poolAllocators
+}
+
+// NewController builds a Controller, allocating node CIDRs with prefix length maskSize from clusterCIDR,
+// and from the pools passed to SetPools
+func NewController(kubeClient kubernetes.Interface, clusterCIDR *net.IPNet, maskSize int, resyncPeriod time.Duration) (*Controller, error) {
+	// We check the mask size now, so that Run cannot fail on it
+	if _, err := NewCIDRAllocator(clusterCIDR, maskSize); err != nil {
+		return nil, err
+	}
+
+	c := &Controller{
+		kubeClient: kubeClient,
+		defaultPool: Pool{
+			Name:     DefaultPoolName,
+			CIDR:     clusterCIDR,
+			MaskSize: maskSize,
+		},
+		resyncPeriod: resyncPeriod,
+		poolsChanged: make(chan struct{}, 1),
+	}
+	return c, nil
+}
+
+// SetPools replaces the pools we allocate from, in addition to the default pool
+func (c *Controller) SetPools(pools []Pool) {
+	c.mutex.Lock()
+	c.pools = pools
+	c.mutex.Unlock()
+
+	select {
+	case c.poolsChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Run allocates node CIDRs until ctx is cancelled
+func (c *Controller) Run(ctx context.Context) {
+	klog.Infof("starting ipam controller, allocating /%d node CIDRs from %s and any IPPools", c.defaultPool.MaskSize, c.defaultPool.CIDR)
+
+	for {
+		err := c.runOnce(ctx)
+		if ctx.Err() != nil {
+			klog.Infof("exiting ipam controller")
+			return
+		}
+		if err != nil {
+			klog.Warningf("unexpected error in ipam controller, will restart watch: %v", err)
+			time.Sleep(10 * time.Second)
+		}
+	}
+}
+
+// runOnce lists all nodes, allocating CIDRs where needed, and then watches for changes until the resync period elapses
+func (c *Controller) runOnce(ctx context.Context) error {
+	var listOpts metav1.ListOptions
+	listOpts.AllowWatchBookmarks = true
+
+	nodeList, err := c.kubeClient.CoreV1().Nodes().List(ctx, listOpts)
+	if err != nil {
+		return fmt.Errorf("error listing nodes: %w", err)
+	}
+
+	c.mutex.Lock()
+	pools := c.pools
+	c.mutex.Unlock()
+	allocators, err := newPoolAllocators(c.defaultPool, pools)
+	if err != nil {
+		return err
+	}
+	c.allocators = allocators
+
+	// We occupy every existing CIDR before allocating any, so that we never hand out a CIDR that is in use
+	for i := range nodeList.Items {
+		c.occupy(&nodeList.Items[i])
+	}
+	for i := range nodeList.Items {
+		if err := c.ensureCIDR(ctx, &nodeList.Items[i]); err != nil {
+			klog.Warningf("%v", err)
+		}
+	}
+
+	listOpts.Watch = true
+	listOpts.ResourceVersion = nodeList.ResourceVersion
+	watcher, err := c.kubeClient.CoreV1().Nodes().Watch(ctx, listOpts)
+	if err != nil {
+		return fmt.Errorf("error watching nodes: %w", err)
+	}
+	defer watcher.Stop()
+
+	var resync <-chan time.Time
+	if c.resyncPeriod > 0 {
+		timer := time.NewTimer(c.resyncPeriod)
+		defer timer.Stop()
+		resync = timer.C
+	}
+
+	ch := watcher.ResultChan()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-resync:
+			klog.V(2).Infof("resync period elapsed; relisting nodes")
+			return nil
+		case <-c.poolsChanged:
+			klog.Infof("pools changed; relisting nodes")
+			return nil
+		case event, ok := <-ch:
+			if !ok {
+				return nil
+			}
+
+			if event.Type == watch.Error {
+				return fmt.Errorf("error from watch: %v", event.Object)
+			}
+			if event.Type == watch.Bookmark {
+				continue
+			}
+
+			node, ok := event.Object.(*corev1.Node)
+			if !ok {
+				return fmt.Errorf("object had unexpected type %T", event.Object)
+			}
+
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				c.occupy(node)
+				if err := c.ensureCIDR(ctx, node); err != nil {
+					klog.Warningf("%v", err)
+				}
+
+			case watch.Deleted:
+				for _, cidr := range nodeCIDRs(node) {
+					klog.Infof("releasing CIDR %s of deleted node %q", cidr, node.Name)
+					c.allocators.release(cidr)
+				}
+			}
+		}
+	}
+}
+
+// occupy marks the CIDRs of node as allocated
+func (c *Controller) occupy(node *corev1.Node) {
+	for _, cidr := range nodeCIDRs(node) {
+		c.allocators.occupy(node.Name, cidr)
+	}
+}
+
+// ensureCIDR allocates a CIDR to node, if it does not already have one
+func (c *Controller) ensureCIDR(ctx context.Context, node *corev1.Node) error {
+	if node.Spec.PodCIDR != "" || len(node.Spec.PodCIDRs) != 0 {
+		return nil
+	}
+
+	cidr, poolName, err := c.allocators.allocate(node)
+	if err != nil {
+		return fmt.Errorf("unable to allocate CIDR for node %q: %w", node.Name, err)
+	}
+
+	klog.Infof("allocating CIDR %s from pool %q to node %q", cidr, poolName, node.Name)
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"podCIDR":  cidr.String(),
+			"podCIDRs": []string{cidr.String()},
+		},
+	})
+	if err != nil {
+		c.allocators.release(cidr)
+		return err
+	}
+	if _, err := c.kubeClient.CoreV1().Nodes().Patch(ctx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		// We will retry when we relist, or when the node next changes
+		c.allocators.release(cidr)
+		return fmt.Errorf("error setting CIDR of node %q: %w", node.Name, err)
+	}
+	return nil
+}
+
+// nodeCIDRs returns the parsed PodCIDRs of node, ignoring invalid values
+func nodeCIDRs(node *corev1.Node) []*net.IPNet {
+	values := node.Spec.PodCIDRs
+	if len(values) == 0 && node.Spec.PodCIDR != "" {
+		values = []string{node.Spec.PodCIDR}
+	}
+
+	var cidrs []*net.IPNet
+	for _, s := range values {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			klog.Warningf("ignoring invalid CIDR %q on node %q", s, node.Name)
+			continue
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs
+}
@@ -0,0 +1,54 @@
+package ipam
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestControllerEnsureCIDR(t *testing.T) {
+	ctx := context.Background()
+
+	existing := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       corev1.NodeSpec{PodCIDR: "100.96.0.0/24", PodCIDRs: []string{"100.96.0.0/24"}},
+	}
+	added := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node2"},
+	}
+	kubeClient := fake.NewSimpleClientset(existing, added)
+
+	c, err := NewController(kubeClient, mustParseCIDR(t, "100.96.0.0/16"), 24, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.allocators, _ = newPoolAllocators(c.defaultPool, nil)
+
+	for _, node := range []*corev1.Node{existing, added} {
+		c.occupy(node)
+	}
+	for _, node := range []*corev1.Node{existing, added} {
+		if err := c.ensureCIDR(ctx, node); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	node, err := kubeClient.CoreV1().Nodes().Get(ctx, "node2", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if node.Spec.PodCIDR != "100.96.1.0/24" || len(node.Spec.PodCIDRs) != 1 || node.Spec.PodCIDRs[0] != "100.96.1.0/24" {
+		t.Errorf("unexpected CIDRs for new node: %q %v", node.Spec.PodCIDR, node.Spec.PodCIDRs)
+	}
+
+	node, err = kubeClient.CoreV1().Nodes().Get(ctx, "node1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if node.Spec.PodCIDR != "100.96.0.0/24" {
+		t.Errorf("existing CIDR was changed to %q", node.Spec.PodCIDR)
+	}
+}
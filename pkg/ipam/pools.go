@@ -0,0 +1,169 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	networkingv1alpha1 "kope.io/networking/pkg/apis/networking/v1alpha1"
+)
+
+// DefaultPoolName is the name of the pool built from the podCIDR of the agent configuration
+const DefaultPoolName = "podCIDR"
+
+// Pool is a block of address space from which we allocate node CIDRs
+type Pool struct {
+	Name     string
+	CIDR     *net.IPNet
+	MaskSize int
+
+	// Selector restricts the pool to matching nodes; nil means the pool is for all nodes that no pool selects
+	Selector labels.Selector
+}
+
+// PoolFromAPI converts an IPPool; defaultMaskSize returns the block size to use for a CIDR if the pool does not set one
+func PoolFromAPI(pool *networkingv1alpha1.IPPool, defaultMaskSize func(cidr *net.IPNet) int) (Pool, error) {
+	_, cidr, err := net.ParseCIDR(pool.Spec.CIDR)
+	if err != nil {
+		return Pool{}, fmt.Errorf("IPPool %q has invalid cidr %q", pool.Name, pool.Spec.CIDR)
+	}
+
+	p := Pool{
+		Name:     pool.Name,
+		CIDR:     cidr,
+		MaskSize: pool.Spec.BlockSize,
+	}
+	if p.MaskSize == 0 {
+		p.MaskSize = defaultMaskSize(cidr)
+	}
+	if _, err := NewCIDRAllocator(p.CIDR, p.MaskSize); err != nil {
+		return Pool{}, fmt.Errorf("IPPool %q has invalid blockSize: %w", pool.Name, err)
+	}
+
+	if pool.Spec.NodeSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(pool.Spec.NodeSelector)
+		if err != nil {
+			return Pool{}, fmt.Errorf("IPPool %q has invalid nodeSelector: %w", pool.Name, err)
+		}
+		if !selector.Empty() {
+			p.Selector = selector
+		}
+	}
+	return p, nil
+}
+
+// poolAllocator tracks the allocations within one pool
+type poolAllocator struct {
+	pool      Pool
+	allocator *CIDRAllocator
+}
+
+// poolAllocators tracks the allocations within all the pools
+type poolAllocators struct {
+	// pools are in priority order: the default pool, then the other pools by name
+	pools []*poolAllocator
+}
+
+// NonOverlapping returns pools in name order, without the pools that overlap clusterCIDR or an earlier pool
+func NonOverlapping(clusterCIDR *net.IPNet, pools []Pool) []Pool {
+	sorted := append([]Pool(nil), pools...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	accepted := []Pool{{Name: DefaultPoolName, CIDR: clusterCIDR}}
+	for _, pool := range sorted {
+		overlaps := false
+		for _, existing := range accepted {
+			if existing.CIDR.Contains(pool.CIDR.IP) || pool.CIDR.Contains(existing.CIDR.IP) {
+				klog.Warningf("ignoring pool %q: %s overlaps pool %q", pool.Name, pool.CIDR, existing.Name)
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			accepted = append(accepted, pool)
+		}
+	}
+	return accepted[1:]
+}
+
+// newPoolAllocators builds the allocators for the default pool and pools, skipping pools that overlap an earlier pool
+func newPoolAllocators(defaultPool Pool, pools []Pool) (*poolAllocators, error) {
+	a := &poolAllocators{}
+	for _, pool := range append([]Pool{defaultPool}, NonOverlapping(defaultPool.CIDR, pools)...) {
+		allocator, err := NewCIDRAllocator(pool.CIDR, pool.MaskSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pool %q: %w", pool.Name, err)
+		}
+		a.pools = append(a.pools, &poolAllocator{pool: pool, allocator: allocator})
+	}
+	return a, nil
+}
+
+// overlapping returns the pool that overlaps cidr, or nil
+func (a *poolAllocators) overlapping(cidr *net.IPNet) *poolAllocator {
+	for _, p := range a.pools {
+		if p.pool.CIDR.Contains(cidr.IP) || cidr.Contains(p.pool.CIDR.IP) {
+			return p
+		}
+	}
+	return nil
+}
+
+// occupy marks cidr as allocated in the pool that contains it
+func (a *poolAllocators) occupy(nodeName string, cidr *net.IPNet) {
+	p := a.overlapping(cidr)
+	if p == nil {
+		// e.g. the other family of a dual-stack node, or a pool that has been deleted
+		klog.V(2).Infof("CIDR %s of node %q is not in any pool", cidr, nodeName)
+		return
+	}
+	if err := p.allocator.Occupy(cidr); err != nil {
+		klog.Warningf("node %q has a CIDR we did not allocate: %v", nodeName, err)
+	}
+}
+
+// release marks cidr as free in the pool that contains it
+func (a *poolAllocators) release(cidr *net.IPNet) {
+	if p := a.overlapping(cidr); p != nil {
+		p.allocator.Release(cidr)
+	}
+}
+
+// candidates returns the pools from which node may be allocated, in the order we try them:
+// if any pool selects the node, only the pools that select it; otherwise the pools without a selector.
+func (a *poolAllocators) candidates(node *corev1.Node) []*poolAllocator {
+	var selected, general []*poolAllocator
+	for _, p := range a.pools {
+		if p.pool.Selector == nil {
+			general = append(general, p)
+		} else if p.pool.Selector.Matches(labels.Set(node.Labels)) {
+			selected = append(selected, p)
+		}
+	}
+	if len(selected) != 0 {
+		return selected
+	}
+	return general
+}
+
+// allocate returns a free CIDR for node from the first candidate pool with space
+func (a *poolAllocators) allocate(node *corev1.Node) (*net.IPNet, string, error) {
+	candidates := a.candidates(node)
+	if len(candidates) == 0 {
+		return nil, "", fmt.Errorf("no pool for node %q", node.Name)
+	}
+
+	var errs []error
+	for _, p := range candidates {
+		cidr, err := p.allocator.Allocate()
+		if err == nil {
+			return cidr, p.pool.Name, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, "", fmt.Errorf("all pools for node %q are full: %v", node.Name, errs)
+}
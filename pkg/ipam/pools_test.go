@@ -0,0 +1,84 @@
+package ipam
+
+import (
+	"net"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	networkingv1alpha1 "kope.io/networking/pkg/apis/networking/v1alpha1"
+)
+
+func testPool(t *testing.T, name string, cidr string, blockSize int, nodeSelector *metav1.LabelSelector) Pool {
+	pool, err := PoolFromAPI(&networkingv1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       networkingv1alpha1.IPPoolSpec{CIDR: cidr, BlockSize: blockSize, NodeSelector: nodeSelector},
+	}, func(cidr *net.IPNet) int { return 24 })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return pool
+}
+
+func TestPoolAllocators(t *testing.T) {
+	defaultPool := Pool{Name: DefaultPoolName, CIDR: mustParseCIDR(t, "100.96.0.0/23"), MaskSize: 24}
+	edge := &metav1.LabelSelector{MatchLabels: map[string]string{"pool": "edge"}}
+	pools := []Pool{
+		testPool(t, "growth", "100.98.0.0/16", 0, nil),
+		testPool(t, "edge", "100.97.0.0/24", 26, edge),
+		testPool(t, "overlapping", "100.96.1.0/24", 0, nil),
+	}
+
+	a, err := newPoolAllocators(defaultPool, pools)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(a.pools) != 3 {
+		t.Errorf("expected the overlapping pool to be ignored, got %d pools", len(a.pools))
+	}
+
+	a.occupy("node1", mustParseCIDR(t, "100.96.0.0/24"))
+
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}}
+	edgeNode := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node3", Labels: map[string]string{"pool": "edge"}}}
+
+	grid := []struct {
+		node     *corev1.Node
+		expected string
+		pool     string
+	}{
+		{node: node, expected: "100.96.1.0/24", pool: DefaultPoolName},
+		{node: node, expected: "100.98.0.0/24", pool: "growth"},
+		{node: edgeNode, expected: "100.97.0.0/26", pool: "edge"},
+		{node: edgeNode, expected: "100.97.0.64/26", pool: "edge"},
+	}
+	for _, g := range grid {
+		cidr, pool, err := a.allocate(g.node)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cidr.String() != g.expected || pool != g.pool {
+			t.Errorf("allocated %s from %q for %s, expected %s from %q", cidr, pool, g.node.Name, g.expected, g.pool)
+		}
+	}
+
+	// Edge nodes never fall back to the general pools
+	a.allocate(edgeNode)
+	a.allocate(edgeNode)
+	if cidr, _, err := a.allocate(edgeNode); err == nil {
+		t.Errorf("expected error when the edge pool is full, got %s", cidr)
+	}
+}
+
+func TestPoolFromAPIInvalid(t *testing.T) {
+	defaultMaskSize := func(cidr *net.IPNet) int { return 24 }
+	for _, spec := range []networkingv1alpha1.IPPoolSpec{
+		{CIDR: "100.97.0.0"},
+		{CIDR: "100.97.0.0/16", BlockSize: 8},
+		{CIDR: "100.97.0.0/16", NodeSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "a", Operator: "Sometimes"}}}},
+	} {
+		if _, err := PoolFromAPI(&networkingv1alpha1.IPPool{Spec: spec}, defaultMaskSize); err == nil {
+			t.Errorf("expected error for %+v", spec)
+		}
+	}
+}
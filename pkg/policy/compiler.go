@@ -0,0 +1,402 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	"kope.io/networking/pkg/routing/netutil"
+)
+
+// CompilerInput is the cluster state we compile into per-pod policy
+type CompilerInput struct {
+	// NodeName is the name of this node; only pods on this node are compiled
+	NodeName string
+
+	Pods       []*corev1.Pod
+	Namespaces []*corev1.Namespace
+	Policies   []*networkingv1.NetworkPolicy
+}
+
+// PodPolicy is the compiled policy for a pod on this node
+type PodPolicy struct {
+	Namespace string
+	Name      string
+	IP        net.IP
+
+	// Ingress is nil if the pod is not isolated for ingress
+	Ingress *DirectionPolicy
+	// Egress is nil if the pod is not isolated for egress
+	Egress *DirectionPolicy
+}
+
+// DirectionPolicy holds the rules for one direction; traffic matching none of the rules is dropped.
+type DirectionPolicy struct {
+	Rules []*Rule
+}
+
+// Rule allows traffic to or from Peers on Ports
+type Rule struct {
+	// AllPeers is set if the rule applies to all sources (ingress) or destinations (egress)
+	AllPeers bool
+	Peers    []AddressRange
+
+	// AllPorts is set if the rule applies to all ports and protocols
+	AllPorts bool
+	Ports    []Port
+}
+
+// Port is a protocol and (optional) port range
+type Port struct {
+	Protocol corev1.Protocol
+	// Port is 0 if all ports of Protocol are allowed
+	Port int32
+	// EndPort is 0 unless this is a port range
+	EndPort int32
+}
+
+// AddressRange is an inclusive range of IPv4 addresses
+type AddressRange struct {
+	Start net.IP
+	End   net.IP
+}
+
+func (r AddressRange) String() string {
+	if r.Start.Equal(r.End) {
+		return r.Start.String()
+	}
+	return r.Start.String() + "-" + r.End.String()
+}
+
+// Compile computes the policy for each pod on this node.
+// Pods are returned sorted by namespace and name, so the output is stable.
+func Compile(in *CompilerInput) []*PodPolicy {
+	c := &compiler{
+		namespaceLabels:   make(map[string]labels.Set),
+		policiesNamespace: make(map[string][]*networkingv1.NetworkPolicy),
+	}
+	for _, ns := range in.Namespaces {
+		c.namespaceLabels[ns.Name] = labels.Set(ns.Labels)
+	}
+	for _, policy := range in.Policies {
+		c.policiesNamespace[policy.Namespace] = append(c.policiesNamespace[policy.Namespace], policy)
+	}
+	for _, pod := range in.Pods {
+		if podIP(pod) == nil {
+			continue
+		}
+		c.pods = append(c.pods, pod)
+	}
+	sort.Slice(c.pods, func(i, j int) bool {
+		if c.pods[i].Namespace != c.pods[j].Namespace {
+			return c.pods[i].Namespace < c.pods[j].Namespace
+		}
+		return c.pods[i].Name < c.pods[j].Name
+	})
+	for _, policies := range c.policiesNamespace {
+		sort.Slice(policies, func(i, j int) bool {
+			return policies[i].Name < policies[j].Name
+		})
+	}
+
+	var out []*PodPolicy
+	for _, pod := range c.pods {
+		if pod.Spec.NodeName != in.NodeName {
+			continue
+		}
+		out = append(out, c.compilePod(pod))
+	}
+	return out
+}
+
+type compiler struct {
+	// pods holds the pods that have an IP, sorted by namespace and name
+	pods              []*corev1.Pod
+	namespaceLabels   map[string]labels.Set
+	policiesNamespace map[string][]*networkingv1.NetworkPolicy
+}
+
+func (c *compiler) compilePod(pod *corev1.Pod) *PodPolicy {
+	out := &PodPolicy{
+		Namespace: pod.Namespace,
+		Name:      pod.Name,
+		IP:        podIP(pod),
+	}
+
+	for _, policy := range c.policiesNamespace[pod.Namespace] {
+		selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector)
+		if err != nil {
+			klog.Warningf("ignoring NetworkPolicy %s/%s with invalid podSelector: %v", policy.Namespace, policy.Name, err)
+			continue
+		}
+		if !selector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+
+		affectsIngress, affectsEgress := policyTypes(policy)
+		if affectsIngress {
+			if out.Ingress == nil {
+				out.Ingress = &DirectionPolicy{}
+			}
+			for i := range policy.Spec.Ingress {
+				rule := &policy.Spec.Ingress[i]
+				out.Ingress.Rules = append(out.Ingress.Rules, c.compileRule(pod, policy, rule.From, rule.Ports, true)...)
+			}
+		}
+		if affectsEgress {
+			if out.Egress == nil {
+				out.Egress = &DirectionPolicy{}
+			}
+			for i := range policy.Spec.Egress {
+				rule := &policy.Spec.Egress[i]
+				out.Egress.Rules = append(out.Egress.Rules, c.compileRule(pod, policy, rule.To, rule.Ports, false)...)
+			}
+		}
+	}
+
+	return out
+}
+
+// policyTypes returns whether the policy applies to ingress and egress, applying the API defaulting rules
+func policyTypes(policy *networkingv1.NetworkPolicy) (bool, bool) {
+	if len(policy.Spec.PolicyTypes) == 0 {
+		return true, len(policy.Spec.Egress) != 0
+	}
+	ingress := false
+	egress := false
+	for _, t := range policy.Spec.PolicyTypes {
+		switch t {
+		case networkingv1.PolicyTypeIngress:
+			ingress = true
+		case networkingv1.PolicyTypeEgress:
+			egress = true
+		}
+	}
+	return ingress, egress
+}
+
+// compileRule compiles a single ingress or egress rule.
+// Named ports are resolved against the pod itself for ingress, and against the peer pods for egress;
+// because peers can use different numbers for the same port name, a rule can compile to several rules.
+func (c *compiler) compileRule(pod *corev1.Pod, policy *networkingv1.NetworkPolicy, peers []networkingv1.NetworkPolicyPeer, ports []networkingv1.NetworkPolicyPort, ingress bool) []*Rule {
+	allPeers := len(peers) == 0
+	var peerRanges []AddressRange
+	var peerPods []*corev1.Pod
+	if allPeers {
+		peerPods = c.pods
+	} else {
+		peerRanges, peerPods = c.resolvePeers(policy, peers)
+	}
+
+	if len(ports) == 0 {
+		return []*Rule{{AllPeers: allPeers, Peers: peerRanges, AllPorts: true}}
+	}
+
+	var out []*Rule
+
+	numbered := &Rule{AllPeers: allPeers, Peers: peerRanges}
+	for i := range ports {
+		port := &ports[i]
+
+		protocol := corev1.ProtocolTCP
+		if port.Protocol != nil {
+			protocol = *port.Protocol
+		}
+
+		if port.Port == nil {
+			numbered.Ports = append(numbered.Ports, Port{Protocol: protocol})
+			continue
+		}
+
+		if port.Port.IntVal != 0 || port.Port.StrVal == "" {
+			p := Port{Protocol: protocol, Port: port.Port.IntVal}
+			if port.EndPort != nil {
+				p.EndPort = *port.EndPort
+			}
+			numbered.Ports = append(numbered.Ports, p)
+			continue
+		}
+
+		name := port.Port.StrVal
+		if ingress {
+			if n := namedPort(pod, name, protocol); n != 0 {
+				numbered.Ports = append(numbered.Ports, Port{Protocol: protocol, Port: n})
+			}
+			continue
+		}
+
+		// Group the peer pods by the port number they use for this name
+		byNumber := make(map[int32][]*corev1.Pod)
+		var numbers []int32
+		for _, peerPod := range peerPods {
+			n := namedPort(peerPod, name, protocol)
+			if n == 0 {
+				continue
+			}
+			if byNumber[n] == nil {
+				numbers = append(numbers, n)
+			}
+			byNumber[n] = append(byNumber[n], peerPod)
+		}
+		sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+		for _, n := range numbers {
+			var ips []net.IP
+			for _, peerPod := range byNumber[n] {
+				ips = append(ips, podIP(peerPod))
+			}
+			out = append(out, &Rule{
+				Peers: rangesForIPs(ips),
+				Ports: []Port{{Protocol: protocol, Port: n}},
+			})
+		}
+	}
+
+	if len(numbered.Ports) != 0 {
+		out = append([]*Rule{numbered}, out...)
+	}
+	return out
+}
+
+// resolvePeers returns the address ranges that match the peers, and the pods they select
+func (c *compiler) resolvePeers(policy *networkingv1.NetworkPolicy, peers []networkingv1.NetworkPolicyPeer) ([]AddressRange, []*corev1.Pod) {
+	var ranges []netutil.IPv4Range
+	var pods []*corev1.Pod
+	seen := make(map[*corev1.Pod]bool)
+
+	for i := range peers {
+		peer := &peers[i]
+
+		if peer.IPBlock != nil {
+			r, err := ipBlockRanges(peer.IPBlock)
+			if err != nil {
+				klog.Warningf("ignoring invalid ipBlock in NetworkPolicy %s/%s: %v", policy.Namespace, policy.Name, err)
+				continue
+			}
+			ranges = append(ranges, r...)
+			continue
+		}
+
+		podSelector := labels.Everything()
+		if peer.PodSelector != nil {
+			s, err := metav1.LabelSelectorAsSelector(peer.PodSelector)
+			if err != nil {
+				klog.Warningf("ignoring invalid podSelector in NetworkPolicy %s/%s: %v", policy.Namespace, policy.Name, err)
+				continue
+			}
+			podSelector = s
+		}
+
+		var namespaceSelector labels.Selector
+		if peer.NamespaceSelector != nil {
+			s, err := metav1.LabelSelectorAsSelector(peer.NamespaceSelector)
+			if err != nil {
+				klog.Warningf("ignoring invalid namespaceSelector in NetworkPolicy %s/%s: %v", policy.Namespace, policy.Name, err)
+				continue
+			}
+			namespaceSelector = s
+		}
+
+		for _, pod := range c.pods {
+			if namespaceSelector == nil {
+				if pod.Namespace != policy.Namespace {
+					continue
+				}
+			} else if !namespaceSelector.Matches(c.namespaceLabels[pod.Namespace]) {
+				continue
+			}
+			if !podSelector.Matches(labels.Set(pod.Labels)) {
+				continue
+			}
+			if seen[pod] {
+				continue
+			}
+			seen[pod] = true
+			pods = append(pods, pod)
+
+			ip := netutil.IPv4ToUint32(podIP(pod))
+			ranges = append(ranges, netutil.IPv4Range{Start: ip, End: ip})
+		}
+	}
+
+	return toAddressRanges(ranges), pods
+}
+
+// namedPort returns the container port with the given name and protocol, or 0 if not found
+func namedPort(pod *corev1.Pod, name string, protocol corev1.Protocol) int32 {
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		for _, port := range container.Ports {
+			portProtocol := port.Protocol
+			if portProtocol == "" {
+				portProtocol = corev1.ProtocolTCP
+			}
+			if port.Name == name && portProtocol == protocol {
+				return port.ContainerPort
+			}
+		}
+	}
+	return 0
+}
+
+// podIP returns the IPv4 address of a running pod in the pod network, or nil
+func podIP(pod *corev1.Pod) net.IP {
+	if pod.Spec.HostNetwork {
+		return nil
+	}
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return nil
+	}
+	ip := net.ParseIP(pod.Status.PodIP)
+	if ip == nil {
+		return nil
+	}
+	return ip.To4()
+}
+
+func toAddressRanges(ranges []netutil.IPv4Range) []AddressRange {
+	var out []AddressRange
+	for _, r := range netutil.MergeIPv4Ranges(ranges) {
+		out = append(out, AddressRange{Start: netutil.Uint32ToIPv4(r.Start), End: netutil.Uint32ToIPv4(r.End)})
+	}
+	return out
+}
+
+func rangesForIPs(ips []net.IP) []AddressRange {
+	var ranges []netutil.IPv4Range
+	for _, ip := range ips {
+		v := netutil.IPv4ToUint32(ip)
+		ranges = append(ranges, netutil.IPv4Range{Start: v, End: v})
+	}
+	return toAddressRanges(ranges)
+}
+
+// ipBlockRanges returns the ranges in the ipBlock CIDR, minus the except CIDRs
+func ipBlockRanges(block *networkingv1.IPBlock) ([]netutil.IPv4Range, error) {
+	_, cidr, err := net.ParseCIDR(block.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CIDR %q: %w", block.CIDR, err)
+	}
+	r, err := netutil.IPv4RangeForCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := []netutil.IPv4Range{r}
+	for _, s := range block.Except {
+		_, except, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing except CIDR %q: %w", s, err)
+		}
+		x, err := netutil.IPv4RangeForCIDR(except)
+		if err != nil {
+			return nil, err
+		}
+		ranges = netutil.SubtractIPv4Range(ranges, x)
+	}
+	return ranges, nil
+}
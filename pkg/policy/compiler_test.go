@@ -0,0 +1,332 @@
+package policy
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func testPod(namespace, name, nodeName, ip string, labels map[string]string, ports ...corev1.ContainerPort) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+		Spec: corev1.PodSpec{
+			NodeName:   nodeName,
+			Containers: []corev1.Container{{Name: "main", Ports: ports}},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning, PodIP: ip},
+	}
+}
+
+func testNamespace(name string, labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+	}
+}
+
+func testPolicy(namespace, name string, spec networkingv1.NetworkPolicySpec) *networkingv1.NetworkPolicy {
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       spec,
+	}
+}
+
+func tcpPort(port intstr.IntOrString) networkingv1.NetworkPolicyPort {
+	protocol := corev1.ProtocolTCP
+	return networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &port}
+}
+
+// describe renders the compiled policy in a compact form, so test expectations are readable
+func describe(policies []*PodPolicy) []string {
+	var out []string
+	for _, p := range policies {
+		s := fmt.Sprintf("%s/%s %s", p.Namespace, p.Name, p.IP)
+		s += " ingress=" + describeDirection(p.Ingress)
+		s += " egress=" + describeDirection(p.Egress)
+		out = append(out, s)
+	}
+	return out
+}
+
+func describeDirection(d *DirectionPolicy) string {
+	if d == nil {
+		return "open"
+	}
+	var rules []string
+	for _, r := range d.Rules {
+		peers := "*"
+		if !r.AllPeers {
+			var s []string
+			for _, peer := range r.Peers {
+				s = append(s, peer.String())
+			}
+			peers = strings.Join(s, ",")
+		}
+		ports := "*"
+		if !r.AllPorts {
+			var s []string
+			for _, port := range r.Ports {
+				p := string(port.Protocol)
+				if port.Port != 0 {
+					p += fmt.Sprintf(":%d", port.Port)
+				}
+				if port.EndPort != 0 {
+					p += fmt.Sprintf("-%d", port.EndPort)
+				}
+				s = append(s, p)
+			}
+			ports = strings.Join(s, ",")
+		}
+		rules = append(rules, peers+"/"+ports)
+	}
+	return "[" + strings.Join(rules, " ") + "]"
+}
+
+func TestCompile(t *testing.T) {
+	namespaces := []*corev1.Namespace{
+		testNamespace("default", nil),
+		testNamespace("monitoring", map[string]string{"team": "ops"}),
+	}
+
+	web := testPod("default", "web", "node1", "100.96.1.2", map[string]string{"app": "web"}, corev1.ContainerPort{Name: "http", ContainerPort: 8080})
+	db := testPod("default", "db", "node1", "100.96.1.3", map[string]string{"app": "db"})
+	client := testPod("default", "client", "node2", "100.96.2.2", map[string]string{"app": "client"})
+	prometheus := testPod("monitoring", "prometheus", "node2", "100.96.2.3", map[string]string{"app": "prometheus"})
+	hostNetwork := testPod("default", "hostnetwork", "node1", "10.0.0.1", map[string]string{"app": "web"})
+	hostNetwork.Spec.HostNetwork = true
+	api1 := testPod("default", "api1", "node2", "100.96.2.4", map[string]string{"app": "api"}, corev1.ContainerPort{Name: "api", ContainerPort: 9000})
+	api2 := testPod("default", "api2", "node2", "100.96.2.5", map[string]string{"app": "api"}, corev1.ContainerPort{Name: "api", ContainerPort: 9001})
+
+	pods := []*corev1.Pod{web, db, client, prometheus, hostNetwork}
+
+	grid := []struct {
+		name     string
+		pods     []*corev1.Pod
+		policies []*networkingv1.NetworkPolicy
+		expected []string
+	}{
+		{
+			name: "no policies",
+			pods: pods,
+			expected: []string{
+				"default/db 100.96.1.3 ingress=open egress=open",
+				"default/web 100.96.1.2 ingress=open egress=open",
+			},
+		},
+		{
+			name: "default deny ingress",
+			pods: pods,
+			policies: []*networkingv1.NetworkPolicy{
+				testPolicy("default", "deny", networkingv1.NetworkPolicySpec{
+					PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+				}),
+			},
+			expected: []string{
+				"default/db 100.96.1.3 ingress=[] egress=open",
+				"default/web 100.96.1.2 ingress=[] egress=open",
+			},
+		},
+		{
+			name: "policy in other namespace does not apply",
+			pods: pods,
+			policies: []*networkingv1.NetworkPolicy{
+				testPolicy("monitoring", "deny", networkingv1.NetworkPolicySpec{}),
+			},
+			expected: []string{
+				"default/db 100.96.1.3 ingress=open egress=open",
+				"default/web 100.96.1.2 ingress=open egress=open",
+			},
+		},
+		{
+			name: "allow from pod selector on port",
+			pods: pods,
+			policies: []*networkingv1.NetworkPolicy{
+				testPolicy("default", "db", networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+					Ingress: []networkingv1.NetworkPolicyIngressRule{
+						{
+							From: []networkingv1.NetworkPolicyPeer{
+								{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+							},
+							Ports: []networkingv1.NetworkPolicyPort{tcpPort(intstr.FromInt(5432))},
+						},
+					},
+				}),
+			},
+			expected: []string{
+				"default/db 100.96.1.3 ingress=[100.96.1.2/TCP:5432] egress=open",
+				"default/web 100.96.1.2 ingress=open egress=open",
+			},
+		},
+		{
+			name: "allow from namespace selector",
+			pods: pods,
+			policies: []*networkingv1.NetworkPolicy{
+				testPolicy("default", "web", networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					Ingress: []networkingv1.NetworkPolicyIngressRule{
+						{
+							From: []networkingv1.NetworkPolicyPeer{
+								{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "ops"}}},
+							},
+						},
+					},
+				}),
+			},
+			expected: []string{
+				"default/db 100.96.1.3 ingress=open egress=open",
+				"default/web 100.96.1.2 ingress=[100.96.2.3/*] egress=open",
+			},
+		},
+		{
+			name: "allow from namespace and pod selector",
+			pods: pods,
+			policies: []*networkingv1.NetworkPolicy{
+				testPolicy("default", "web", networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					Ingress: []networkingv1.NetworkPolicyIngressRule{
+						{
+							From: []networkingv1.NetworkPolicyPeer{
+								{
+									NamespaceSelector: &metav1.LabelSelector{},
+									PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "client"}},
+								},
+							},
+						},
+					},
+				}),
+			},
+			expected: []string{
+				"default/db 100.96.1.3 ingress=open egress=open",
+				"default/web 100.96.1.2 ingress=[100.96.2.2/*] egress=open",
+			},
+		},
+		{
+			name: "ingress named port resolves against the pod",
+			pods: pods,
+			policies: []*networkingv1.NetworkPolicy{
+				testPolicy("default", "web", networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					Ingress: []networkingv1.NetworkPolicyIngressRule{
+						{
+							Ports: []networkingv1.NetworkPolicyPort{tcpPort(intstr.FromString("http"))},
+						},
+					},
+				}),
+			},
+			expected: []string{
+				"default/db 100.96.1.3 ingress=open egress=open",
+				"default/web 100.96.1.2 ingress=[*/TCP:8080] egress=open",
+			},
+		},
+		{
+			name: "ip block with except and port range",
+			pods: pods,
+			policies: []*networkingv1.NetworkPolicy{
+				testPolicy("default", "db", networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+					Ingress: []networkingv1.NetworkPolicyIngressRule{
+						{
+							From: []networkingv1.NetworkPolicyPeer{
+								{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/16", Except: []string{"10.0.1.0/24"}}},
+							},
+							Ports: []networkingv1.NetworkPolicyPort{
+								func() networkingv1.NetworkPolicyPort {
+									p := tcpPort(intstr.FromInt(8000))
+									endPort := int32(8100)
+									p.EndPort = &endPort
+									return p
+								}(),
+							},
+						},
+					},
+				}),
+			},
+			expected: []string{
+				"default/db 100.96.1.3 ingress=[10.0.0.0-10.0.0.255,10.0.2.0-10.0.255.255/TCP:8000-8100] egress=open",
+				"default/web 100.96.1.2 ingress=open egress=open",
+			},
+		},
+		{
+			name: "egress policy, implied by egress rules",
+			pods: pods,
+			policies: []*networkingv1.NetworkPolicy{
+				testPolicy("default", "web", networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					Egress: []networkingv1.NetworkPolicyEgressRule{
+						{
+							To: []networkingv1.NetworkPolicyPeer{
+								{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}},
+							},
+						},
+					},
+				}),
+			},
+			expected: []string{
+				"default/db 100.96.1.3 ingress=open egress=open",
+				"default/web 100.96.1.2 ingress=[] egress=[100.96.1.3/*]",
+			},
+		},
+		{
+			name: "egress named port is resolved per peer",
+			pods: append([]*corev1.Pod{api1, api2}, pods...),
+			policies: []*networkingv1.NetworkPolicy{
+				testPolicy("default", "web", networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+					Egress: []networkingv1.NetworkPolicyEgressRule{
+						{
+							To: []networkingv1.NetworkPolicyPeer{
+								{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}}},
+							},
+							Ports: []networkingv1.NetworkPolicyPort{tcpPort(intstr.FromString("api"))},
+						},
+					},
+				}),
+			},
+			expected: []string{
+				"default/db 100.96.1.3 ingress=open egress=open",
+				"default/web 100.96.1.2 ingress=open egress=[100.96.2.4/TCP:9000 100.96.2.5/TCP:9001]",
+			},
+		},
+		{
+			name: "peer selecting nothing",
+			pods: pods,
+			policies: []*networkingv1.NetworkPolicy{
+				testPolicy("default", "web", networkingv1.NetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					Ingress: []networkingv1.NetworkPolicyIngressRule{
+						{
+							From: []networkingv1.NetworkPolicyPeer{
+								{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "missing"}}},
+							},
+						},
+					},
+				}),
+			},
+			expected: []string{
+				"default/db 100.96.1.3 ingress=open egress=open",
+				"default/web 100.96.1.2 ingress=[/*] egress=open",
+			},
+		},
+	}
+
+	for _, g := range grid {
+		t.Run(g.name, func(t *testing.T) {
+			actual := describe(Compile(&CompilerInput{
+				NodeName:   "node1",
+				Pods:       g.pods,
+				Namespaces: namespaces,
+				Policies:   g.policies,
+			}))
+			if !reflect.DeepEqual(actual, g.expected) {
+				t.Errorf("unexpected result\nactual:\n\t%s\nexpected:\n\t%s", strings.Join(actual, "\n\t"), strings.Join(g.expected, "\n\t"))
+			}
+		})
+	}
+}
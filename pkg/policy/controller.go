@@ -0,0 +1,288 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"kope.io/networking/pkg/routing"
+	"kope.io/networking/pkg/routing/netutil"
+)
+
+// policyTableName is the nftables table that holds the policy chains; it is shared with the masquerade rules,
+// and we only own the chains and sets whose names start with namePrefix.
+const policyTableName = "kopeio"
+
+// bridgeNetfilterSysctl must be enabled for traffic between pods on the same bridge to traverse the forward hook.
+// It is host-wide, so we save the previous value before enabling it, and Cleanup restores it.
+const bridgeNetfilterSysctl = "/proc/sys/net/bridge/bridge-nf-call-iptables"
+
+// bridgeNetfilterSavedPath holds the value of bridgeNetfilterSysctl from before we enabled it.
+// It is on the host filesystem, so that it survives restarts of the agent and can be read by `networking-agent cleanup`.
+const bridgeNetfilterSavedPath = "/var/lib/kopeio-networking/bridge-nf-call-iptables"
+
+// resyncInterval is how often we check the policy table when nothing has changed, in case it was changed outside of our control
+const resyncInterval = 1 * time.Minute
+
+// Controller enforces NetworkPolicy for the pods on this node
+type Controller struct {
+	kubeClient    kubernetes.Interface
+	nodeMap       *routing.NodeMap
+	interfaceName string
+
+	table *netutil.NftTable
+
+	mutex      sync.Mutex
+	version    uint64
+	pods       objectStore[*corev1.Pod]
+	namespaces objectStore[*corev1.Namespace]
+	policies   objectStore[*networkingv1.NetworkPolicy]
+	// changed is signalled by mutate, so that we only sync the table when the state has changed (or on resync)
+	changed chan struct{}
+
+	lastVersionCompiled uint64
+	lastNodeName        string
+	state               *netutil.NftState
+}
+
+// NewController creates a policy Controller; interfaceName is the pod-facing interface on which we enforce policy
+func NewController(kubeClient kubernetes.Interface, nodeMap *routing.NodeMap, interfaceName string) (*Controller, error) {
+	c := &Controller{
+		kubeClient:    kubeClient,
+		nodeMap:       nodeMap,
+		interfaceName: interfaceName,
+		table:         newPolicyTable(),
+		changed:       make(chan struct{}, 1),
+	}
+	return c, nil
+}
+
+func newPolicyTable() *netutil.NftTable {
+	return netutil.NewNftTableSection(nftables.TableFamilyIPv4, policyTableName, func(name string) bool {
+		return strings.HasPrefix(name, namePrefix)
+	})
+}
+
+// Cleanup removes the policy chains and restores bridgeNetfilterSysctl, without needing a controller
+func Cleanup() error {
+	var errs []error
+	if err := newPolicyTable().Delete(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := restoreBridgeNetfilter(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// enableBridgeNetfilter enables bridgeNetfilterSysctl, saving the previous value if we are the ones changing it
+func enableBridgeNetfilter() error {
+	b, err := os.ReadFile(bridgeNetfilterSysctl)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(b)) == "1" {
+		return nil
+	}
+
+	// If a value is already saved, we enabled the sysctl before and something has since disabled it; the saved value is still the original
+	if _, err := os.Stat(bridgeNetfilterSavedPath); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(bridgeNetfilterSavedPath), 0755); err != nil {
+			return fmt.Errorf("error creating directory for %s: %w", bridgeNetfilterSavedPath, err)
+		}
+		if err := os.WriteFile(bridgeNetfilterSavedPath, b, 0644); err != nil {
+			return fmt.Errorf("error saving previous value of %s: %w", bridgeNetfilterSysctl, err)
+		}
+	}
+
+	klog.Infof("enabling %s", bridgeNetfilterSysctl)
+	return os.WriteFile(bridgeNetfilterSysctl, []byte("1"), 0644)
+}
+
+// restoreBridgeNetfilter restores bridgeNetfilterSysctl to the value saved by enableBridgeNetfilter, if any
+func restoreBridgeNetfilter() error {
+	b, err := os.ReadFile(bridgeNetfilterSavedPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error reading saved value of %s: %w", bridgeNetfilterSysctl, err)
+	}
+
+	klog.Infof("restoring %s to %s", bridgeNetfilterSysctl, strings.TrimSpace(string(b)))
+	// If br_netfilter has since been unloaded there is nothing to restore
+	if err := os.WriteFile(bridgeNetfilterSysctl, b, 0644); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error restoring %s: %w", bridgeNetfilterSysctl, err)
+	}
+	if err := os.Remove(bridgeNetfilterSavedPath); err != nil {
+		return fmt.Errorf("error removing %s: %w", bridgeNetfilterSavedPath, err)
+	}
+	return nil
+}
+
+// Run starts the policy controller
+func (c *Controller) Run(ctx context.Context) error {
+	klog.Infof("starting network policy controller")
+
+	if err := enableBridgeNetfilter(); err != nil {
+		klog.Warningf("unable to enable %s; policy will not apply between pods on the same node: %v", bridgeNetfilterSysctl, err)
+	}
+
+	pods := &listWatch[*corev1.Pod]{
+		kind: "pods",
+		list: func(ctx context.Context, opts metav1.ListOptions) ([]*corev1.Pod, string, error) {
+			l, err := c.kubeClient.CoreV1().Pods("").List(ctx, opts)
+			if err != nil {
+				return nil, "", err
+			}
+			var out []*corev1.Pod
+			for i := range l.Items {
+				out = append(out, &l.Items[i])
+			}
+			return out, l.ResourceVersion, nil
+		},
+		watch: func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+			return c.kubeClient.CoreV1().Pods("").Watch(ctx, opts)
+		},
+		replaceAll: func(objects []*corev1.Pod) { c.mutate(func() { c.pods.replaceAll(objects) }) },
+		update:     func(obj *corev1.Pod) { c.mutate(func() { c.pods.update(obj) }) },
+		remove:     func(obj *corev1.Pod) { c.mutate(func() { c.pods.remove(obj) }) },
+	}
+	namespaces := &listWatch[*corev1.Namespace]{
+		kind: "namespaces",
+		list: func(ctx context.Context, opts metav1.ListOptions) ([]*corev1.Namespace, string, error) {
+			l, err := c.kubeClient.CoreV1().Namespaces().List(ctx, opts)
+			if err != nil {
+				return nil, "", err
+			}
+			var out []*corev1.Namespace
+			for i := range l.Items {
+				out = append(out, &l.Items[i])
+			}
+			return out, l.ResourceVersion, nil
+		},
+		watch: func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+			return c.kubeClient.CoreV1().Namespaces().Watch(ctx, opts)
+		},
+		replaceAll: func(objects []*corev1.Namespace) { c.mutate(func() { c.namespaces.replaceAll(objects) }) },
+		update:     func(obj *corev1.Namespace) { c.mutate(func() { c.namespaces.update(obj) }) },
+		remove:     func(obj *corev1.Namespace) { c.mutate(func() { c.namespaces.remove(obj) }) },
+	}
+	policies := &listWatch[*networkingv1.NetworkPolicy]{
+		kind: "networkpolicies",
+		list: func(ctx context.Context, opts metav1.ListOptions) ([]*networkingv1.NetworkPolicy, string, error) {
+			l, err := c.kubeClient.NetworkingV1().NetworkPolicies("").List(ctx, opts)
+			if err != nil {
+				return nil, "", err
+			}
+			var out []*networkingv1.NetworkPolicy
+			for i := range l.Items {
+				out = append(out, &l.Items[i])
+			}
+			return out, l.ResourceVersion, nil
+		},
+		watch: func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+			return c.kubeClient.NetworkingV1().NetworkPolicies("").Watch(ctx, opts)
+		},
+		replaceAll: func(objects []*networkingv1.NetworkPolicy) { c.mutate(func() { c.policies.replaceAll(objects) }) },
+		update:     func(obj *networkingv1.NetworkPolicy) { c.mutate(func() { c.policies.update(obj) }) },
+		remove:     func(obj *networkingv1.NetworkPolicy) { c.mutate(func() { c.policies.remove(obj) }) },
+	}
+
+	go pods.run(ctx)
+	go namespaces.run(ctx)
+	go policies.run(ctx)
+
+	for {
+		interval := resyncInterval
+		if err := c.syncOnce(); err != nil {
+			klog.Warningf("Unexpected error in network policy controller, will retry: %v", err)
+			interval = 10 * time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			err := ctx.Err()
+			klog.Infof("exiting network policy controller: %v", err)
+			return err
+		case <-c.changed:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// mutate applies fn to the stores under the lock, records that the state has changed, and wakes Run to sync it
+func (c *Controller) mutate(fn func()) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	fn()
+	c.version++
+
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// snapshot returns the compiler input, or nil if we have not yet listed everything
+func (c *Controller) snapshot(nodeName string) (*CompilerInput, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.pods.ready || !c.namespaces.ready || !c.policies.ready {
+		return nil, 0
+	}
+
+	in := &CompilerInput{
+		NodeName:   nodeName,
+		Pods:       c.pods.list(),
+		Namespaces: c.namespaces.list(),
+		Policies:   c.policies.list(),
+	}
+	return in, c.version
+}
+
+func (c *Controller) syncOnce() error {
+	me := c.nodeMap.Self()
+	if me == nil {
+		return fmt.Errorf("Cannot find local node")
+	}
+
+	if c.state == nil || c.lastNodeName != me.Name || c.lastVersionCompiled != c.currentVersion() {
+		in, version := c.snapshot(me.Name)
+		if in == nil {
+			klog.Infof("network policy state not yet ready")
+			return nil
+		}
+
+		policies := Compile(in)
+		c.state = BuildNftState(policies, c.interfaceName)
+		c.lastVersionCompiled = version
+		c.lastNodeName = me.Name
+	}
+
+	if err := c.table.Ensure(c.state); err != nil {
+		return fmt.Errorf("error applying network policy: %w", err)
+	}
+	return nil
+}
+
+func (c *Controller) currentVersion() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.version
+}
@@ -0,0 +1,191 @@
+package policy
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	"kope.io/networking/pkg/routing/netutil"
+)
+
+// namePrefix starts the names of all our chains and sets, which share the kopeio table with the masquerade rules
+const namePrefix = "policy-"
+
+// ifNameSize is IFNAMSIZ; interface names are compared as fixed-size, null-padded strings
+const ifNameSize = 16
+
+// BuildNftState renders the compiled policies to the nftables state we enforce.
+// interfaceName is the pod-facing interface (the CNI bridge); traffic to and from isolated pods jumps to a per-pod chain,
+// which returns if any rule matches and drops otherwise.
+func BuildNftState(policies []*PodPolicy, interfaceName string) *netutil.NftState {
+	state := &netutil.NftState{}
+
+	forward := &netutil.NftChain{
+		Name:     namePrefix + "forward",
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	}
+	state.Chains = append(state.Chains, forward)
+
+	// ct state established,related accept
+	forward.Rules = append(forward.Rules, &netutil.NftRule{
+		Exprs: []expr.Any{
+			&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED), Xor: binaryutil.NativeEndian.PutUint32(0)},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	})
+
+	for _, pod := range policies {
+		if pod.Ingress != nil {
+			chainName := namePrefix + "ingress-" + pod.IP.String()
+			// oifname $interface ip daddr $podIP jump policy-ingress-$podIP
+			forward.Rules = append(forward.Rules, &netutil.NftRule{
+				Exprs: []expr.Any{
+					&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(interfaceName)},
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: pod.IP.To4()},
+					&expr.Verdict{Kind: expr.VerdictJump, Chain: chainName},
+				},
+			})
+			buildDirection(state, chainName, pod.Ingress, true)
+		}
+		if pod.Egress != nil {
+			chainName := namePrefix + "egress-" + pod.IP.String()
+			// iifname $interface ip saddr $podIP jump policy-egress-$podIP
+			forward.Rules = append(forward.Rules, &netutil.NftRule{
+				Exprs: []expr.Any{
+					&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(interfaceName)},
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: pod.IP.To4()},
+					&expr.Verdict{Kind: expr.VerdictJump, Chain: chainName},
+				},
+			})
+			buildDirection(state, chainName, pod.Egress, false)
+		}
+	}
+
+	return state
+}
+
+// buildDirection adds the chain (and sets) for one direction of a pod's policy
+func buildDirection(state *netutil.NftState, chainName string, policy *DirectionPolicy, ingress bool) {
+	chain := &netutil.NftChain{
+		Name: chainName,
+	}
+
+	// For ingress we match the source address; for egress the destination
+	var peerOffset uint32 = 12
+	if !ingress {
+		peerOffset = 16
+	}
+
+	for i, rule := range policy.Rules {
+		var match []expr.Any
+		if !rule.AllPeers {
+			if len(rule.Peers) == 0 {
+				// Selects nothing
+				continue
+			}
+
+			var ranges []netutil.IPv4Range
+			for _, peer := range rule.Peers {
+				ranges = append(ranges, netutil.IPv4Range{Start: netutil.IPv4ToUint32(peer.Start), End: netutil.IPv4ToUint32(peer.End)})
+			}
+			set := &netutil.NftSet{
+				Name:     fmt.Sprintf("%s-%d", chainName, i),
+				KeyType:  nftables.TypeIPAddr,
+				Interval: true,
+				Elements: netutil.IPv4RangeSetElements(ranges),
+			}
+			state.Sets = append(state.Sets, set)
+
+			match = append(match,
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: peerOffset, Len: 4},
+				&expr.Lookup{SourceRegister: 1, SetName: set.Name},
+			)
+		}
+
+		if rule.AllPorts {
+			chain.Rules = append(chain.Rules, &netutil.NftRule{
+				Exprs: append(match, &expr.Verdict{Kind: expr.VerdictReturn}),
+			})
+			continue
+		}
+
+		for _, port := range rule.Ports {
+			portMatch, err := buildPortMatch(port)
+			if err != nil {
+				klog.Warningf("ignoring port in policy for %s: %v", chainName, err)
+				continue
+			}
+			exprs := append([]expr.Any{}, match...)
+			exprs = append(exprs, portMatch...)
+			exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictReturn})
+			chain.Rules = append(chain.Rules, &netutil.NftRule{Exprs: exprs})
+		}
+	}
+
+	// Anything not allowed is dropped
+	chain.Rules = append(chain.Rules, &netutil.NftRule{
+		Exprs: []expr.Any{
+			&expr.Counter{},
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		},
+	})
+
+	state.Chains = append(state.Chains, chain)
+}
+
+// buildPortMatch matches the protocol and destination port
+func buildPortMatch(port Port) ([]expr.Any, error) {
+	var proto byte
+	switch port.Protocol {
+	case corev1.ProtocolTCP:
+		proto = unix.IPPROTO_TCP
+	case corev1.ProtocolUDP:
+		proto = unix.IPPROTO_UDP
+	case corev1.ProtocolSCTP:
+		proto = unix.IPPROTO_SCTP
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", port.Protocol)
+	}
+
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	}
+	if port.Port == 0 {
+		return exprs, nil
+	}
+
+	// The destination port is at the same offset for TCP, UDP and SCTP
+	exprs = append(exprs, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2})
+	if port.EndPort != 0 && port.EndPort != port.Port {
+		exprs = append(exprs, &expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: portBytes(port.Port), ToData: portBytes(port.EndPort)})
+	} else {
+		exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: portBytes(port.Port)})
+	}
+	return exprs, nil
+}
+
+func portBytes(port int32) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(port))
+	return b
+}
+
+func ifname(name string) []byte {
+	b := make([]byte, ifNameSize)
+	copy(b, name)
+	return b
+}
@@ -0,0 +1,141 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog/v2"
+)
+
+// objectStore holds the current state of one kind of object, keyed by namespace/name
+type objectStore[T metav1.Object] struct {
+	ready   bool
+	objects map[string]T
+}
+
+func objectKey(obj metav1.Object) string {
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+func (s *objectStore[T]) replaceAll(objects []T) {
+	s.objects = make(map[string]T, len(objects))
+	for _, obj := range objects {
+		s.objects[objectKey(obj)] = obj
+	}
+	s.ready = true
+}
+
+func (s *objectStore[T]) update(obj T) {
+	if s.objects == nil {
+		s.objects = make(map[string]T)
+	}
+	s.objects[objectKey(obj)] = obj
+}
+
+func (s *objectStore[T]) remove(obj T) {
+	delete(s.objects, objectKey(obj))
+}
+
+func (s *objectStore[T]) list() []T {
+	out := make([]T, 0, len(s.objects))
+	for _, obj := range s.objects {
+		out = append(out, obj)
+	}
+	return out
+}
+
+// listWatch describes how to list and watch one kind of object, and where to store the results
+type listWatch[T interface {
+	metav1.Object
+	runtime.Object
+}] struct {
+	kind  string
+	list  func(ctx context.Context, opts metav1.ListOptions) ([]T, string, error)
+	watch func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error)
+
+	replaceAll func(objects []T)
+	update     func(obj T)
+	remove     func(obj T)
+}
+
+// run lists and then watches the objects, restarting the watch on errors, until ctx is cancelled
+func (lw *listWatch[T]) run(ctx context.Context) {
+	runOnce := func() (bool, error) {
+		var listOpts metav1.ListOptions
+		listOpts.AllowWatchBookmarks = true
+
+		objects, resourceVersion, err := lw.list(ctx, listOpts)
+		if err != nil {
+			return false, fmt.Errorf("error listing %s: %w", lw.kind, err)
+		}
+		lw.replaceAll(objects)
+
+		listOpts.Watch = true
+		listOpts.ResourceVersion = resourceVersion
+		klog.Infof("starting %s watch from %s", lw.kind, listOpts.ResourceVersion)
+		watcher, err := lw.watch(ctx, listOpts)
+		if err != nil {
+			return false, fmt.Errorf("error watching %s: %w", lw.kind, err)
+		}
+		defer watcher.Stop()
+
+		ch := watcher.ResultChan()
+		for {
+			select {
+			case <-ctx.Done():
+				return true, ctx.Err()
+			case event, ok := <-ch:
+				if !ok {
+					klog.Infof("%s watch channel closed", lw.kind)
+					return false, nil
+				}
+
+				if event.Type == watch.Error {
+					return false, fmt.Errorf("error from %s watch: %v", lw.kind, event.Object)
+				}
+
+				if event.Type == watch.Bookmark {
+					continue
+				}
+
+				obj, ok := event.Object.(T)
+				if !ok {
+					return false, fmt.Errorf("%s watch object had unexpected type %T", lw.kind, event.Object)
+				}
+				klog.V(4).Infof("%s changed: %s %s", lw.kind, event.Type, objectKey(obj))
+
+				switch event.Type {
+				case watch.Added, watch.Modified:
+					lw.update(obj)
+				case watch.Deleted:
+					lw.remove(obj)
+				default:
+					return false, fmt.Errorf("unexpected type of %s watch event: %v", lw.kind, event.Type)
+				}
+			}
+		}
+	}
+
+	for {
+		stop, err := runOnce()
+		if stop {
+			return
+		}
+
+		retryInterval := time.Duration(0)
+		if err != nil {
+			klog.Warningf("Unexpected error in %s watch, will restart watch: %v", lw.kind, err)
+			retryInterval = 10 * time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
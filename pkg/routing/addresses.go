@@ -0,0 +1,128 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// UnderlayAddressAnnotation can be set on a node to specify the address that other nodes should use to reach it
+const UnderlayAddressAnnotation = "kopeio.io/underlay-address"
+
+// Entries in an address priority list, other than CIDRs
+const (
+	// AddressPriorityAnnotation selects the address in the UnderlayAddressAnnotation
+	AddressPriorityAnnotation = "Annotation"
+	// AddressPriorityInternalIP selects an InternalIP from the node status
+	AddressPriorityInternalIP = "InternalIP"
+	// AddressPriorityExternalIP selects an ExternalIP from the node status
+	AddressPriorityExternalIP = "ExternalIP"
+)
+
+// DefaultAddressPriority is the annotation if set, otherwise the InternalIP, which is what we have always used
+func DefaultAddressPriority() []string {
+	return []string{AddressPriorityAnnotation, AddressPriorityInternalIP}
+}
+
+// AddressSelector chooses the underlay address of a node, trying each rule in order until one yields an address
+type AddressSelector struct {
+	rules []addressRule
+}
+
+// addressRule is one entry of the priority list; exactly one of annotation, addressType or cidr is set
+type addressRule struct {
+	annotation  bool
+	addressType corev1.NodeAddressType
+	cidr        *net.IPNet
+}
+
+// ParseAddressSelector builds an AddressSelector from a priority list.
+// Each entry is Annotation, InternalIP, ExternalIP or a CIDR, which matches any node address within it.
+// An empty list gives the DefaultAddressPriority.
+func ParseAddressSelector(priority []string) (*AddressSelector, error) {
+	if len(priority) == 0 {
+		priority = DefaultAddressPriority()
+	}
+
+	s := &AddressSelector{}
+	var errs []error
+	for _, entry := range priority {
+		entry = strings.TrimSpace(entry)
+		switch entry {
+		case AddressPriorityAnnotation:
+			s.rules = append(s.rules, addressRule{annotation: true})
+		case AddressPriorityInternalIP:
+			s.rules = append(s.rules, addressRule{addressType: corev1.NodeInternalIP})
+		case AddressPriorityExternalIP:
+			s.rules = append(s.rules, addressRule{addressType: corev1.NodeExternalIP})
+		default:
+			_, cidr, err := net.ParseCIDR(entry)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unknown address priority %q; expected %s, %s, %s or a CIDR", entry, AddressPriorityAnnotation, AddressPriorityInternalIP, AddressPriorityExternalIP))
+				continue
+			}
+			s.rules = append(s.rules, addressRule{cidr: cidr})
+		}
+	}
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+	return s, nil
+}
+
+// Select returns the underlay address of node, or nil if no rule yields one
+func (s *AddressSelector) Select(node *corev1.Node) net.IP {
+	for _, rule := range s.rules {
+		if ip := rule.selectAddress(node); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+func (r *addressRule) selectAddress(node *corev1.Node) net.IP {
+	if r.annotation {
+		value := node.Annotations[UnderlayAddressAnnotation]
+		if value == "" {
+			return nil
+		}
+		ip := net.ParseIP(strings.TrimSpace(value))
+		if ip == nil {
+			klog.Warningf("Unable to parse %s annotation %q on node %q", UnderlayAddressAnnotation, value, node.Name)
+		}
+		return ip
+	}
+
+	var candidates []string
+	for i := range node.Status.Addresses {
+		address := &node.Status.Addresses[i]
+		if r.addressType != "" && address.Type != r.addressType {
+			continue
+		}
+		ip := net.ParseIP(address.Address)
+		if ip == nil {
+			if address.Type == corev1.NodeInternalIP || address.Type == corev1.NodeExternalIP {
+				klog.Warningf("Unable to parse node address %q", address.Address)
+			}
+			continue
+		}
+		if r.cidr != nil && !r.cidr.Contains(ip) {
+			continue
+		}
+		candidates = append(candidates, address.Address)
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+	if len(candidates) != 1 {
+		klog.Infof("arbitrarily choosing IP for node: %q", node.Name)
+		sort.Strings(candidates) // At least choose consistently
+	}
+	return net.ParseIP(candidates[0])
+}
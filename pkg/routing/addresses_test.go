@@ -0,0 +1,84 @@
+package routing
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAddressSelector(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeHostName, Address: "node1"},
+				{Type: corev1.NodeInternalIP, Address: "10.0.0.5"},
+				{Type: corev1.NodeInternalIP, Address: "192.168.10.5"},
+				{Type: corev1.NodeExternalIP, Address: "203.0.113.5"},
+			},
+		},
+	}
+	annotated := node.DeepCopy()
+	annotated.Annotations = map[string]string{UnderlayAddressAnnotation: "198.51.100.5"}
+
+	grid := []struct {
+		priority []string
+		node     *corev1.Node
+		expected string
+	}{
+		// The default is the lexically smallest InternalIP, unless the annotation is set
+		{priority: nil, node: node, expected: "10.0.0.5"},
+		{priority: nil, node: annotated, expected: "198.51.100.5"},
+		{priority: []string{"ExternalIP", "InternalIP"}, node: annotated, expected: "203.0.113.5"},
+		{priority: []string{"192.168.0.0/16", "InternalIP"}, node: node, expected: "192.168.10.5"},
+		{priority: []string{"172.16.0.0/12", "InternalIP"}, node: node, expected: "10.0.0.5"},
+		{priority: []string{"172.16.0.0/12"}, node: node, expected: "<nil>"},
+	}
+	for _, g := range grid {
+		s, err := ParseAddressSelector(g.priority)
+		if err != nil {
+			t.Fatalf("error parsing %v: %v", g.priority, err)
+		}
+		actual := s.Select(g.node)
+		if actual.String() != g.expected {
+			t.Errorf("priority %v: got %s, expected %s", g.priority, actual, g.expected)
+		}
+	}
+}
+
+func TestParseAddressSelectorErrors(t *testing.T) {
+	_, err := ParseAddressSelector([]string{"InternalIP", "Hostname", "10.0.0.0/33"})
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	for _, s := range []string{`"Hostname"`, `"10.0.0.0/33"`} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected error to mention %s, got %v", s, err)
+		}
+	}
+}
+
+func TestNodeMapUsesAddressSelector(t *testing.T) {
+	s, err := ParseAddressSelector([]string{"ExternalIP"})
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	m := NewNodeMap(func(node *corev1.Node) bool { return node.Name == "node1" }, s)
+	m.UpdateNode(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeInternalIP, Address: "10.0.0.5"},
+				{Type: corev1.NodeExternalIP, Address: "203.0.113.5"},
+			},
+		},
+	})
+	m.MarkReady()
+
+	me, _, _ := m.Snapshot()
+	if me.Address.String() != "203.0.113.5" {
+		t.Errorf("unexpected address %s", me.Address)
+	}
+}
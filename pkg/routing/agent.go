@@ -0,0 +1,67 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// AgentAnnotation is set by the agent on its own node to a JSON AgentInfo, describing what the agent is running.
+// Peers use it to decide how to reach the node, and it shows at a glance what each node is doing.
+const AgentAnnotation = "kopeio.io/agent"
+
+// AgentInfo is what an agent advertises about itself in the AgentAnnotation
+type AgentInfo struct {
+	// Version is the version of the agent
+	Version string `json:"version,omitempty"`
+
+	// Providers are the routing providers the agent is running; during a migration there are two, the new provider first
+	Providers []string `json:"providers,omitempty"`
+
+	// Encapsulations are the encapsulations on which the node accepts traffic from peers
+	Encapsulations []Encapsulation `json:"encapsulations,omitempty"`
+
+	// TunnelEndpoint is the address to which peers send encapsulated traffic: the TunnelEndpointAnnotation if set,
+	// otherwise the node's underlay address
+	TunnelEndpoint string `json:"tunnelEndpoint,omitempty"`
+
+	// PublicKeys are the public keys that peers need to reach the node, by provider.
+	// None of the current providers use per-node keys, so this is empty for now.
+	PublicKeys map[string]string `json:"publicKeys,omitempty"`
+
+	// MTU is the MTU of the overlay, if the provider sets one
+	MTU int `json:"mtu,omitempty"`
+}
+
+// Encapsulation describes one way of sending traffic to a node
+type Encapsulation struct {
+	// Type is vxlan, gre, esp or esp-in-udp
+	Type string `json:"type"`
+
+	// Port is the UDP port, for UDP encapsulations
+	Port int `json:"port,omitempty"`
+
+	// VNI is the vxlan network identifier, for vxlan
+	VNI int `json:"vni,omitempty"`
+}
+
+// ParseAgentInfo parses the value of the AgentAnnotation
+func ParseAgentInfo(s string) (*AgentInfo, error) {
+	info := &AgentInfo{}
+	if err := json.Unmarshal([]byte(s), info); err != nil {
+		return nil, fmt.Errorf("error parsing %s annotation: %w", AgentAnnotation, err)
+	}
+	return info, nil
+}
+
+// SupportsProvider is true if the node advertises that it runs the named provider
+func (n *NodeInfo) SupportsProvider(name string) bool {
+	if n.Agent == nil {
+		return false
+	}
+	for _, p := range n.Agent.Providers {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
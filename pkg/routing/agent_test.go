@@ -0,0 +1,50 @@
+package routing
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAgentAnnotation(t *testing.T) {
+	m := NewNodeMap(func(node *corev1.Node) bool { return node.Name == "node1" }, nil)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "node2",
+			Annotations: map[string]string{
+				AgentAnnotation: `{"version":"1.2.0","providers":["vxlan"],"encapsulations":[{"type":"vxlan","port":4789,"vni":1}],"tunnelEndpoint":"10.0.0.5","mtu":1450}`,
+			},
+		},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.5"}},
+		},
+	}
+	m.UpdateNode(node)
+	m.MarkReady()
+
+	_, nodes, _ := m.Snapshot()
+	expected := &AgentInfo{
+		Version:        "1.2.0",
+		Providers:      []string{"vxlan"},
+		Encapsulations: []Encapsulation{{Type: "vxlan", Port: 4789, VNI: 1}},
+		TunnelEndpoint: "10.0.0.5",
+		MTU:            1450,
+	}
+	if !reflect.DeepEqual(nodes[0].Agent, expected) {
+		t.Errorf("unexpected agent info: %+v", nodes[0].Agent)
+	}
+	if !nodes[0].SupportsProvider("vxlan") || nodes[0].SupportsProvider("ipsec") {
+		t.Errorf("unexpected SupportsProvider results for %v", nodes[0].Agent.Providers)
+	}
+
+	node.Annotations[AgentAnnotation] = "{not json"
+	if !m.UpdateNode(node) {
+		t.Errorf("expected an invalid annotation to change the node")
+	}
+	_, nodes, _ = m.Snapshot()
+	if nodes[0].Agent != nil || nodes[0].SupportsProvider("vxlan") {
+		t.Errorf("expected an invalid annotation to be ignored, got %+v", nodes[0].Agent)
+	}
+}
@@ -0,0 +1,131 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+// Reasons we set on the NetworkUnavailable condition of our node, and on the events we publish
+const (
+	// ReasonRouteCreated means the network is configured; it is the reason used by the kubernetes route controller
+	ReasonRouteCreated = "RouteCreated"
+	// ReasonNoPodCIDR means the node has not been allocated a PodCIDR
+	ReasonNoPodCIDR = "NoPodCIDR"
+	// ReasonNoAddress means we could not select an address for the node
+	ReasonNoAddress = "NoAddress"
+	// ReasonProviderError means the routing provider failed to configure the network
+	ReasonProviderError = "ProviderError"
+	// ReasonCNIConfigWriteFailed means we could not write the CNI configuration
+	ReasonCNIConfigWriteFailed = "CNIConfigWriteFailed"
+	// ReasonMasqueradeFailed means we could not configure masquerade
+	ReasonMasqueradeFailed = "MasqueradeFailed"
+)
+
+// unavailableAfter is how long reconciliation must have been failing before we mark a node that was working as network-unavailable,
+// so that transient errors do not make the node flap.
+const unavailableAfter = 30 * time.Second
+
+// eventComponent is the source of the events we publish
+const eventComponent = "kopeio-networking-agent"
+
+// networkError is a reconcile failure, with the reason we report on the NetworkUnavailable condition
+type networkError struct {
+	reason string
+	err    error
+}
+
+func (e *networkError) Error() string {
+	return e.err.Error()
+}
+
+func (e *networkError) Unwrap() error {
+	return e.err
+}
+
+// newEventRecorder builds a recorder that publishes events through kubeClient
+func newEventRecorder(kubeClient kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+}
+
+// reportNetworkCondition sets the NetworkUnavailable condition on our node to reflect the result of the last reconcile,
+// publishing an event on the node when the condition changes.
+// Every agent reports only on its own node, so no leader election is needed.
+func (c *Controller) reportNetworkCondition(ctx context.Context, reconcileErr error) {
+	me := c.nodeMap.Self()
+	if me == nil {
+		return
+	}
+
+	now := time.Now()
+	condition := corev1.NodeCondition{
+		Type:    corev1.NodeNetworkUnavailable,
+		Status:  corev1.ConditionFalse,
+		Reason:  ReasonRouteCreated,
+		Message: "kope.io network controller initialized node routes",
+	}
+	if reconcileErr == nil {
+		c.lastReconciled = now
+	} else {
+		if !c.lastReconciled.IsZero() && now.Sub(c.lastReconciled) < unavailableAfter {
+			return
+		}
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = ReasonProviderError
+		var networkErr *networkError
+		if errors.As(reconcileErr, &networkErr) {
+			condition.Reason = networkErr.reason
+		}
+		condition.Message = reconcileErr.Error()
+	}
+
+	available := condition.Status == corev1.ConditionFalse
+	if me.NetworkAvailable == available && me.NetworkReason == condition.Reason {
+		return
+	}
+
+	key := string(condition.Status) + "/" + condition.Reason
+	if key == c.lastCondition && now.Sub(c.lastConditionAttempt) < advertiseRetryInterval {
+		// Wait for the watch to catch up with our last update
+		return
+	}
+	changed := key != c.lastCondition
+	c.lastCondition = key
+	c.lastConditionAttempt = now
+
+	if me.NetworkAvailable != available || me.NetworkReason == "" {
+		condition.LastTransitionTime = metav1.NewTime(now)
+	}
+
+	if changed {
+		// The kubelet uses the node name as the UID of node references, so events are grouped with its own
+		ref := &corev1.ObjectReference{Kind: "Node", Name: me.Name, UID: types.UID(me.Name)}
+		if available {
+			c.recorder.Event(ref, corev1.EventTypeNormal, condition.Reason, condition.Message)
+		} else {
+			c.recorder.Event(ref, corev1.EventTypeWarning, condition.Reason, condition.Message)
+		}
+	}
+
+	if available {
+		klog.Infof("marking node %q as network-ready in node status", me.Name)
+	} else {
+		klog.Warningf("marking node %q as network-unavailable in node status: %s", me.Name, condition.Reason)
+	}
+	if err := setNodeCondition(ctx, c.kubeClient, me.Name, condition); err != nil {
+		klog.Errorf("Error updating node %s, will retry: %v", me.Name, err)
+		// Retry on the next loop, without publishing the event again
+		c.lastConditionAttempt = time.Time{}
+	}
+}
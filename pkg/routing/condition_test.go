@@ -0,0 +1,85 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestReportNetworkCondition(t *testing.T) {
+	ctx := context.Background()
+	node := migrationTestNode("node1")
+	node.Spec.PodCIDR = ""
+	kubeClient := fake.NewSimpleClientset(node)
+
+	m := NewNodeMap(func(node *corev1.Node) bool { return node.Name == "node1" }, nil)
+	m.UpdateNode(node)
+	m.MarkReady()
+
+	provider := &fakeProvider{}
+	c, err := NewController(kubeClient, m, "fake", provider, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+
+	// reconcile reports the condition, and then picks up the change as the watch would
+	reconcile := func() *corev1.NodeCondition {
+		c.reportNetworkCondition(ctx, c.reconcile())
+		node, err := kubeClient.CoreV1().Nodes().Get(ctx, "node1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		m.UpdateNode(node)
+		for i := range node.Status.Conditions {
+			if node.Status.Conditions[i].Type == corev1.NodeNetworkUnavailable {
+				return &node.Status.Conditions[i]
+			}
+		}
+		return nil
+	}
+
+	condition := reconcile()
+	if condition == nil || condition.Status != corev1.ConditionTrue || condition.Reason != ReasonNoPodCIDR {
+		t.Fatalf("expected network-unavailable with reason %s, got %+v", ReasonNoPodCIDR, condition)
+	}
+	if event := <-recorder.Events; event != "Warning NoPodCIDR node \"node1\" has no PodCIDR" {
+		t.Errorf("unexpected event %q", event)
+	}
+
+	node.Spec.PodCIDR = "100.96.0.0/24"
+	node.Status.Conditions = []corev1.NodeCondition{*condition}
+	if _, err := kubeClient.CoreV1().Nodes().Update(ctx, node, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m.UpdateNode(node)
+
+	condition = reconcile()
+	if condition == nil || condition.Status != corev1.ConditionFalse || condition.Reason != ReasonRouteCreated {
+		t.Fatalf("expected network-available, got %+v", condition)
+	}
+	if condition.LastTransitionTime.IsZero() {
+		t.Errorf("expected transition time to be set")
+	}
+	<-recorder.Events
+
+	// Transient failures do not flap the condition
+	provider.err = fmt.Errorf("injected failure")
+	if condition := reconcile(); condition.Status != corev1.ConditionFalse {
+		t.Errorf("expected a transient failure to be ignored, got %+v", condition)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("unexpected event %q", <-recorder.Events)
+	}
+
+	c.lastReconciled = c.lastReconciled.Add(-unavailableAfter)
+	if condition := reconcile(); condition.Status != corev1.ConditionTrue || condition.Reason != ReasonProviderError {
+		t.Errorf("expected network-unavailable with reason %s, got %+v", ReasonProviderError, condition)
+	}
+}
@@ -0,0 +1,70 @@
+package routing
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TunnelEndpointAnnotation can be set on a node behind NAT to the public IP (and optionally port) at which
+// other nodes reach its tunnel, e.g. "203.0.113.5:30001" or "203.0.113.5".
+// It overrides the underlay address as the destination of encapsulated traffic, but not the address used inside the tunnel.
+const TunnelEndpointAnnotation = "kopeio.io/tunnel-endpoint"
+
+// Endpoint is the public address of a node's tunnel
+type Endpoint struct {
+	IP net.IP
+	// Port is the UDP port; zero means the provider's usual port
+	Port int
+}
+
+func (e *Endpoint) String() string {
+	if e.Port == 0 {
+		return e.IP.String()
+	}
+	return net.JoinHostPort(e.IP.String(), strconv.Itoa(e.Port))
+}
+
+// ParseEndpoint parses "ip", "ip:port" or "[ipv6]:port"
+func ParseEndpoint(s string) (*Endpoint, error) {
+	s = strings.TrimSpace(s)
+
+	if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil {
+		return &Endpoint{IP: ip}, nil
+	}
+
+	host, portString, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %w", s, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %q is not an IP address", s, host)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid endpoint %q: port must be between 1 and 65535", s)
+	}
+	return &Endpoint{IP: ip, Port: port}, nil
+}
+
+func endpointEqual(a, e *Endpoint) bool {
+	if a == nil || e == nil {
+		return a == e
+	}
+	return a.IP.Equal(e.IP) && a.Port == e.Port
+}
+
+// TunnelEndpoint returns the address and port to which we send encapsulated traffic for the node:
+// the TunnelEndpointAnnotation if set, otherwise the node's Address and defaultPort
+func (n *NodeInfo) TunnelEndpoint(defaultPort int) (net.IP, int) {
+	if n.Endpoint == nil {
+		return n.Address, defaultPort
+	}
+	port := n.Endpoint.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	return n.Endpoint.IP, port
+}
@@ -0,0 +1,81 @@
+package routing
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	grid := []struct {
+		input    string
+		expected string
+		err      bool
+	}{
+		{input: "203.0.113.5", expected: "203.0.113.5"},
+		{input: "203.0.113.5:30001", expected: "203.0.113.5:30001"},
+		{input: "[2001:db8::5]:30001", expected: "[2001:db8::5]:30001"},
+		{input: "2001:db8::5", expected: "2001:db8::5"},
+		{input: "203.0.113.5:0", err: true},
+		{input: "203.0.113.5:http", err: true},
+		{input: "example.com:4789", err: true},
+	}
+	for _, g := range grid {
+		e, err := ParseEndpoint(g.input)
+		if g.err {
+			if err == nil {
+				t.Errorf("expected error parsing %q, got %s", g.input, e)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("error parsing %q: %v", g.input, err)
+			continue
+		}
+		if e.String() != g.expected {
+			t.Errorf("parsing %q: got %s, expected %s", g.input, e, g.expected)
+		}
+	}
+}
+
+func TestTunnelEndpoint(t *testing.T) {
+	m := NewNodeMap(func(node *corev1.Node) bool { return node.Name == "node1" }, nil)
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node2"},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.5"}},
+		},
+	}
+	m.UpdateNode(node)
+	m.MarkReady()
+
+	tunnelEndpoint := func() string {
+		_, nodes, _ := m.Snapshot()
+		ip, port := nodes[0].TunnelEndpoint(4789)
+		return (&Endpoint{IP: ip, Port: port}).String()
+	}
+
+	if actual := tunnelEndpoint(); actual != "10.0.0.5:4789" {
+		t.Errorf("unexpected endpoint without annotation: %s", actual)
+	}
+
+	node.Annotations = map[string]string{TunnelEndpointAnnotation: "203.0.113.5"}
+	if !m.UpdateNode(node) {
+		t.Errorf("adding annotation was not a change")
+	}
+	if actual := tunnelEndpoint(); actual != "203.0.113.5:4789" {
+		t.Errorf("unexpected endpoint with IP annotation: %s", actual)
+	}
+
+	node.Annotations[TunnelEndpointAnnotation] = "203.0.113.5:30001"
+	if !m.UpdateNode(node) {
+		t.Errorf("changing port was not a change")
+	}
+	if actual := tunnelEndpoint(); actual != "203.0.113.5:30001" {
+		t.Errorf("unexpected endpoint with IP:port annotation: %s", actual)
+	}
+	if m.UpdateNode(node) {
+		t.Errorf("unchanged annotation was a change")
+	}
+}
@@ -22,14 +22,23 @@ const greLinkNameMaxLength = 15
 type GreRoutingProvider struct {
 	lastVersionApplied uint64
 
+	// mtuProber is optional; if set we lower the MTU of tunnels to peers with a smaller path MTU
+	mtuProber            *netutil.PathMTUProber
+	lastMTUProberVersion uint64
+
 	routeTable *netutil.RouteTable
 	links      *netutil.Links
 }
 
 var _ routing.Provider = &GreRoutingProvider{}
+var _ routing.AgentDescriber = &GreRoutingProvider{}
+var _ routing.EnvironmentConfigurable = &GreRoutingProvider{}
 
-func NewGreRoutingProvider() (*GreRoutingProvider, error) {
+// NewGreRoutingProvider builds a GreRoutingProvider.
+// mtuProber is optional; if nil we don't probe the path MTU to peers.
+func NewGreRoutingProvider(mtuProber *netutil.PathMTUProber) (*GreRoutingProvider, error) {
 	p := &GreRoutingProvider{
+		mtuProber:  mtuProber,
 		routeTable: &netutil.RouteTable{},
 		links:      &netutil.Links{},
 	}
@@ -37,10 +46,40 @@ func NewGreRoutingProvider() (*GreRoutingProvider, error) {
 	return p, nil
 }
 
+// DescribeAgent advertises GRE; the MTU is set per tunnel, so we don't advertise one
+func (p *GreRoutingProvider) DescribeAgent(info *routing.AgentInfo) {
+	info.Encapsulations = append(info.Encapsulations, routing.Encapsulation{Type: "gre"})
+}
+
+// SetEnvironment changes the path MTU prober; we don't use the target links, as the kernel routes our tunnels
+func (p *GreRoutingProvider) SetEnvironment(env *routing.ProviderEnvironment) error {
+	p.mtuProber = env.MTUProber
+	p.lastVersionApplied = 0
+	return nil
+}
+
 func (p *GreRoutingProvider) Close() error {
 	return nil
 }
 
+// Teardown removes our GRE tunnels, and with them the routes via them
+func (p *GreRoutingProvider) Teardown() error {
+	if err := Cleanup(); err != nil {
+		return err
+	}
+	p.lastVersionApplied = 0
+	return nil
+}
+
+// Cleanup removes all GRE tunnels we could have created, without needing a provider
+func Cleanup() error {
+	links := &netutil.Links{}
+	if _, err := links.Ensure(nil, greLinkNamePrefix); err != nil {
+		return fmt.Errorf("error removing tunnels: %w", err)
+	}
+	return nil
+}
+
 func buildTunnelName(ip net.IP) string {
 	ip4 := ip.To4()
 	if ip4 == nil {
@@ -55,8 +94,27 @@ func buildTunnelName(ip net.IP) string {
 	return name
 }
 
+// tunnelMTU returns the MTU for the tunnel to remote, or 0 to let the kernel choose
+func (p *GreRoutingProvider) tunnelMTU(remote net.IP) int {
+	mtu, err := netutil.UnderlayMTU(remote)
+	if err != nil {
+		klog.Warningf("unable to determine underlay MTU to %s: %v", remote, err)
+		return 0
+	}
+	if p.mtuProber != nil {
+		if pathMTU, ok := p.mtuProber.PathMTU(remote, mtu); ok && pathMTU < mtu {
+			mtu = pathMTU
+		}
+	}
+	return mtu - netutil.GreOverhead
+}
+
 func (p *GreRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
-	if p.lastVersionApplied != 0 && nodeMap.IsVersion(p.lastVersionApplied) {
+	var mtuProberVersion uint64
+	if p.mtuProber != nil {
+		mtuProberVersion = p.mtuProber.Version()
+	}
+	if p.lastVersionApplied != 0 && nodeMap.IsVersion(p.lastVersionApplied) && mtuProberVersion == p.lastMTUProberVersion {
 		return nil
 	}
 
@@ -95,6 +153,7 @@ func (p *GreRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 			t := &netlink.Gretun{
 				LinkAttrs: netlink.LinkAttrs{
 					Name: tunnelName,
+					MTU:  p.tunnelMTU(remote.Address),
 				},
 				Local:  me.Address,
 				Remote: remote.Address,
@@ -122,8 +181,6 @@ func (p *GreRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 		}
 	}
 
-	// TODO: Set MTU?
-
 	var routes []*netlink.Route
 
 	for i := range allNodes {
@@ -158,7 +215,7 @@ func (p *GreRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 			r := &netlink.Route{
 				LinkIndex: tunnel.Attrs().Index,
 				Dst:       remote.PodCIDR,
-				Protocol:  syscall.RTPROT_BOOT,
+				Protocol:  netutil.RouteProtocol,
 				Table:     syscall.RT_TABLE_MAIN,
 				Type:      syscall.RTN_UNICAST,
 			}
@@ -166,12 +223,15 @@ func (p *GreRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 		}
 	}
 
-	err = p.routeTable.Ensure(nil, routes, false)
+	// Only routes with our protocol are removed, so this cleans up routes to nodes that have gone away
+	deleteExtraRoutes := true
+	err = p.routeTable.Ensure(nil, routes, deleteExtraRoutes)
 	if err != nil {
 		return fmt.Errorf("error applying route table: %v", err)
 	}
 
 	p.lastVersionApplied = version
+	p.lastMTUProberVersion = mtuProberVersion
 
 	return nil
 }
@@ -0,0 +1,18 @@
+package gre
+
+import (
+	"kope.io/networking/pkg/routing"
+)
+
+func init() {
+	routing.RegisterProvider(routing.ProviderFactory[struct{}]{
+		Name: "gre",
+		New: func(_ *struct{}, env *routing.ProviderEnvironment) (routing.Provider, error) {
+			return NewGreRoutingProvider(env.MTUProber)
+		},
+		// Routes via the tunnels are removed with them
+		Cleanup: func(_ *struct{}) error {
+			return Cleanup()
+		},
+	})
+}
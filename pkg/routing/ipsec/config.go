@@ -0,0 +1,61 @@
+package ipsec
+
+import (
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Valid values of the fields of Config
+var (
+	Authentications = []string{"sha1", "none"}
+	Encryptions     = []string{"aes", "none"}
+	Encapsulations  = []string{"udp", "esp"}
+)
+
+// Config is the ipsec section of the agent configuration
+type Config struct {
+	// Authentication is sha1 (the default) or none
+	Authentication string `json:"authentication,omitempty"`
+
+	// Encryption is aes (the default) or none
+	Encryption string `json:"encryption,omitempty"`
+
+	// Encapsulation is udp (the default) or esp
+	Encapsulation string `json:"encapsulation,omitempty"`
+}
+
+// SetDefaults fills in the fields of c that are not set
+func (c *Config) SetDefaults() {
+	if c.Authentication == "" {
+		c.Authentication = "sha1"
+	}
+	if c.Encryption == "" {
+		c.Encryption = "aes"
+	}
+	if c.Encapsulation == "" {
+		c.Encapsulation = "udp"
+	}
+}
+
+// Validate checks a defaulted configuration, whose path is fldPath
+func (c *Config) Validate(fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if !contains(Authentications, c.Authentication) {
+		errs = append(errs, field.NotSupported(fldPath.Child("authentication"), c.Authentication, Authentications))
+	}
+	if !contains(Encryptions, c.Encryption) {
+		errs = append(errs, field.NotSupported(fldPath.Child("encryption"), c.Encryption, Encryptions))
+	}
+	if !contains(Encapsulations, c.Encapsulation) {
+		errs = append(errs, field.NotSupported(fldPath.Child("encapsulation"), c.Encapsulation, Encapsulations))
+	}
+	return errs
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
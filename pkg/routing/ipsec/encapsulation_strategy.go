@@ -1,14 +1,19 @@
 package ipsec
 
 import (
-	"net"
-
 	"github.com/vishvananda/netlink"
 	"kope.io/networking/pkg/routing"
 )
 
+// udpEncapPort is the port on which we listen for ESP-in-UDP, and to which we send it unless a node has a tunnel endpoint
+const udpEncapPort = 4500
+
 type EncapsulationStrategy interface {
-	Apply(s *netlink.XfrmState, src *routing.NodeInfo, dest *routing.NodeInfo)
+	// Apply sets the encapsulation of s, a state for traffic between me and remote in direction dir
+	Apply(s *netlink.XfrmState, me *routing.NodeInfo, remote *routing.NodeInfo, dir netlink.Dir)
+
+	// Encapsulation describes the encapsulation, for the AgentAnnotation
+	Encapsulation() routing.Encapsulation
 }
 
 type UdpEncapsulationStrategy struct {
@@ -16,19 +21,36 @@ type UdpEncapsulationStrategy struct {
 
 var _ EncapsulationStrategy = &UdpEncapsulationStrategy{}
 
-func (e *UdpEncapsulationStrategy) Apply(s *netlink.XfrmState, src *routing.NodeInfo, dest *routing.NodeInfo) {
+func (e *UdpEncapsulationStrategy) Apply(s *netlink.XfrmState, me *routing.NodeInfo, remote *routing.NodeInfo, dir netlink.Dir) {
+	// A remote behind NAT sends from, and receives on, its public port; we always use our own port locally
+	_, remotePort := remote.TunnelEndpoint(udpEncapPort)
+
 	s.Encap = &netlink.XfrmStateEncap{
-		Type:            netlink.XFRM_ENCAP_ESPINUDP,
-		SrcPort:         4500,
-		DstPort:         4500,
-		OriginalAddress: net.IPv4(0, 0, 0, 0),
+		Type: netlink.XFRM_ENCAP_ESPINUDP,
+		// The address of the remote before NAT
+		OriginalAddress: remote.Address,
+	}
+	if dir == netlink.XFRM_DIR_OUT {
+		s.Encap.SrcPort = udpEncapPort
+		s.Encap.DstPort = remotePort
+	} else {
+		s.Encap.SrcPort = remotePort
+		s.Encap.DstPort = udpEncapPort
 	}
 }
 
+func (e *UdpEncapsulationStrategy) Encapsulation() routing.Encapsulation {
+	return routing.Encapsulation{Type: "esp-in-udp", Port: udpEncapPort}
+}
+
 type EspEncapsulationStrategy struct {
 }
 
 var _ EncapsulationStrategy = &EspEncapsulationStrategy{}
 
-func (e *EspEncapsulationStrategy) Apply(s *netlink.XfrmState, src *routing.NodeInfo, dest *routing.NodeInfo) {
+func (e *EspEncapsulationStrategy) Apply(s *netlink.XfrmState, me *routing.NodeInfo, remote *routing.NodeInfo, dir netlink.Dir) {
+}
+
+func (e *EspEncapsulationStrategy) Encapsulation() routing.Encapsulation {
+	return routing.Encapsulation{Type: "esp"}
 }
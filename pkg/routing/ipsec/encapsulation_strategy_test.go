@@ -0,0 +1,42 @@
+package ipsec
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"kope.io/networking/pkg/routing"
+)
+
+func TestUdpEncapsulationStrategy(t *testing.T) {
+	me := &routing.NodeInfo{Name: "me", Address: net.ParseIP("10.0.0.1")}
+	remote := &routing.NodeInfo{
+		Name:     "remote",
+		Address:  net.ParseIP("192.168.1.5"),
+		Endpoint: &routing.Endpoint{IP: net.ParseIP("203.0.113.5"), Port: 30001},
+	}
+
+	e := &UdpEncapsulationStrategy{}
+
+	out := &netlink.XfrmState{}
+	e.Apply(out, me, remote, netlink.XFRM_DIR_OUT)
+	if out.Encap.SrcPort != 4500 || out.Encap.DstPort != 30001 {
+		t.Errorf("unexpected outbound ports %d -> %d", out.Encap.SrcPort, out.Encap.DstPort)
+	}
+	if !out.Encap.OriginalAddress.Equal(remote.Address) {
+		t.Errorf("unexpected original address %s", out.Encap.OriginalAddress)
+	}
+
+	in := &netlink.XfrmState{}
+	e.Apply(in, me, remote, netlink.XFRM_DIR_IN)
+	if in.Encap.SrcPort != 30001 || in.Encap.DstPort != 4500 {
+		t.Errorf("unexpected inbound ports %d -> %d", in.Encap.SrcPort, in.Encap.DstPort)
+	}
+
+	// Without an endpoint, both sides use the usual port
+	remote.Endpoint = nil
+	e.Apply(out, me, remote, netlink.XFRM_DIR_OUT)
+	if out.Encap.SrcPort != 4500 || out.Encap.DstPort != 4500 {
+		t.Errorf("unexpected ports %d -> %d", out.Encap.SrcPort, out.Encap.DstPort)
+	}
+}
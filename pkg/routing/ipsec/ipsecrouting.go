@@ -41,6 +41,7 @@ type IpsecRoutingProvider struct {
 	encryptionStrategy     EncryptionStrategy
 	encapsulationStrategy  EncapsulationStrategy
 
+	// udpEncapListener is opened by start, on the first call to EnsureCIDRs; nil until then
 	udpEncapListener *UDPEncapListener
 
 	xfrmPolicyTable *netutil.XfrmPolicyTable
@@ -50,13 +51,12 @@ type IpsecRoutingProvider struct {
 }
 
 var _ routing.Provider = &IpsecRoutingProvider{}
+var _ routing.AgentDescriber = &IpsecRoutingProvider{}
+var _ routing.EnvironmentConfigurable = &IpsecRoutingProvider{}
 
+// NewIpsecRoutingProvider builds an IpsecRoutingProvider.
+// It does not change the node until the first call to EnsureCIDRs, so it can be built while the provider it replaces is running.
 func NewIpsecRoutingProvider(authenticationStrategy AuthenticationStrategy, encryptionStrategy EncryptionStrategy, encapsulationStrategy EncapsulationStrategy) (*IpsecRoutingProvider, error) {
-	err := doModprobe()
-	if err != nil {
-		return nil, err
-	}
-
 	p := &IpsecRoutingProvider{
 		authenticationStrategy: authenticationStrategy,
 		encryptionStrategy:     encryptionStrategy,
@@ -65,15 +65,32 @@ func NewIpsecRoutingProvider(authenticationStrategy AuthenticationStrategy, encr
 		xfrmPolicyTable: &netutil.XfrmPolicyTable{},
 		xfrmStateTable:  &netutil.XfrmStateTable{},
 	}
+	return p, nil
+}
+
+// start loads the kernel modules we need, removes any xfrm policies and state, and opens the UDP encapsulation listener.
+// The previous provider has been torn down by the time we are first asked to EnsureCIDRs, so the port is free
+// and we do not flush state that is still in use.
+func (p *IpsecRoutingProvider) start() error {
+	if err := doModprobe(); err != nil {
+		return err
+	}
+
+	// TODO: This is only because state update is not working
+	klog.Warningf("TODO Doing ip xfrm flush; remove!!")
+	if err := p.Flush(); err != nil {
+		return fmt.Errorf("cannot flush tables: %w", err)
+	}
 
 	// TODO: Refactor into encapsulationStrategy
-	port := 4500
+	port := udpEncapPort
 	klog.Infof("Creating encap listener on port %d", port)
-	p.udpEncapListener, err = NewUDPEncapListener(port)
+	listener, err := NewUDPEncapListener(port)
 	if err != nil {
-		return nil, fmt.Errorf("error creating UDP encapsulation listener on port %d: %v", port, err)
+		return fmt.Errorf("error creating UDP encapsulation listener on port %d: %v", port, err)
 	}
-	return p, nil
+	p.udpEncapListener = listener
+	return nil
 }
 
 func (p *IpsecRoutingProvider) Flush() error {
@@ -88,6 +105,37 @@ func (p *IpsecRoutingProvider) Flush() error {
 	return nil
 }
 
+// Teardown removes all xfrm policies and state, as we do on startup, and closes the UDP encapsulation listener
+func (p *IpsecRoutingProvider) Teardown() error {
+	if err := Cleanup(); err != nil {
+		return err
+	}
+	p.lastVersionApplied = 0
+	return p.Close()
+}
+
+// Cleanup removes all xfrm policies and state, without needing a provider.
+// Note that this includes any installed by other software.
+func Cleanup() error {
+	if err := (&netutil.XfrmPolicyTable{}).Flush(); err != nil {
+		return fmt.Errorf("error flushing xfrm policies: %w", err)
+	}
+	if err := (&netutil.XfrmStateTable{}).Flush(); err != nil {
+		return fmt.Errorf("error flushing xfrm state: %w", err)
+	}
+	return nil
+}
+
+// SetEnvironment does nothing, as we use neither the target links nor the path MTU prober
+func (p *IpsecRoutingProvider) SetEnvironment(env *routing.ProviderEnvironment) error {
+	return nil
+}
+
+// DescribeAgent advertises our ipsec encapsulation
+func (p *IpsecRoutingProvider) DescribeAgent(info *routing.AgentInfo) {
+	info.Encapsulations = append(info.Encapsulations, p.encapsulationStrategy.Encapsulation())
+}
+
 func (p *IpsecRoutingProvider) Close() error {
 	if p.udpEncapListener != nil {
 		err := p.udpEncapListener.Close()
@@ -127,6 +175,12 @@ func (p *IpsecRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 		return nil
 	}
 
+	if p.udpEncapListener == nil {
+		if err := p.start(); err != nil {
+			return err
+		}
+	}
+
 	me, allNodes, version := nodeMap.Snapshot()
 
 	if me == nil {
@@ -171,6 +225,9 @@ func (p *IpsecRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 				return err
 			}
 
+			// Nodes behind NAT are reached at their public endpoint; traffic from them also arrives from it
+			remoteEndpoint, _ := remote.TunnelEndpoint(udpEncapPort)
+
 			// dir isn't explicit in state rules, but we use it to avoid code duplication
 			for _, dir := range []netlink.Dir{netlink.XFRM_DIR_IN, netlink.XFRM_DIR_OUT} {
 				klog.Errorf("Using hard-coded (and stupid) encryption keys - NO SECURITY ")
@@ -187,7 +244,7 @@ func (p *IpsecRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 
 					if dir == netlink.XFRM_DIR_OUT {
 						s.Src = me.Address
-						s.Dst = remote.Address
+						s.Dst = remoteEndpoint
 
 						spi := uint32(0xc0000000)
 						spi |= meNodeNumeral << 16
@@ -197,7 +254,7 @@ func (p *IpsecRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 
 						p.authenticationStrategy.Apply(s, me, remote)
 					} else {
-						s.Src = remote.Address
+						s.Src = remoteEndpoint
 						s.Dst = me.Address
 
 						spi := uint32(0xc0000000)
@@ -222,7 +279,7 @@ func (p *IpsecRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 
 					if dir == netlink.XFRM_DIR_OUT {
 						s.Src = me.Address
-						s.Dst = remote.Address
+						s.Dst = remoteEndpoint
 
 						spi := uint32(0xc0000000)
 						spi |= meNodeNumeral << 16
@@ -231,9 +288,9 @@ func (p *IpsecRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 						s.Spi = int(spi)
 
 						p.encryptionStrategy.Apply(s, me, remote)
-						p.encapsulationStrategy.Apply(s, me, remote)
+						p.encapsulationStrategy.Apply(s, me, remote, dir)
 					} else {
-						s.Src = remote.Address
+						s.Src = remoteEndpoint
 						s.Dst = me.Address
 
 						spi := uint32(0xc0000000)
@@ -243,7 +300,7 @@ func (p *IpsecRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 						s.Spi = int(spi)
 
 						p.encryptionStrategy.Apply(s, remote, me)
-						p.encapsulationStrategy.Apply(s, remote, me)
+						p.encapsulationStrategy.Apply(s, me, remote, dir)
 					}
 					expected = append(expected, s)
 				}
@@ -264,7 +321,7 @@ func (p *IpsecRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 			p := &netlink.XfrmPolicy{}
 			p.Src = ipnetAll
 			p.Dst = ipnetAll
-			p.DstPort = 4500
+			p.DstPort = udpEncapPort
 			p.Dir = dir
 			p.Proto = XFRM_PROTO_UDP
 			p.Priority = 200
@@ -297,6 +354,8 @@ func (p *IpsecRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 				continue
 			}
 
+			remoteEndpoint, _ := remote.TunnelEndpoint(udpEncapPort)
+
 			// TODO: Do we need forward??
 			// TODO: Do we need to speciy that AH is required?  (and check that encryption is required)
 			// TODO: Can we tie to a specific policy (or is that done by IP)
@@ -323,9 +382,9 @@ func (p *IpsecRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 
 				if dir == netlink.XFRM_DIR_OUT {
 					t.Src = me.Address
-					t.Dst = remote.Address
+					t.Dst = remoteEndpoint
 				} else {
-					t.Src = remote.Address
+					t.Src = remoteEndpoint
 					t.Dst = me.Address
 				}
 
@@ -356,9 +415,9 @@ func (p *IpsecRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 
 				if dir == netlink.XFRM_DIR_OUT {
 					t.Src = me.Address
-					t.Dst = remote.Address
+					t.Dst = remoteEndpoint
 				} else {
-					t.Src = remote.Address
+					t.Src = remoteEndpoint
 					t.Dst = me.Address
 				}
 
@@ -389,9 +448,9 @@ func (p *IpsecRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 
 				if dir == netlink.XFRM_DIR_OUT {
 					t.Src = me.Address
-					t.Dst = remote.Address
+					t.Dst = remoteEndpoint
 				} else {
-					t.Src = remote.Address
+					t.Src = remoteEndpoint
 					t.Dst = me.Address
 				}
 
@@ -0,0 +1,55 @@
+package ipsec
+
+import (
+	"fmt"
+
+	"kope.io/networking/pkg/routing"
+)
+
+func init() {
+	routing.RegisterProvider(routing.ProviderFactory[Config]{
+		Name:          "ipsec",
+		ConfigSection: "ipsec",
+		Migratable:    true,
+		SetDefaults:   (*Config).SetDefaults,
+		Validate:      (*Config).Validate,
+		New:           newProvider,
+		// Cleanup flushes all xfrm policies and state, including any we did not create
+		Cleanup:               func(config *Config) error { return Cleanup() },
+		CleanupOnlyIfSelected: true,
+	})
+}
+
+// newProvider builds an IpsecRoutingProvider from the ipsec section of the agent configuration
+func newProvider(config *Config, env *routing.ProviderEnvironment) (routing.Provider, error) {
+	var authenticationStrategy AuthenticationStrategy
+	var encryptionStrategy EncryptionStrategy
+	var encapsulationStrategy EncapsulationStrategy
+
+	switch config.Encryption {
+	case "none":
+		encryptionStrategy = &PlaintextEncryptionStrategy{}
+	case "aes":
+		encryptionStrategy = &AesEncryptionStrategy{}
+	default:
+		return nil, fmt.Errorf("unknown ipsec-encryption: %v", config.Encryption)
+	}
+	switch config.Authentication {
+	case "none":
+		authenticationStrategy = &PlaintextAuthenticationStrategy{}
+	case "sha1":
+		authenticationStrategy = &HmacSha1AuthenticationStrategy{}
+	default:
+		return nil, fmt.Errorf("unknown ipsec-authentication: %v", config.Authentication)
+	}
+	switch config.Encapsulation {
+	case "udp":
+		encapsulationStrategy = &UdpEncapsulationStrategy{}
+	case "esp":
+		encapsulationStrategy = &EspEncapsulationStrategy{}
+	default:
+		return nil, fmt.Errorf("unknown ipsec-encapsulation: %v", config.Encapsulation)
+	}
+
+	return NewIpsecRoutingProvider(authenticationStrategy, encryptionStrategy, encapsulationStrategy)
+}
@@ -2,6 +2,7 @@ package layer2
 
 import (
 	"fmt"
+	"net"
 	"syscall"
 
 	"github.com/vishvananda/netlink"
@@ -18,8 +19,11 @@ type Layer2RoutingProvider struct {
 }
 
 var _ routing.Provider = &Layer2RoutingProvider{}
+var _ routing.EnvironmentConfigurable = &Layer2RoutingProvider{}
 
-func NewLayer2RoutingProvider(deviceName string) (*Layer2RoutingProvider, error) {
+// NewLayer2RoutingProvider builds a Layer2RoutingProvider that routes to the other nodes via the link deviceName.
+// overlayCIDR is the pod network, in which earlier versions installed our routes with RTPROT_BOOT.
+func NewLayer2RoutingProvider(overlayCIDR *net.IPNet, deviceName string) (*Layer2RoutingProvider, error) {
 	underlyingLink, err := netlink.LinkByName(deviceName)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching target link %q: %v", deviceName, err)
@@ -29,17 +33,39 @@ func NewLayer2RoutingProvider(deviceName string) (*Layer2RoutingProvider, error)
 	}
 
 	p := &Layer2RoutingProvider{
-		routeTable:     &netutil.RouteTable{},
+		routeTable: &netutil.RouteTable{
+			LegacyBootRoute: func(route *netlink.Route) bool {
+				return route.LinkIndex == underlyingLink.Attrs().Index && route.Gw != nil && overlayCIDR.Contains(route.Dst.IP)
+			},
+		},
 		underlyingLink: underlyingLink,
 	}
 
 	return p, nil
 }
 
+// SetEnvironment accepts a change to path MTU discovery, which we don't use; our routes are via the target link,
+// so changing it requires rebuilding the provider
+func (p *Layer2RoutingProvider) SetEnvironment(env *routing.ProviderEnvironment) error {
+	if len(env.TargetLinkNames) != 1 || env.TargetLinkNames[0] != p.underlyingLink.Attrs().Name {
+		return fmt.Errorf("cannot change target link from %q to %v in place", p.underlyingLink.Attrs().Name, env.TargetLinkNames)
+	}
+	return nil
+}
+
 func (p *Layer2RoutingProvider) Close() error {
 	return nil
 }
 
+// Teardown removes the routes we installed via the target link
+func (p *Layer2RoutingProvider) Teardown() error {
+	if err := p.routeTable.Ensure(p.underlyingLink, nil, true); err != nil {
+		return fmt.Errorf("error removing routes: %w", err)
+	}
+	p.lastVersionApplied = 0
+	return nil
+}
+
 func (p *Layer2RoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 	if p.lastVersionApplied != 0 && nodeMap.IsVersion(p.lastVersionApplied) {
 		return nil
@@ -77,7 +103,7 @@ func (p *Layer2RoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 				LinkIndex: underlyingLinkIndex,
 				Dst:       remote.PodCIDR,
 				Gw:        remote.Address,
-				Protocol:  syscall.RTPROT_BOOT,
+				Protocol:  netutil.RouteProtocol,
 				Table:     syscall.RT_TABLE_MAIN,
 				Type:      syscall.RTN_UNICAST,
 			}
@@ -85,7 +111,9 @@ func (p *Layer2RoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 		}
 	}
 
-	err := p.routeTable.Ensure(nil, routes, false)
+	// Only routes with our protocol are removed, so this cleans up routes to nodes that have gone away
+	deleteExtraRoutes := true
+	err := p.routeTable.Ensure(nil, routes, deleteExtraRoutes)
 	if err != nil {
 		return fmt.Errorf("error applying route table: %v", err)
 	}
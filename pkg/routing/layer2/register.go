@@ -0,0 +1,20 @@
+package layer2
+
+import (
+	"fmt"
+
+	"kope.io/networking/pkg/routing"
+)
+
+func init() {
+	// layer2 creates no devices; the agent's cleanup removes its routes along with every other route we installed
+	routing.RegisterProvider(routing.ProviderFactory[struct{}]{
+		Name: "layer2",
+		New: func(_ *struct{}, env *routing.ProviderEnvironment) (routing.Provider, error) {
+			if len(env.TargetLinkNames) != 1 {
+				return nil, fmt.Errorf("expected exactly one target link with layer2; got %v", env.TargetLinkNames)
+			}
+			return NewLayer2RoutingProvider(env.OverlayCIDR, env.TargetLinkNames[0])
+		},
+	})
+}
@@ -0,0 +1,152 @@
+package routing
+
+import (
+	"fmt"
+
+	"k8s.io/klog/v2"
+)
+
+// MigrationProvider runs two providers at once, while a cluster moves from one to the other without a flag day.
+// Peers that advertise the new provider in their AgentAnnotation are reached with the new provider, the others with the old one,
+// so both ends of a tunnel always agree.  Once every node advertises the new provider, the old provider is torn down.
+// The two providers must not reconcile each other's state: for example two vxlan devices must have different names and VNIs.
+type MigrationProvider struct {
+	fromName  string
+	from      Provider
+	fromNodes *NodeMap
+
+	toName  string
+	to      Provider
+	toNodes *NodeMap
+
+	// retired is set once every node has migrated and we have torn down the old provider
+	retired bool
+}
+
+var _ Provider = &MigrationProvider{}
+var _ MultiProvider = &MigrationProvider{}
+var _ MTUConfigurable = &MigrationProvider{}
+var _ EnvironmentConfigurable = &MigrationProvider{}
+var _ AgentDescriber = &MigrationProvider{}
+
+// NewMigrationProvider builds a MigrationProvider, migrating from the provider named fromName to the provider named toName
+func NewMigrationProvider(fromName string, from Provider, toName string, to Provider) *MigrationProvider {
+	return &MigrationProvider{
+		fromName:  fromName,
+		from:      from,
+		fromNodes: NewNodeMap(nil, nil),
+		toName:    toName,
+		to:        to,
+		toNodes:   NewNodeMap(nil, nil),
+	}
+}
+
+// ActiveProviders returns the providers we are running, the new provider first
+func (p *MigrationProvider) ActiveProviders() []string {
+	if p.retired {
+		return []string{p.toName}
+	}
+	return []string{p.toName, p.fromName}
+}
+
+func (p *MigrationProvider) EnsureCIDRs(nodeMap *NodeMap) error {
+	me, allNodes, _ := nodeMap.Snapshot()
+	if me == nil {
+		return fmt.Errorf("Cannot find local node")
+	}
+
+	if !p.retired && p.allMigrated(allNodes) {
+		klog.Infof("all nodes support provider %q; retiring provider %q", p.toName, p.fromName)
+		if err := p.from.Teardown(); err != nil {
+			return fmt.Errorf("error tearing down provider %q: %w", p.fromName, err)
+		}
+		p.retired = true
+	}
+
+	migrated := func(node *NodeInfo) bool {
+		return p.retired || node.SupportsProvider(p.toName)
+	}
+
+	if !p.retired {
+		p.fromNodes.CopyFrom(nodeMap, func(node *NodeInfo) bool {
+			return !migrated(node)
+		})
+		if err := p.from.EnsureCIDRs(p.fromNodes); err != nil {
+			return fmt.Errorf("error from provider %q: %w", p.fromName, err)
+		}
+	}
+
+	p.toNodes.CopyFrom(nodeMap, migrated)
+	if err := p.to.EnsureCIDRs(p.toNodes); err != nil {
+		return fmt.Errorf("error from provider %q: %w", p.toName, err)
+	}
+	return nil
+}
+
+// allMigrated is true if every node with a PodCIDR advertises the new provider, including our own node
+func (p *MigrationProvider) allMigrated(nodes []NodeInfo) bool {
+	for i := range nodes {
+		node := &nodes[i]
+		if node.PodCIDR == nil {
+			continue
+		}
+		if !node.SupportsProvider(p.toName) {
+			klog.V(2).Infof("node %q does not yet support provider %q", node.Name, p.toName)
+			return false
+		}
+	}
+	return true
+}
+
+// DescribeAgent describes both providers, so peers can reach us with either; the MTU is that of the new provider
+func (p *MigrationProvider) DescribeAgent(info *AgentInfo) {
+	var providers []Provider
+	if !p.retired {
+		providers = append(providers, p.from)
+	}
+	providers = append(providers, p.to)
+	for _, provider := range providers {
+		if describer, ok := provider.(AgentDescriber); ok {
+			describer.DescribeAgent(info)
+		}
+	}
+}
+
+// SetMTU sets the MTU of both providers, if they support it
+func (p *MigrationProvider) SetMTU(mtu int) {
+	for _, provider := range []Provider{p.from, p.to} {
+		if configurable, ok := provider.(MTUConfigurable); ok {
+			configurable.SetMTU(mtu)
+		}
+	}
+}
+
+// SetEnvironment sets the environment of both providers, failing if either cannot change it in place
+func (p *MigrationProvider) SetEnvironment(env *ProviderEnvironment) error {
+	for _, provider := range []struct {
+		name     string
+		provider Provider
+	}{{p.fromName, p.from}, {p.toName, p.to}} {
+		configurable, ok := provider.provider.(EnvironmentConfigurable)
+		if !ok {
+			return fmt.Errorf("provider %q cannot change its target links or path MTU discovery in place", provider.name)
+		}
+		if err := configurable.SetEnvironment(env); err != nil {
+			return fmt.Errorf("provider %q: %w", provider.name, err)
+		}
+	}
+	return nil
+}
+
+// Teardown tears down both providers
+func (p *MigrationProvider) Teardown() error {
+	if !p.retired {
+		if err := p.from.Teardown(); err != nil {
+			return fmt.Errorf("error tearing down provider %q: %w", p.fromName, err)
+		}
+	}
+	if err := p.to.Teardown(); err != nil {
+		return fmt.Errorf("error tearing down provider %q: %w", p.toName, err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package routing
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeProvider records the nodes it was asked to reach
+type fakeProvider struct {
+	nodes    []string
+	version  uint64
+	tornDown bool
+	// err is returned by EnsureCIDRs
+	err error
+}
+
+func (p *fakeProvider) EnsureCIDRs(nodeMap *NodeMap) error {
+	if p.err != nil {
+		return p.err
+	}
+	me, nodes, version := nodeMap.Snapshot()
+	p.version = version
+	p.nodes = nil
+	for _, node := range nodes {
+		if node.Name != me.Name {
+			p.nodes = append(p.nodes, node.Name)
+		}
+	}
+	sort.Strings(p.nodes)
+	return nil
+}
+
+func (p *fakeProvider) Teardown() error {
+	p.tornDown = true
+	return nil
+}
+
+func migrationTestNode(name string, providers ...string) *corev1.Node {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{PodCIDR: "100.96.0.0/24"},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.1"}},
+		},
+	}
+	if len(providers) != 0 {
+		b, _ := json.Marshal(&AgentInfo{Providers: providers})
+		node.Annotations = map[string]string{AgentAnnotation: string(b)}
+	}
+	return node
+}
+
+func TestMigrationProvider(t *testing.T) {
+	m := NewNodeMap(func(node *corev1.Node) bool { return node.Name == "node1" }, nil)
+	m.UpdateNode(migrationTestNode("node1", "vxlan", "ipsec"))
+	m.UpdateNode(migrationTestNode("node2", "ipsec"))
+	m.UpdateNode(migrationTestNode("node3", "vxlan", "ipsec"))
+	m.UpdateNode(migrationTestNode("node4"))
+	m.MarkReady()
+
+	from := &fakeProvider{}
+	to := &fakeProvider{}
+	p := NewMigrationProvider("ipsec", from, "vxlan", to)
+
+	if err := p.EnsureCIDRs(m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(from.nodes, []string{"node2", "node4"}) {
+		t.Errorf("unexpected nodes for old provider: %v", from.nodes)
+	}
+	if !reflect.DeepEqual(to.nodes, []string{"node3"}) {
+		t.Errorf("unexpected nodes for new provider: %v", to.nodes)
+	}
+	if !reflect.DeepEqual(p.ActiveProviders(), []string{"vxlan", "ipsec"}) {
+		t.Errorf("unexpected active providers: %v", p.ActiveProviders())
+	}
+
+	// An unrelated change to the old provider's nodes does not change the new provider's view
+	toVersion := to.version
+	node4 := migrationTestNode("node4")
+	node4.Spec.PodCIDR = "100.96.4.0/24"
+	m.UpdateNode(node4)
+	if err := p.EnsureCIDRs(m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if to.version != toVersion {
+		t.Errorf("new provider's node map changed version, but its nodes did not change")
+	}
+
+	m.UpdateNode(migrationTestNode("node2", "vxlan"))
+	m.UpdateNode(migrationTestNode("node4", "vxlan"))
+	if err := p.EnsureCIDRs(m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !from.tornDown {
+		t.Errorf("expected old provider to be torn down once every node has migrated")
+	}
+	if !reflect.DeepEqual(to.nodes, []string{"node2", "node3", "node4"}) {
+		t.Errorf("unexpected nodes for new provider: %v", to.nodes)
+	}
+	if !reflect.DeepEqual(p.ActiveProviders(), []string{"vxlan"}) {
+		t.Errorf("unexpected active providers after migration: %v", p.ActiveProviders())
+	}
+}
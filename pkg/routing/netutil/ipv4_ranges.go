@@ -0,0 +1,93 @@
+package netutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/google/nftables"
+)
+
+// IPv4Range is an inclusive range of IPv4 addresses, as integers to simplify the arithmetic
+type IPv4Range struct {
+	Start uint32
+	End   uint32
+}
+
+// IPv4RangeForCIDR returns the range of addresses in an IPv4 CIDR
+func IPv4RangeForCIDR(cidr *net.IPNet) (IPv4Range, error) {
+	ip4 := cidr.IP.To4()
+	ones, bits := cidr.Mask.Size()
+	if ip4 == nil || bits != 32 {
+		return IPv4Range{}, fmt.Errorf("CIDR %q is not IPv4", cidr)
+	}
+	start := IPv4ToUint32(ip4.Mask(cidr.Mask))
+	end := start | uint32((uint64(1)<<uint(bits-ones))-1)
+	return IPv4Range{Start: start, End: end}, nil
+}
+
+// IPv4ToUint32 converts an IPv4 address to an integer
+func IPv4ToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+// Uint32ToIPv4 converts an integer to an IPv4 address
+func Uint32ToIPv4(v uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip
+}
+
+// MergeIPv4Ranges sorts the ranges and merges any that overlap or are adjacent; the kernel rejects overlapping interval elements.
+func MergeIPv4Ranges(ranges []IPv4Range) []IPv4Range {
+	sorted := append([]IPv4Range(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	var merged []IPv4Range
+	for _, r := range sorted {
+		if len(merged) != 0 {
+			last := &merged[len(merged)-1]
+			if last.End == 0xffffffff || r.Start <= last.End+1 {
+				if r.End > last.End {
+					last.End = r.End
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// SubtractIPv4Range removes x from each of the ranges
+func SubtractIPv4Range(ranges []IPv4Range, x IPv4Range) []IPv4Range {
+	var out []IPv4Range
+	for _, r := range ranges {
+		if x.End < r.Start || x.Start > r.End {
+			out = append(out, r)
+			continue
+		}
+		if x.Start > r.Start {
+			out = append(out, IPv4Range{Start: r.Start, End: x.Start - 1})
+		}
+		if x.End < r.End {
+			out = append(out, IPv4Range{Start: x.End + 1, End: r.End})
+		}
+	}
+	return out
+}
+
+// IPv4RangeSetElements returns the elements of an interval set containing the (merged) ranges
+func IPv4RangeSetElements(ranges []IPv4Range) []nftables.SetElement {
+	var elements []nftables.SetElement
+	for _, r := range MergeIPv4Ranges(ranges) {
+		elements = append(elements, nftables.SetElement{Key: Uint32ToIPv4(r.Start)})
+		if r.End != 0xffffffff {
+			elements = append(elements, nftables.SetElement{Key: Uint32ToIPv4(r.End + 1), IntervalEnd: true})
+		}
+	}
+	return elements
+}
@@ -2,6 +2,7 @@ package netutil
 
 import (
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/vishvananda/netlink"
@@ -12,7 +13,8 @@ import (
 type Links struct {
 }
 
-// Creates links to match expected; removing any links that match prefix but are not expected
+// Creates links to match expected; removing any links that match prefix but are not expected.
+// Existing links whose attributes differ are recreated, except for the MTU, which is changed in place.
 // Returns the state of links matching expected
 func (t *Links) Ensure(expected []netlink.Link, prefix string) (map[string]netlink.Link, error) {
 	klog.V(2).Infof("NETLINK: ip links show")
@@ -46,6 +48,7 @@ func (t *Links) Ensure(expected []netlink.Link, prefix string) (map[string]netli
 
 	var create []netlink.Link
 	var remove []netlink.Link
+	var setMTU []netlink.Link
 
 	for k, e := range expectedMap {
 		a := actualMap[k]
@@ -55,10 +58,16 @@ func (t *Links) Ensure(expected []netlink.Link, prefix string) (map[string]netli
 			continue
 		}
 
-		if !linkEqual(a, e) {
-			klog.Warningf("NOT IMPLEMENTED change for link %s:\n\ta: %s\n\te: %s", k, util.AsJsonString(a), util.AsJsonString(e))
-			//remove = append(remove, a)
-			//create = append(create, e)
+		recreate, mtuChanged := LinkDiff(a, e)
+		if len(recreate) != 0 {
+			klog.Infof("link %s must be recreated: %s", k, strings.Join(recreate, ", "))
+			klog.V(2).Infof("change for link %s:\n\ta: %s\n\te: %s", k, util.AsJsonString(a), util.AsJsonString(e))
+			remove = append(remove, a)
+			create = append(create, e)
+			continue
+		}
+		if mtuChanged {
+			setMTU = append(setMTU, e)
 		}
 		retMap[k] = a
 	}
@@ -72,74 +81,172 @@ func (t *Links) Ensure(expected []netlink.Link, prefix string) (map[string]netli
 		}
 	}
 
-	if len(remove) != 0 {
-		for _, l := range remove {
-			klog.Infof("NETLINK: ip link del %s", l.Attrs().Name)
-			err := netlink.LinkDel(l)
-			if err != nil {
-				return nil, fmt.Errorf("error removing link: %v", err)
-			}
+	for _, l := range remove {
+		klog.Infof("NETLINK: ip link del %s", l.Attrs().Name)
+		err := netlink.LinkDel(l)
+		if err != nil {
+			return nil, fmt.Errorf("error removing link: %v", err)
 		}
 	}
 
-	if len(create) != 0 {
-		for _, l := range create {
-			klog.Infof("NETLINK: ip link create %s", l.Attrs().Name)
-			klog.V(2).Infof(" full link object: %v", util.AsJsonString(l))
-			err := netlink.LinkAdd(l)
-			if err != nil {
-				return nil, fmt.Errorf("error creating link %v: %v", l, err)
-			}
+	for _, l := range setMTU {
+		name := l.Attrs().Name
+		klog.Infof("NETLINK: ip link set %s mtu %d", name, l.Attrs().MTU)
+		if err := netlink.LinkSetMTU(retMap[name], l.Attrs().MTU); err != nil {
+			return nil, fmt.Errorf("error setting mtu on link %s: %v", name, err)
+		}
+		retMap[name].Attrs().MTU = l.Attrs().MTU
+	}
 
-			retMap[l.Attrs().Name] = l
+	for _, l := range create {
+		name := l.Attrs().Name
+		klog.Infof("NETLINK: ip link create %s", name)
+		klog.V(2).Infof(" full link object: %v", util.AsJsonString(l))
+		err := LinkAdd(l)
+		if err != nil {
+			return nil, fmt.Errorf("error creating link %v: %v", l, err)
 		}
+
+		// Re-read the link so that callers see the index and flags assigned by the kernel
+		actual, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting link %s after creation: %v", name, err)
+		}
+		retMap[name] = actual
 	}
 
 	return retMap, nil
 }
 
-func linkEqual(a, e netlink.Link) bool {
-	if a.Type() != e.Type() {
-		return false
+// DeleteLink deletes the named link; it is not an error if the link does not exist
+func DeleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("error fetching link %q: %w", name, err)
 	}
-	aa := a.Attrs()
-	ea := e.Attrs()
-	if aa.Name != ea.Name {
-		return false
+
+	klog.Infof("NETLINK: ip link del %s", name)
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("error deleting link %q: %w", name, err)
 	}
-	switch a.Type() {
-	//case "gre":
-	//	return greLinkEqual(a.(*netlink.Gre), e.(*netlink.Gre))
+	return nil
+}
+
+// LinkDiff compares the attributes of actual link a that are specified in the expected link e.
+// It returns the differences that can only be fixed by recreating the link, and whether the MTU (which we change in place) differs.
+// Zero-valued numeric and address fields in e are treated as "kernel default" and not compared.
+func LinkDiff(a, e netlink.Link) ([]string, bool) {
+	var d linkDiffs
+
+	if a.Type() != e.Type() {
+		d.add("type", a.Type(), e.Type())
+		return d, false
+	}
+
+	mtuChanged := e.Attrs().MTU != 0 && a.Attrs().MTU != e.Attrs().MTU
+
+	switch e := e.(type) {
+	case *netlink.Gretun:
+		a := a.(*netlink.Gretun)
+		d.ip("local", a.Local, e.Local)
+		d.ip("remote", a.Remote, e.Remote)
+		optional(&d, "ttl", a.Ttl, e.Ttl)
+		optional(&d, "tos", a.Tos, e.Tos)
+		optional(&d, "pmtudisc", a.PMtuDisc, e.PMtuDisc)
+		optional(&d, "link", a.Link, e.Link)
+		required(&d, "ikey", a.IKey, e.IKey)
+		required(&d, "okey", a.OKey, e.OKey)
+
+	case *netlink.Gretap:
+		a := a.(*netlink.Gretap)
+		d.ip("local", a.Local, e.Local)
+		d.ip("remote", a.Remote, e.Remote)
+		optional(&d, "ttl", a.Ttl, e.Ttl)
+		optional(&d, "tos", a.Tos, e.Tos)
+		optional(&d, "pmtudisc", a.PMtuDisc, e.PMtuDisc)
+		optional(&d, "link", a.Link, e.Link)
+		required(&d, "ikey", a.IKey, e.IKey)
+		required(&d, "okey", a.OKey, e.OKey)
+		required(&d, "external", a.FlowBased, e.FlowBased)
+
+	case *netlink.Iptun:
+		a := a.(*netlink.Iptun)
+		d.ip("local", a.Local, e.Local)
+		d.ip("remote", a.Remote, e.Remote)
+		optional(&d, "ttl", a.Ttl, e.Ttl)
+		optional(&d, "tos", a.Tos, e.Tos)
+		optional(&d, "pmtudisc", a.PMtuDisc, e.PMtuDisc)
+		optional(&d, "link", a.Link, e.Link)
+		required(&d, "external", a.FlowBased, e.FlowBased)
+
+	case *netlink.Vxlan:
+		a := a.(*netlink.Vxlan)
+		required(&d, "id", a.VxlanId, e.VxlanId)
+		d.ip("local", a.SrcAddr, e.SrcAddr)
+		d.ip("group", a.Group, e.Group)
+		optional(&d, "dev", a.VtepDevIndex, e.VtepDevIndex)
+		optional(&d, "ttl", a.TTL, e.TTL)
+		optional(&d, "tos", a.TOS, e.TOS)
+		optional(&d, "dstport", a.Port, e.Port)
+		optional(&d, "srcport-low", a.PortLow, e.PortLow)
+		optional(&d, "srcport-high", a.PortHigh, e.PortHigh)
+		required(&d, "learning", a.Learning, e.Learning)
+		required(&d, "proxy", a.Proxy, e.Proxy)
+		required(&d, "l2miss", a.L2miss, e.L2miss)
+		required(&d, "l3miss", a.L3miss, e.L3miss)
+		required(&d, "udpcsum", a.UDPCSum, e.UDPCSum)
+		required(&d, "udp6zerocsumtx", a.UDP6ZeroCSumTx, e.UDP6ZeroCSumTx)
+		required(&d, "udp6zerocsumrx", a.UDP6ZeroCSumRx, e.UDP6ZeroCSumRx)
+		required(&d, "gbp", a.GBP, e.GBP)
+		required(&d, "external", a.FlowBased, e.FlowBased)
+
+	case *netlink.Geneve:
+		a := a.(*netlink.Geneve)
+		required(&d, "id", a.ID, e.ID)
+		d.ip("remote", a.Remote, e.Remote)
+		optional(&d, "ttl", a.Ttl, e.Ttl)
+		optional(&d, "tos", a.Tos, e.Tos)
+		optional(&d, "dstport", a.Dport, e.Dport)
+		required(&d, "external", a.FlowBased, e.FlowBased)
+
+	case *netlink.Wireguard:
+		// Peers and keys are configured over genetlink, not as link attributes
+
 	default:
-		klog.Warningf("Unhandled type %q", a.Type())
-		return true
+		klog.Warningf("Unhandled link type %q; not comparing attributes", e.Type())
 	}
+
+	return d, mtuChanged
+}
+
+// linkDiffs is a list of human-readable differences between two links
+type linkDiffs []string
+
+func (d *linkDiffs) add(field string, a, e interface{}) {
+	*d = append(*d, fmt.Sprintf("%s is %v, expected %v", field, a, e))
 }
 
-//func greLinkEqual(a, e *netlink.Gre) bool {
-//	if !ipEqual(a.Local, e.Local) {
-//		return false
-//	}
-//	if !ipEqual(a.Remote, e.Remote) {
-//		return false
-//	}
-//	if a.Ttl != e.Ttl {
-//		return false
-//	}
-//	if a.IFlags != e.IFlags {
-//		return false
-//	}
-//	if a.OFlags != e.OFlags {
-//		return false
-//	}
-//	if a.PMtuDisc != e.PMtuDisc {
-//		return false
-//	}
-//	if a.Tos != e.Tos {
-//		return false
-//	}
-//	if a.Link != e.Link {
-//		return false
-//	}
-//	return true
-//}
+// ip records a difference if e is specified and a is a different address
+func (d *linkDiffs) ip(field string, a, e net.IP) {
+	if e != nil && !ipEqual(a, e) {
+		d.add(field, a, e)
+	}
+}
+
+// required records a difference if a and e differ
+func required[T comparable](d *linkDiffs, field string, a, e T) {
+	if a != e {
+		d.add(field, a, e)
+	}
+}
+
+// optional records a difference if e is non-zero and a differs
+func optional[T comparable](d *linkDiffs, field string, a, e T) {
+	var zero T
+	if e != zero && a != e {
+		d.add(field, a, e)
+	}
+}
@@ -0,0 +1,187 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"kope.io/networking/pkg/testutil"
+)
+
+func buildTestVxlan(name string, vni int, mtu int) *netlink.Vxlan {
+	return &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: name,
+			MTU:  mtu,
+		},
+		VxlanId: vni,
+		SrcAddr: net.ParseIP("192.0.2.1"),
+		Port:    4789,
+	}
+}
+
+func TestLinksEnsure(t *testing.T) {
+	testutil.EnterNetNS(t)
+
+	links := &Links{}
+
+	ensure := func(expected ...netlink.Link) map[string]netlink.Link {
+		t.Helper()
+		actual, err := links.Ensure(expected, "kt")
+		if err != nil {
+			t.Fatalf("error from Ensure: %v", err)
+		}
+		if len(actual) != len(expected) {
+			t.Fatalf("unexpected links returned: %v", actual)
+		}
+		for name, l := range actual {
+			if l.Attrs().Index == 0 {
+				t.Errorf("link %s returned without index", name)
+			}
+		}
+		return actual
+	}
+
+	// An unrelated link (without our prefix) must be left alone
+	if err := netlink.LinkAdd(buildTestVxlan("other", 9, 0)); err != nil {
+		t.Fatalf("error creating link: %v", err)
+	}
+
+	actual := ensure(buildTestVxlan("kt1", 1, 1400), buildTestVxlan("kt2", 2, 1400))
+	index1 := actual["kt1"].Attrs().Index
+	index2 := actual["kt2"].Attrs().Index
+
+	// No changes: links are kept
+	actual = ensure(buildTestVxlan("kt1", 1, 1400), buildTestVxlan("kt2", 2, 1400))
+	if actual["kt1"].Attrs().Index != index1 || actual["kt2"].Attrs().Index != index2 {
+		t.Errorf("links were recreated without changes")
+	}
+
+	// MTU is changed in place; the VNI requires recreation
+	actual = ensure(buildTestVxlan("kt1", 1, 1300), buildTestVxlan("kt2", 3, 1400))
+	if actual["kt1"].Attrs().Index != index1 {
+		t.Errorf("link kt1 was recreated for an MTU change")
+	}
+	if actual["kt2"].Attrs().Index == index2 {
+		t.Errorf("link kt2 was not recreated for a VNI change")
+	}
+
+	for name, expected := range map[string]*netlink.Vxlan{"kt1": buildTestVxlan("kt1", 1, 1300), "kt2": buildTestVxlan("kt2", 3, 1400)} {
+		l, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatalf("error getting link: %v", err)
+		}
+		if diffs, mtuChanged := LinkDiff(l, expected); len(diffs) != 0 || mtuChanged {
+			t.Errorf("link %s not reconciled: %v (mtu changed: %v)", name, diffs, mtuChanged)
+		}
+	}
+
+	// Links that are no longer expected are removed
+	ensure(buildTestVxlan("kt1", 1, 1300))
+	if _, err := netlink.LinkByName("kt2"); err == nil {
+		t.Errorf("link kt2 was not removed")
+	}
+	if _, err := netlink.LinkByName("other"); err != nil {
+		t.Errorf("unrelated link was removed: %v", err)
+	}
+}
+
+func TestDeleteLink(t *testing.T) {
+	testutil.EnterNetNS(t)
+
+	// Deleting a link that does not exist is not an error
+	if err := DeleteLink("kt1"); err != nil {
+		t.Fatalf("error from DeleteLink of missing link: %v", err)
+	}
+
+	if err := netlink.LinkAdd(buildTestVxlan("kt1", 1, 0)); err != nil {
+		t.Fatalf("error creating link: %v", err)
+	}
+	if err := DeleteLink("kt1"); err != nil {
+		t.Fatalf("error from DeleteLink: %v", err)
+	}
+	if _, err := netlink.LinkByName("kt1"); err == nil {
+		t.Errorf("expected link to be deleted")
+	}
+}
+
+func TestLinkDiff(t *testing.T) {
+	a := &netlink.Gretun{
+		LinkAttrs: netlink.LinkAttrs{Name: "gre1", MTU: 1476},
+		Local:     net.ParseIP("192.0.2.1"),
+		Remote:    net.ParseIP("192.0.2.2"),
+		Ttl:       64,
+		PMtuDisc:  1,
+	}
+
+	// Unspecified fields are not compared
+	e := &netlink.Gretun{
+		LinkAttrs: netlink.LinkAttrs{Name: "gre1"},
+		Local:     net.ParseIP("192.0.2.1"),
+		Remote:    net.ParseIP("192.0.2.2"),
+	}
+	if diffs, mtuChanged := LinkDiff(a, e); len(diffs) != 0 || mtuChanged {
+		t.Errorf("unexpected diffs: %v %v", diffs, mtuChanged)
+	}
+
+	e.Remote = net.ParseIP("192.0.2.3")
+	e.Ttl = 32
+	diffs, _ := LinkDiff(a, e)
+	if len(diffs) != 2 {
+		t.Errorf("expected remote and ttl differences, got %v", diffs)
+	}
+
+	if diffs, _ := LinkDiff(a, &netlink.Iptun{LinkAttrs: netlink.LinkAttrs{Name: "gre1"}}); len(diffs) != 1 {
+		t.Errorf("expected type difference, got %v", diffs)
+	}
+}
+
+func TestLinkDiffVxlanChecksum(t *testing.T) {
+	grid := []struct {
+		actual, expected bool
+	}{
+		{actual: false, expected: true},
+		{actual: true, expected: false},
+	}
+	for _, g := range grid {
+		a := &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: "vxlan1"}, VxlanId: 1, UDPCSum: g.actual}
+		e := &netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: "vxlan1"}, VxlanId: 1, UDPCSum: g.expected}
+		if diffs, _ := LinkDiff(a, e); len(diffs) != 1 {
+			t.Errorf("udpcsum %v to %v: expected udpcsum difference, got %v", g.actual, g.expected, diffs)
+		}
+	}
+}
+
+func TestLinkAddVxlan(t *testing.T) {
+	testutil.EnterNetNS(t)
+
+	grid := []struct {
+		name   string
+		mutate func(v *netlink.Vxlan)
+	}{
+		{name: "defaults", mutate: func(v *netlink.Vxlan) {}},
+		{name: "udpcsum", mutate: func(v *netlink.Vxlan) { v.UDPCSum = true }},
+		{name: "proxy", mutate: func(v *netlink.Vxlan) { v.Proxy = true }},
+		{name: "l2miss", mutate: func(v *netlink.Vxlan) { v.L2miss = true }},
+		{name: "l3miss", mutate: func(v *netlink.Vxlan) { v.L3miss = true }},
+		{name: "gbp", mutate: func(v *netlink.Vxlan) { v.GBP = true }},
+		{name: "remote", mutate: func(v *netlink.Vxlan) { v.Group = net.ParseIP("10.9.9.9") }},
+	}
+	for _, g := range grid {
+		expected := buildTestVxlan("kt1", 1, 1400)
+		g.mutate(expected)
+		if err := LinkAdd(expected); err != nil {
+			t.Fatalf("%s: error from LinkAdd: %v", g.name, err)
+		}
+		actual, err := netlink.LinkByName("kt1")
+		if err != nil {
+			t.Fatalf("%s: error getting link: %v", g.name, err)
+		}
+		if diffs, mtuChanged := LinkDiff(actual, expected); len(diffs) != 0 || mtuChanged {
+			t.Errorf("%s: link not created as expected: %v (mtu changed: %v)", g.name, diffs, mtuChanged)
+		}
+		if err := netlink.LinkDel(actual); err != nil {
+			t.Fatalf("%s: error from LinkDel: %v", g.name, err)
+		}
+	}
+}
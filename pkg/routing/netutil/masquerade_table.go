@@ -0,0 +1,107 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// masqueradeTableName is shared with the network policy rules, so we only own our chain and set in it
+const masqueradeTableName = "kopeio"
+const masqueradeChainName = "postrouting"
+const nonMasqueradeSetName = "non-masquerade"
+
+// multicastCIDR is never masqueraded, matching the behaviour of the CNI bridge plugin
+var multicastCIDR = &net.IPNet{
+	IP:   net.IPv4(224, 0, 0, 0).To4(),
+	Mask: net.CIDRMask(4, 32),
+}
+
+// MasqueradeTable manages the nftables rules that SNAT pod traffic leaving the pod network.
+// Traffic from the local PodCIDR is masqueraded unless the destination is in one of the non-masquerade CIDRs.
+type MasqueradeTable struct {
+	nonMasqueradeCIDRs []*net.IPNet
+
+	table *NftTable
+}
+
+// NewMasqueradeTable builds a MasqueradeTable; traffic to nonMasqueradeCIDRs is never masqueraded.
+func NewMasqueradeTable(nonMasqueradeCIDRs []*net.IPNet) (*MasqueradeTable, error) {
+	for _, cidr := range nonMasqueradeCIDRs {
+		if _, err := IPv4RangeForCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("invalid non-masquerade CIDR: %w", err)
+		}
+	}
+	t := &MasqueradeTable{
+		nonMasqueradeCIDRs: nonMasqueradeCIDRs,
+		table:              NewNftTableSection(nftables.TableFamilyIPv4, masqueradeTableName, ownsMasqueradeName),
+	}
+	return t, nil
+}
+
+func ownsMasqueradeName(name string) bool {
+	return name == masqueradeChainName || name == nonMasqueradeSetName
+}
+
+// Delete removes our masquerade rules
+func (t *MasqueradeTable) Delete() error {
+	return t.table.Delete()
+}
+
+// Ensure configures masquerade for traffic originating in podCIDR; traffic to poolCIDRs is not masqueraded either
+func (t *MasqueradeTable) Ensure(podCIDR *net.IPNet, poolCIDRs []*net.IPNet) error {
+	podCIDRv4 := podCIDR.IP.To4()
+	if podCIDRv4 == nil {
+		return fmt.Errorf("expected IPv4 PodCIDR %q", podCIDR)
+	}
+	ones, _ := podCIDR.Mask.Size()
+	podCIDRMask := net.CIDRMask(ones, 32)
+
+	var ranges []IPv4Range
+	nonMasqueradeCIDRs := append([]*net.IPNet{multicastCIDR}, t.nonMasqueradeCIDRs...)
+	for _, cidr := range poolCIDRs {
+		if cidr.IP.To4() != nil {
+			nonMasqueradeCIDRs = append(nonMasqueradeCIDRs, cidr)
+		}
+	}
+	for _, cidr := range nonMasqueradeCIDRs {
+		r, err := IPv4RangeForCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		ranges = append(ranges, r)
+	}
+
+	set := &NftSet{
+		Name:     nonMasqueradeSetName,
+		KeyType:  nftables.TypeIPAddr,
+		Interval: true,
+		Elements: IPv4RangeSetElements(ranges),
+	}
+
+	chain := &NftChain{
+		Name:     masqueradeChainName,
+		Type:     nftables.ChainTypeNAT,
+		Hook:     nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	}
+
+	// ip saddr $podCIDR ip daddr != @non-masquerade masquerade
+	chain.Rules = append(chain.Rules, &NftRule{
+		Exprs: []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: podCIDRMask, Xor: []byte{0, 0, 0, 0}},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: podCIDRv4.Mask(podCIDRMask)},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name, Invert: true},
+			&expr.Masq{},
+		},
+	})
+
+	return t.table.Ensure(&NftState{
+		Sets:   []*NftSet{set},
+		Chains: []*NftChain{chain},
+	})
+}
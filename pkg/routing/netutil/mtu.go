@@ -0,0 +1,257 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// Header sizes used to compute encapsulation overhead, for an IPv4 underlay
+const (
+	ipv4HeaderLen     = 20
+	udpHeaderLen      = 8
+	ethernetHeaderLen = 14
+	vxlanHeaderLen    = 8
+	greHeaderLen      = 4
+)
+
+// VxlanOverhead is the bytes added by vxlan: outer IPv4 and UDP headers, the VXLAN header and the inner Ethernet header
+const VxlanOverhead = ipv4HeaderLen + udpHeaderLen + vxlanHeaderLen + ethernetHeaderLen
+
+// GreOverhead is the bytes added by GRE without key, checksum or sequence number: outer IPv4 header and GRE header
+const GreOverhead = ipv4HeaderLen + greHeaderLen
+
+// UnderlayMTU returns the MTU of the route the kernel would use to reach remote
+func UnderlayMTU(remote net.IP) (int, error) {
+	routes, err := netlink.RouteGet(remote)
+	if err != nil {
+		return 0, fmt.Errorf("error doing `ip route get %s`: %w", remote, err)
+	}
+	if len(routes) == 0 {
+		return 0, fmt.Errorf("no route to %s", remote)
+	}
+	route := routes[0]
+	if route.MTU != 0 {
+		return route.MTU, nil
+	}
+	link, err := netlink.LinkByIndex(route.LinkIndex)
+	if err != nil {
+		return 0, fmt.Errorf("error getting link %d for route to %s: %w", route.LinkIndex, remote, err)
+	}
+	return link.Attrs().MTU, nil
+}
+
+// Settings for path MTU probes
+const (
+	// pathMTUProbeAttempts is the number of probes we send; each can discover a smaller hop
+	pathMTUProbeAttempts = 3
+	// pathMTUProbeWait is how long we wait for a "fragmentation needed" reply after each probe
+	pathMTUProbeWait = 200 * time.Millisecond
+	// pathMTUProbeWorkers is the number of peers we probe concurrently
+	pathMTUProbeWorkers = 16
+	// ipv4UDPHeadersLen is the space taken by headers in a probe datagram
+	ipv4UDPHeadersLen = ipv4HeaderLen + udpHeaderLen
+)
+
+// ProbePathMTU measures the path MTU to remote, up to maxMTU.
+// It sends full-size UDP datagrams with DF set to remote:port; routers that cannot forward them reply
+// with "fragmentation needed", which the kernel records and reports through IP_MTU.
+// The remote does not need to reply; port should be one that is allowed through firewalls (e.g. the vxlan port).
+func ProbePathMTU(remote net.IP, port int, maxMTU int) (int, error) {
+	remote4 := remote.To4()
+	if remote4 == nil {
+		return 0, fmt.Errorf("path MTU probing is only supported for IPv4, not %s", remote)
+	}
+	if maxMTU <= ipv4UDPHeadersLen {
+		return 0, fmt.Errorf("invalid maximum MTU %d", maxMTU)
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, fmt.Errorf("error creating socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO); err != nil {
+		return 0, fmt.Errorf("error setting IP_MTU_DISCOVER: %w", err)
+	}
+	sa := &unix.SockaddrInet4{Port: port}
+	copy(sa.Addr[:], remote4)
+	if err := unix.Connect(fd, sa); err != nil {
+		return 0, fmt.Errorf("error connecting to %s:%d: %w", remote, port, err)
+	}
+
+	payload := make([]byte, maxMTU-ipv4UDPHeadersLen)
+	for attempt := 0; attempt < pathMTUProbeAttempts; attempt++ {
+		mtu, err := unix.GetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU)
+		if err != nil {
+			return 0, fmt.Errorf("error getting IP_MTU: %w", err)
+		}
+		size := min(mtu, maxMTU) - ipv4UDPHeadersLen
+		if size <= 0 {
+			break
+		}
+
+		if err := unix.Send(fd, payload[:size], 0); err != nil {
+			switch {
+			case errors.Is(err, unix.EMSGSIZE):
+				// The kernel learned a smaller path MTU since we read it; try again at that size
+				continue
+			case errors.Is(err, unix.ECONNREFUSED):
+				// An ICMP port unreachable from a previous probe; the probe reached the remote
+			default:
+				return 0, fmt.Errorf("error sending probe to %s: %w", remote, err)
+			}
+		}
+		time.Sleep(pathMTUProbeWait)
+	}
+
+	mtu, err := unix.GetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU)
+	if err != nil {
+		return 0, fmt.Errorf("error getting IP_MTU: %w", err)
+	}
+	return min(mtu, maxMTU), nil
+}
+
+// PathMTUProber measures the path MTU to peers in the background.
+// Providers ask for the MTU to each peer while reconciling; peers are probed asynchronously,
+// and Version changes when a result changes, so that providers know to reconcile again.
+type PathMTUProber struct {
+	port     int
+	interval time.Duration
+
+	wake chan struct{}
+
+	mutex   sync.Mutex
+	peers   map[string]*pathMTUPeer
+	version uint64
+}
+
+type pathMTUPeer struct {
+	ip     net.IP
+	maxMTU int
+	mtu    int
+}
+
+// NewPathMTUProber builds a PathMTUProber, which sends probes to port and re-probes each peer every interval
+func NewPathMTUProber(port int, interval time.Duration) *PathMTUProber {
+	return &PathMTUProber{
+		port:     port,
+		interval: interval,
+		wake:     make(chan struct{}, 1),
+		peers:    make(map[string]*pathMTUPeer),
+	}
+}
+
+// PathMTU returns the last measured path MTU to remote, if we have one.
+// maxMTU is the MTU of the local underlay interface; remote is registered for probing if it is new.
+func (p *PathMTUProber) PathMTU(remote net.IP, maxMTU int) (int, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	k := remote.String()
+	peer := p.peers[k]
+	if peer == nil || peer.maxMTU != maxMTU {
+		p.peers[k] = &pathMTUPeer{ip: remote, maxMTU: maxMTU}
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+		return 0, false
+	}
+	if peer.mtu == 0 {
+		return 0, false
+	}
+	return peer.mtu, true
+}
+
+// Version returns a number that changes whenever a measured path MTU changes
+func (p *PathMTUProber) Version() uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.version
+}
+
+// Run probes the registered peers until ctx is cancelled
+func (p *PathMTUProber) Run(ctx context.Context) {
+	klog.Infof("starting path MTU prober")
+
+	lastFullProbe := time.Time{}
+	for {
+		full := time.Since(lastFullProbe) >= p.interval
+		if full {
+			lastFullProbe = time.Now()
+		}
+		p.probePeers(ctx, full)
+
+		select {
+		case <-ctx.Done():
+			klog.Infof("exiting path MTU prober: %v", ctx.Err())
+			return
+		case <-p.wake:
+		case <-time.After(time.Until(lastFullProbe.Add(p.interval))):
+		}
+	}
+}
+
+// probePeers probes peers that have not been measured, or all peers if full is true
+func (p *PathMTUProber) probePeers(ctx context.Context, full bool) {
+	var peers []pathMTUPeer
+	p.mutex.Lock()
+	for _, peer := range p.peers {
+		if full || peer.mtu == 0 {
+			peers = append(peers, *peer)
+		}
+	}
+	p.mutex.Unlock()
+
+	work := make(chan pathMTUPeer)
+	var wg sync.WaitGroup
+	for i := 0; i < pathMTUProbeWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for peer := range work {
+				mtu, err := ProbePathMTU(peer.ip, p.port, peer.maxMTU)
+				if err != nil {
+					klog.Warningf("error probing path MTU to %s: %v", peer.ip, err)
+					// Fall back to the local MTU, so we don't retry continuously
+					mtu = peer.maxMTU
+				}
+				p.recordResult(peer, mtu)
+			}
+		}()
+	}
+	for _, peer := range peers {
+		if ctx.Err() != nil {
+			break
+		}
+		work <- peer
+	}
+	close(work)
+	wg.Wait()
+}
+
+func (p *PathMTUProber) recordResult(probed pathMTUPeer, mtu int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	peer := p.peers[probed.ip.String()]
+	if peer == nil || peer.maxMTU != probed.maxMTU {
+		// Re-registered while we were probing
+		return
+	}
+	if peer.mtu != mtu {
+		klog.Infof("path MTU to %s is %d", peer.ip, mtu)
+		peer.mtu = mtu
+		p.version++
+	}
+}
@@ -0,0 +1,95 @@
+package netutil
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"kope.io/networking/pkg/testutil"
+)
+
+func TestEncapsulationOverhead(t *testing.T) {
+	if VxlanOverhead != 50 {
+		t.Errorf("unexpected vxlan overhead %d", VxlanOverhead)
+	}
+	if GreOverhead != 24 {
+		t.Errorf("unexpected gre overhead %d", GreOverhead)
+	}
+}
+
+// setupTestPathMTU creates a route to 192.0.2.0/24 with a locked MTU, standing in for a smaller hop on the path
+func setupTestPathMTU(t *testing.T, mtu int) {
+	link := setupTestLink(t, "veth0", "10.1.0.1/24")
+	_, dst, _ := net.ParseCIDR("192.0.2.0/24")
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       dst,
+		Gw:        net.ParseIP("10.1.0.2"),
+		MTU:       mtu,
+		Table:     syscall.RT_TABLE_MAIN,
+	}
+	if err := netlink.RouteAdd(route); err != nil {
+		t.Fatalf("error adding route: %v", err)
+	}
+}
+
+func TestProbePathMTU(t *testing.T) {
+	testutil.EnterNetNS(t)
+	setupTestPathMTU(t, 1300)
+
+	remote := net.ParseIP("192.0.2.5")
+
+	underlayMTU, err := UnderlayMTU(remote)
+	if err != nil {
+		t.Fatalf("error from UnderlayMTU: %v", err)
+	}
+	if underlayMTU != 1300 {
+		t.Errorf("unexpected underlay MTU %d", underlayMTU)
+	}
+
+	mtu, err := ProbePathMTU(remote, 4789, 1500)
+	if err != nil {
+		t.Fatalf("error from ProbePathMTU: %v", err)
+	}
+	if mtu != 1300 {
+		t.Errorf("unexpected path MTU %d", mtu)
+	}
+
+	// The result is capped at the maximum we ask for
+	mtu, err = ProbePathMTU(remote, 4789, 1200)
+	if err != nil {
+		t.Fatalf("error from ProbePathMTU: %v", err)
+	}
+	if mtu != 1200 {
+		t.Errorf("unexpected path MTU %d", mtu)
+	}
+}
+
+func TestPathMTUProber(t *testing.T) {
+	// The probes run on worker goroutines, which are not in a test namespace, so we probe loopback
+	remote := net.ParseIP("127.0.0.1")
+	prober := NewPathMTUProber(4789, time.Hour)
+
+	if _, ok := prober.PathMTU(remote, 1400); ok {
+		t.Fatalf("expected no result before probing")
+	}
+	version := prober.Version()
+
+	prober.probePeers(context.Background(), false)
+
+	mtu, ok := prober.PathMTU(remote, 1400)
+	if !ok || mtu != 1400 {
+		t.Errorf("unexpected result %d, %v", mtu, ok)
+	}
+	if prober.Version() == version {
+		t.Errorf("version did not change after probing")
+	}
+
+	// A new local MTU re-registers the peer
+	if _, ok := prober.PathMTU(remote, 1300); ok {
+		t.Errorf("expected no result after local MTU changed")
+	}
+}
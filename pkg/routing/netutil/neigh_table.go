@@ -2,59 +2,91 @@ package netutil
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"syscall"
 
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
 	"k8s.io/klog/v2"
 	"kope.io/networking/pkg/util"
 )
 
+// neighMACPrefix is the prefix of the MAC addresses our providers assign to remote nodes (see mapToMAC)
+var neighMACPrefix = []byte{0x00, 0x53}
+
+// Neigh is an ARP or FDB entry.
+// Port is the UDP destination port of a vxlan FDB entry; if zero, the port of the vxlan device is used.
+// The kernel does not report a port equal to the device's port, so that should be given as zero.
+type Neigh struct {
+	netlink.Neigh
+	Port int
+}
+
+// NeighTable reconciles the ARP and FDB entries on a link
 type NeighTable struct {
 }
 
+// neighKey identifies a neighbour entry; ARP and FDB entries for the same IP are distinct
+type neighKey struct {
+	family int
+	ip     string
+	mac    string
+}
+
+func (k neighKey) String() string {
+	return fmt.Sprintf("family %d %s lladdr %s", k.family, k.ip, k.mac)
+}
+
+func keyForNeigh(n *netlink.Neigh) neighKey {
+	return neighKey{
+		family: n.Family,
+		ip:     n.IP.String(),
+		mac:    n.HardwareAddr.String(),
+	}
+}
+
 func NewNeighTable(linkName string, linkIndex int) (*NeighTable, error) {
 	t := &NeighTable{}
 
 	return t, nil
 }
 
-func (t *NeighTable) Ensure(link netlink.Link, expected []*netlink.Neigh) error {
+// Ensure makes the ARP and FDB entries on link match expected.
+// Entries we no longer expect are removed if they look like ours: permanent, and with a MAC in neighMACPrefix.
+func (t *NeighTable) Ensure(link netlink.Link, expected []*Neigh) error {
 	linkName := link.Attrs().Name
 	linkIndex := link.Attrs().Index
 
 	klog.V(2).Infof("NETLINK: ip neigh show dev %s", linkName)
-	actualList, err := netlink.NeighList(linkIndex, netlink.FAMILY_ALL)
+	actualList, err := listNeighs(linkIndex)
 	if err != nil {
-		return fmt.Errorf("error listing layer2 config: %v", err)
+		return err
 	}
 
-	// TODO: using strings as layer2 key is inefficient
-	actualMap := make(map[string]*netlink.Neigh)
+	actualMap := make(map[neighKey]*Neigh)
 	for i := range actualList {
 		a := &actualList[i]
 		if a.IP == nil {
-			klog.Errorf("ignoring unexpected layer2 entry with no IP: %v", a)
+			klog.V(4).Infof("ignoring layer2 entry with no IP: %v", a)
 			continue
 		}
-		k := a.IP.String()
-		actualMap[k] = a
+		actualMap[keyForNeigh(&a.Neigh)] = a
 		klog.V(4).Infof("Actual layer2 entry: %v", util.AsJsonString(a))
 	}
 
-	expectedMap := make(map[string]*netlink.Neigh)
-
+	expectedMap := make(map[neighKey]*Neigh)
 	for _, e := range expected {
 		if e.IP == nil {
 			klog.Errorf("ignoring unexpected layer2 entry with no IP: %v", e)
 			continue
 		}
-		k := e.IP.String()
-		expectedMap[k] = e
+		expectedMap[keyForNeigh(&e.Neigh)] = e
 		klog.V(4).Infof("Expected layer2 entry: %v", util.AsJsonString(e))
 	}
 
-	var upsert []*netlink.Neigh
-
+	var upsert []*Neigh
 	for k, e := range expectedMap {
 		a := actualMap[k]
 
@@ -69,43 +101,89 @@ func (t *NeighTable) Ensure(link netlink.Link, expected []*netlink.Neigh) error
 		}
 	}
 
-	// We don't remove neighbour entries
-	//var remove []*netlink.Neigh
-	//for k, a := range actualMap {
-	//	e := expectedMap[k]
-	//
-	//	if e == nil {
-	//		remove = append(remove, a)
-	//		continue
-	//	}
-	//}
-	//
-	//if len(remove) != 0 {
-	//	for _, r := range remove {
-	//		klog.Infof("NETLINK: ip neigh delete %v", routecontroller.AsJsonString(r))
-	//		klog.V(2).Infof(" full neigh: %v", routecontroller.AsJsonString(r))
-	//		err := netlink.NeighDel(r)
-	//		if err != nil {
-	//			return fmt.Errorf("error removing route entry: %v", err)
-	//		}
-	//	}
-	//}
-
-	if len(upsert) != 0 {
-		for _, r := range upsert {
-			klog.Infof("NETLINK: ip neigh replace to %s lladdr %s dev %d", r.IP, r.HardwareAddr, r.LinkIndex)
-			klog.V(2).Infof(" full neigh: %v", util.AsJsonString(r))
-			err := netlink.NeighSet(r)
-			if err != nil {
-				return fmt.Errorf("error doing `ip neigh replace to %s lladdr %s dev %d`: %v", r.IP, r.HardwareAddr, r.LinkIndex, err)
-			}
+	// We only remove entries that we created: permanent entries on our link, with our MAC prefix
+	var remove []*Neigh
+	for k, a := range actualMap {
+		if expectedMap[k] != nil {
+			continue
+		}
+		if a.LinkIndex != linkIndex || a.State&netlink.NUD_PERMANENT == 0 || !bytes.HasPrefix(a.HardwareAddr, neighMACPrefix) {
+			continue
+		}
+		remove = append(remove, a)
+	}
+
+	// Removals go first: a stale entry can share the kernel's key with its replacement
+	// (the IP for ARP, the MAC for FDB), so removing it afterwards would remove the replacement.
+	batch := &NetlinkBatch{}
+	for _, r := range remove {
+		klog.Infof("NETLINK: ip neigh del to %s lladdr %s dev %d", r.IP, r.HardwareAddr, r.LinkIndex)
+		klog.V(2).Infof(" full neigh: %v", util.AsJsonString(r))
+		if err := batch.neighDelPort(&r.Neigh, r.Port); err != nil {
+			return err
+		}
+	}
+	for _, r := range upsert {
+		klog.Infof("NETLINK: ip neigh replace to %s lladdr %s dev %d", r.IP, r.HardwareAddr, r.LinkIndex)
+		klog.V(2).Infof(" full neigh: %v", util.AsJsonString(r))
+		if err := batch.neighSetPort(&r.Neigh, r.Port); err != nil {
+			return err
 		}
 	}
+	if err := batch.Flush(); err != nil {
+		return fmt.Errorf("error applying neighbour entries: %w", err)
+	}
 
 	return nil
 }
 
-func neighEqual(a, e *netlink.Neigh) bool {
+// listNeighs returns the ARP and FDB entries on the link
+func listNeighs(linkIndex int) ([]Neigh, error) {
+	arps, err := netlink.NeighList(linkIndex, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("error listing layer2 config: %v", err)
+	}
+	var neighs []Neigh
+	for _, arp := range arps {
+		neighs = append(neighs, Neigh{Neigh: arp})
+	}
+
+	// FDB entries are only returned when we ask for them explicitly.
+	// We dump them ourselves, because netlink.NeighList does not return the destination port.
+	req := nl.NewNetlinkRequest(unix.RTM_GETNEIGH, unix.NLM_F_DUMP)
+	req.AddData(&netlink.Ndmsg{Family: syscall.AF_BRIDGE, Index: uint32(linkIndex)})
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWNEIGH)
+	if err != nil {
+		return nil, fmt.Errorf("error listing fdb entries: %v", err)
+	}
+	for _, m := range msgs {
+		fdb, err := netlink.NeighDeserialize(m)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing fdb entry: %v", err)
+		}
+		if fdb.Family != syscall.AF_BRIDGE || fdb.LinkIndex != linkIndex {
+			continue
+		}
+		n := Neigh{Neigh: *fdb}
+
+		attrs, err := nl.ParseRouteAttr(m[unix.SizeofNdMsg:])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing fdb entry attributes: %v", err)
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type == netlink.NDA_PORT && len(attr.Value) == 2 {
+				n.Port = int(binary.BigEndian.Uint16(attr.Value))
+			}
+		}
+		neighs = append(neighs, n)
+	}
+	return neighs, nil
+}
+
+func neighEqual(a, e *Neigh) bool {
+	if a.Port != e.Port {
+		return false
+	}
 	if a.Type != e.Type || a.Family != e.Family || a.Flags != e.Flags || a.LinkIndex != e.LinkIndex || a.State != e.State {
 		return false
 	}
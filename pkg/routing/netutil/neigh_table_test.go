@@ -0,0 +1,137 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"kope.io/networking/pkg/testutil"
+)
+
+func buildTestNeighs(link netlink.Link, podIP string, remoteIP string, mac string) []*Neigh {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		panic(err)
+	}
+	arp := &Neigh{Neigh: netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       netlink.FAMILY_V4,
+		State:        netlink.NUD_PERMANENT,
+		Type:         syscall.RTN_UNICAST,
+		IP:           net.ParseIP(podIP),
+		HardwareAddr: hw,
+	}}
+	fdb := &Neigh{Neigh: netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       syscall.AF_BRIDGE,
+		State:        netlink.NUD_PERMANENT,
+		Flags:        netlink.NTF_SELF,
+		IP:           net.ParseIP(remoteIP),
+		HardwareAddr: hw,
+	}}
+	return []*Neigh{arp, fdb}
+}
+
+// listTestNeighs returns "family ip lladdr [port]" for every permanent entry with an IP on link
+func listTestNeighs(t *testing.T, link netlink.Link) []string {
+	neighs, err := listNeighs(link.Attrs().Index)
+	if err != nil {
+		t.Fatalf("error listing neighbours: %v", err)
+	}
+	var out []string
+	for _, n := range neighs {
+		if n.IP == nil || n.State&netlink.NUD_PERMANENT == 0 {
+			continue
+		}
+		s := fmt.Sprintf("%d %s %s", n.Family, n.IP, n.HardwareAddr)
+		if n.Port != 0 {
+			s += fmt.Sprintf(" port %d", n.Port)
+		}
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestNeighTableEnsure(t *testing.T) {
+	testutil.EnterNetNS(t)
+
+	vxlan := &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{Name: "vxlan1"},
+		VxlanId:   1,
+		Port:      4789,
+	}
+	if err := netlink.LinkAdd(vxlan); err != nil {
+		t.Fatalf("error creating vxlan link: %v", err)
+	}
+	link, err := netlink.LinkByName("vxlan1")
+	if err != nil {
+		t.Fatalf("error getting link: %v", err)
+	}
+
+	// A permanent entry that isn't ours, which must never be removed
+	foreign := buildTestNeighs(link, "10.9.0.1", "192.0.2.9", "02:00:00:00:00:09")[0]
+	if err := netlink.NeighSet(&foreign.Neigh); err != nil {
+		t.Fatalf("error adding foreign neighbour: %v", err)
+	}
+
+	neighTable, err := NewNeighTable(link.Attrs().Name, link.Attrs().Index)
+	if err != nil {
+		t.Fatalf("error building neigh table: %v", err)
+	}
+
+	var expected []*Neigh
+	expected = append(expected, buildTestNeighs(link, "100.96.1.0", "192.0.2.1", "00:53:64:60:01:00")...)
+	expected = append(expected, buildTestNeighs(link, "100.96.2.0", "192.0.2.2", "00:53:64:60:02:00")...)
+	if err := neighTable.Ensure(link, expected); err != nil {
+		t.Fatalf("error from Ensure: %v", err)
+	}
+	assertStrings(t, listTestNeighs(t, link), []string{
+		"2 10.9.0.1 02:00:00:00:00:09",
+		"2 100.96.1.0 00:53:64:60:01:00",
+		"2 100.96.2.0 00:53:64:60:02:00",
+		"7 192.0.2.1 00:53:64:60:01:00",
+		"7 192.0.2.2 00:53:64:60:02:00",
+	})
+
+	// Node 2 is removed, and node 1 changes its underlay address
+	expected = buildTestNeighs(link, "100.96.1.0", "192.0.2.11", "00:53:64:60:01:00")
+	if err := neighTable.Ensure(link, expected); err != nil {
+		t.Fatalf("error from Ensure: %v", err)
+	}
+	assertStrings(t, listTestNeighs(t, link), []string{
+		"2 10.9.0.1 02:00:00:00:00:09",
+		"2 100.96.1.0 00:53:64:60:01:00",
+		"7 192.0.2.11 00:53:64:60:01:00",
+	})
+
+	// Node 1 moves behind NAT, with a different destination port
+	expected = buildTestNeighs(link, "100.96.1.0", "203.0.113.1", "00:53:64:60:01:00")
+	expected[1].Port = 30001
+	if err := neighTable.Ensure(link, expected); err != nil {
+		t.Fatalf("error from Ensure: %v", err)
+	}
+	assertStrings(t, listTestNeighs(t, link), []string{
+		"2 10.9.0.1 02:00:00:00:00:09",
+		"2 100.96.1.0 00:53:64:60:01:00",
+		"7 203.0.113.1 00:53:64:60:01:00 port 30001",
+	})
+
+	// Node 1 is removed; the kernel only matches the entry if we send its port
+	if err := neighTable.Ensure(link, nil); err != nil {
+		t.Fatalf("error from Ensure: %v", err)
+	}
+	assertStrings(t, listTestNeighs(t, link), []string{
+		"2 10.9.0.1 02:00:00:00:00:09",
+	})
+}
+
+func assertStrings(t *testing.T, actual []string, expected []string) {
+	t.Helper()
+	if fmt.Sprintf("%q", actual) != fmt.Sprintf("%q", expected) {
+		t.Fatalf("unexpected values:\n\tactual:   %v\n\texpected: %v", actual, expected)
+	}
+}
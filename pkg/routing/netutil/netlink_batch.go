@@ -0,0 +1,331 @@
+package netutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// netlinkBatchSize is the maximum number of messages we write in one send.
+// The kernel queues one ack per message before the send returns, so this must stay well within the receive buffer.
+const netlinkBatchSize = 128
+
+// netlinkReceiveBuffer is the receive buffer we request, so that a full batch of acks (or errors) is never dropped
+const netlinkReceiveBuffer = 1024 * 1024
+
+// NetlinkBatch pipelines route and neighbour changes: operations are queued, then Flush writes many messages
+// per send and collects the acks afterwards, rather than waiting for a round-trip per entry.
+// Operations are applied by the kernel in the order they were queued.
+type NetlinkBatch struct {
+	ops []*netlinkOp
+}
+
+type netlinkOp struct {
+	description string
+	request     *nl.NetlinkRequest
+}
+
+// RouteAdd queues the equivalent of `ip route add`
+func (b *NetlinkBatch) RouteAdd(route *netlink.Route) error {
+	return b.addRoute(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, "add", route)
+}
+
+// RouteReplace queues the equivalent of `ip route replace`
+func (b *NetlinkBatch) RouteReplace(route *netlink.Route) error {
+	return b.addRoute(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, "replace", route)
+}
+
+// RouteDel queues the equivalent of `ip route del`
+func (b *NetlinkBatch) RouteDel(route *netlink.Route) error {
+	return b.addRoute(unix.RTM_DELROUTE, 0, "del", route)
+}
+
+// NeighSet queues the equivalent of `ip neigh replace`
+func (b *NetlinkBatch) NeighSet(neigh *netlink.Neigh) error {
+	return b.addNeigh(unix.RTM_NEWNEIGH, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, "replace", neigh)
+}
+
+// neighSetPort queues the equivalent of `bridge fdb replace ... port <port>`; if port is zero it is the same as NeighSet
+func (b *NetlinkBatch) neighSetPort(neigh *netlink.Neigh, port int) error {
+	if err := b.NeighSet(neigh); err != nil {
+		return err
+	}
+	b.addNeighPort(port)
+	return nil
+}
+
+// NeighDel queues the equivalent of `ip neigh del`
+func (b *NetlinkBatch) NeighDel(neigh *netlink.Neigh) error {
+	return b.addNeigh(unix.RTM_DELNEIGH, 0, "del", neigh)
+}
+
+// neighDelPort queues the equivalent of `bridge fdb del ... port <port>`; if port is zero it is the same as NeighDel.
+// The kernel only matches an FDB entry with a port if we send the same port.
+func (b *NetlinkBatch) neighDelPort(neigh *netlink.Neigh, port int) error {
+	if err := b.NeighDel(neigh); err != nil {
+		return err
+	}
+	b.addNeighPort(port)
+	return nil
+}
+
+// addNeighPort adds the destination port to the last queued neighbour operation, if port is not zero
+func (b *NetlinkBatch) addNeighPort(port int) {
+	if port == 0 {
+		return
+	}
+	op := b.ops[len(b.ops)-1]
+	portData := make([]byte, 2)
+	binary.BigEndian.PutUint16(portData, uint16(port))
+	op.request.AddData(nl.NewRtAttr(netlink.NDA_PORT, portData))
+	op.description += fmt.Sprintf(" port %d", port)
+}
+
+// Len returns the number of queued operations
+func (b *NetlinkBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *NetlinkBatch) addRoute(msgType int, flags int, verb string, route *netlink.Route) error {
+	req := nl.NewNetlinkRequest(msgType, flags|unix.NLM_F_ACK)
+	if err := serializeRoute(req, route); err != nil {
+		return fmt.Errorf("cannot encode route %s: %w", route, err)
+	}
+	b.ops = append(b.ops, &netlinkOp{
+		description: fmt.Sprintf("ip route %s %s", verb, route),
+		request:     req,
+	})
+	return nil
+}
+
+func (b *NetlinkBatch) addNeigh(msgType int, flags int, verb string, neigh *netlink.Neigh) error {
+	req := nl.NewNetlinkRequest(msgType, flags|unix.NLM_F_ACK)
+	if err := serializeNeigh(req, neigh); err != nil {
+		return fmt.Errorf("cannot encode neigh %s: %w", neigh, err)
+	}
+	b.ops = append(b.ops, &netlinkOp{
+		description: fmt.Sprintf("ip neigh %s %s lladdr %s dev %d", verb, neigh.IP, neigh.HardwareAddr, neigh.LinkIndex),
+		request:     req,
+	})
+	return nil
+}
+
+// Flush sends all the queued operations and waits for them to be acknowledged.
+// A failing operation does not stop later operations from being applied; all failures are returned.
+// The batch is empty afterwards, whether or not there were errors.
+func (b *NetlinkBatch) Flush() error {
+	ops := b.ops
+	b.ops = nil
+	if len(ops) == 0 {
+		return nil
+	}
+
+	s, err := nl.Subscribe(unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("error opening netlink socket: %w", err)
+	}
+	defer s.Close()
+
+	fd := s.GetFd()
+	// Error acks would otherwise echo the whole request
+	if err := unix.SetsockoptInt(fd, unix.SOL_NETLINK, unix.NETLINK_CAP_ACK, 1); err != nil {
+		klog.V(2).Infof("unable to set NETLINK_CAP_ACK: %v", err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, netlinkReceiveBuffer); err != nil {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, netlinkReceiveBuffer); err != nil {
+			klog.V(2).Infof("unable to set netlink receive buffer: %v", err)
+		}
+	}
+
+	var errs []error
+	for start := 0; start < len(ops); start += netlinkBatchSize {
+		end := start + netlinkBatchSize
+		if end > len(ops) {
+			end = len(ops)
+		}
+		chunkErrs, err := sendNetlinkChunk(s, ops[start:end])
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		errs = append(errs, chunkErrs...)
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("%d of %d netlink operations failed: %w", len(errs), len(ops), errors.Join(errs...))
+	}
+	return nil
+}
+
+// sendNetlinkChunk writes ops in a single send, and reads until every op has been acked.
+// It returns the per-operation failures, and an error if the socket itself failed.
+func sendNetlinkChunk(s *nl.NetlinkSocket, ops []*netlinkOp) ([]error, error) {
+	pending := make(map[uint32]*netlinkOp, len(ops))
+	var buf []byte
+	for _, op := range ops {
+		buf = append(buf, op.request.Serialize()...)
+		pending[op.request.Seq] = op
+	}
+
+	if err := unix.Sendto(s.GetFd(), buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("error sending netlink batch: %w", err)
+	}
+
+	var errs []error
+	for len(pending) != 0 {
+		msgs, from, err := s.Receive()
+		if err != nil {
+			return errs, fmt.Errorf("error receiving netlink acks (%d outstanding): %w", len(pending), err)
+		}
+		if from.Pid != nl.PidKernel {
+			continue
+		}
+		for _, m := range msgs {
+			op := pending[m.Header.Seq]
+			if op == nil || m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			delete(pending, m.Header.Seq)
+
+			if len(m.Data) < 4 {
+				errs = append(errs, fmt.Errorf("%s: short netlink ack", op.description))
+				continue
+			}
+			if errno := int32(nl.NativeEndian().Uint32(m.Data[0:4])); errno != 0 {
+				errs = append(errs, fmt.Errorf("%s: %w", op.description, syscall.Errno(-errno)))
+			}
+		}
+	}
+	return errs, nil
+}
+
+// serializeRoute encodes route the same way as netlink.RouteAdd does, for the attributes we use
+func serializeRoute(req *nl.NetlinkRequest, route *netlink.Route) error {
+	if route.Dst == nil || route.Dst.IP == nil {
+		return fmt.Errorf("route must have a dst")
+	}
+	if len(route.MultiPath) != 0 || route.Encap != nil || route.MPLSDst != nil || route.NewDst != nil {
+		return fmt.Errorf("multipath, encap and MPLS routes are not supported")
+	}
+
+	native := nl.NativeEndian()
+	msg := nl.NewRtMsg()
+	var attrs []*nl.RtAttr
+
+	family := nl.GetIPFamily(route.Dst.IP)
+	ipBytes := func(ip net.IP) []byte {
+		if family == netlink.FAMILY_V4 {
+			return ip.To4()
+		}
+		return ip.To16()
+	}
+
+	dstLen, _ := route.Dst.Mask.Size()
+	msg.Dst_len = uint8(dstLen)
+	attrs = append(attrs, nl.NewRtAttr(unix.RTA_DST, ipBytes(route.Dst.IP)))
+
+	if route.Src != nil {
+		if nl.GetIPFamily(route.Src) != family {
+			return fmt.Errorf("source and destination ip are not the same IP family")
+		}
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_PREFSRC, ipBytes(route.Src)))
+	}
+	if route.Gw != nil {
+		if nl.GetIPFamily(route.Gw) != family {
+			return fmt.Errorf("gateway and destination ip are not the same IP family")
+		}
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_GATEWAY, ipBytes(route.Gw)))
+	}
+
+	if route.Table > 0 {
+		if route.Table >= 256 {
+			msg.Table = unix.RT_TABLE_UNSPEC
+			attrs = append(attrs, nl.NewRtAttr(unix.RTA_TABLE, nl.Uint32Attr(uint32(route.Table))))
+		} else {
+			msg.Table = uint8(route.Table)
+		}
+	}
+	if route.Priority > 0 {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_PRIORITY, nl.Uint32Attr(uint32(route.Priority))))
+	}
+	if route.Tos > 0 {
+		msg.Tos = uint8(route.Tos)
+	}
+	if route.Protocol > 0 {
+		msg.Protocol = uint8(route.Protocol)
+	}
+	if route.Type > 0 {
+		msg.Type = uint8(route.Type)
+	}
+
+	var metrics []*nl.RtAttr
+	if route.MTU > 0 {
+		metrics = append(metrics, nl.NewRtAttr(unix.RTAX_MTU, nl.Uint32Attr(uint32(route.MTU))))
+	}
+	if route.AdvMSS > 0 {
+		metrics = append(metrics, nl.NewRtAttr(unix.RTAX_ADVMSS, nl.Uint32Attr(uint32(route.AdvMSS))))
+	}
+	if route.Hoplimit > 0 {
+		metrics = append(metrics, nl.NewRtAttr(unix.RTAX_HOPLIMIT, nl.Uint32Attr(uint32(route.Hoplimit))))
+	}
+	if metrics != nil {
+		attr := nl.NewRtAttr(unix.RTA_METRICS, nil)
+		for _, metric := range metrics {
+			attr.AddChild(metric)
+		}
+		attrs = append(attrs, attr)
+	}
+
+	msg.Flags = uint32(route.Flags)
+	msg.Scope = uint8(route.Scope)
+	msg.Family = uint8(family)
+	req.AddData(msg)
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+
+	b := make([]byte, 4)
+	native.PutUint32(b, uint32(route.LinkIndex))
+	req.AddData(nl.NewRtAttr(unix.RTA_OIF, b))
+	return nil
+}
+
+// serializeNeigh encodes neigh the same way as netlink.NeighSet does, for the attributes we use
+func serializeNeigh(req *nl.NetlinkRequest, neigh *netlink.Neigh) error {
+	if neigh.IP == nil {
+		return fmt.Errorf("neigh must have an IP")
+	}
+	if neigh.LLIPAddr != nil || neigh.Vlan != 0 || neigh.VNI != 0 {
+		return fmt.Errorf("LLIPAddr, Vlan and VNI are not supported")
+	}
+
+	family := neigh.Family
+	if family == 0 {
+		family = nl.GetIPFamily(neigh.IP)
+	}
+
+	req.AddData(&netlink.Ndmsg{
+		Family: uint8(family),
+		Index:  uint32(neigh.LinkIndex),
+		State:  uint16(neigh.State),
+		Type:   uint8(neigh.Type),
+		Flags:  uint8(neigh.Flags),
+	})
+
+	ipData := neigh.IP.To4()
+	if ipData == nil {
+		ipData = neigh.IP.To16()
+	}
+	req.AddData(nl.NewRtAttr(netlink.NDA_DST, ipData))
+
+	if neigh.HardwareAddr != nil {
+		req.AddData(nl.NewRtAttr(netlink.NDA_LLADDR, []byte(neigh.HardwareAddr)))
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"kope.io/networking/pkg/testutil"
+)
+
+func TestNetlinkBatchRoutes(t *testing.T) {
+	testutil.EnterNetNS(t)
+
+	link := setupTestLink(t, "veth0", "10.1.0.1/24")
+
+	good1 := buildTestRoute(link, syscall.RT_TABLE_MAIN, "10.2.0.0/24", "10.1.0.2")
+	good2 := buildTestRoute(link, 1000, "10.3.0.0/24", "10.1.0.3")
+	good2.Priority = 10
+	bad := buildTestRoute(link, syscall.RT_TABLE_MAIN, "10.4.0.0/24", "10.1.0.4")
+	bad.LinkIndex = 9999
+
+	batch := &NetlinkBatch{}
+	for _, r := range []*netlink.Route{good1, bad, good2} {
+		if err := batch.RouteAdd(r); err != nil {
+			t.Fatalf("error queueing route: %v", err)
+		}
+	}
+
+	// The failing route is reported, but does not stop the routes after it
+	err := batch.Flush()
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 netlink operations failed") || !strings.Contains(err.Error(), "10.4.0.0/24") {
+		t.Fatalf("unexpected error from Flush: %v", err)
+	}
+	if batch.Len() != 0 {
+		t.Errorf("batch was not emptied by Flush")
+	}
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{LinkIndex: link.Attrs().Index}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_OIF)
+	if err != nil {
+		t.Fatalf("error listing routes: %v", err)
+	}
+	found := 0
+	for i := range routes {
+		a := &routes[i]
+		for _, e := range []*netlink.Route{good1, good2} {
+			if ipnetEqual(a.Dst, e.Dst) {
+				if !routeEqual(a, e) {
+					t.Errorf("route not programmed as expected:\n\ta: %v\n\te: %v", a, e)
+				}
+				found++
+			}
+		}
+	}
+	if found != 2 {
+		t.Errorf("expected 2 routes, found %d in %v", found, routes)
+	}
+
+	// Deletes are applied in order with adds
+	if err := batch.RouteDel(good1); err != nil {
+		t.Fatalf("error queueing route: %v", err)
+	}
+	if err := batch.RouteAdd(good1); err != nil {
+		t.Fatalf("error queueing route: %v", err)
+	}
+	if err := batch.Flush(); err != nil {
+		t.Fatalf("unexpected error from Flush: %v", err)
+	}
+}
+
+func TestNetlinkBatchNeighs(t *testing.T) {
+	testutil.EnterNetNS(t)
+
+	link := setupTestLink(t, "veth0", "10.1.0.1/24")
+
+	var expected []*netlink.Neigh
+	batch := &NetlinkBatch{}
+	for i := 0; i < 300; i++ {
+		n := buildTestNeigh(link, i)
+		expected = append(expected, n)
+		if err := batch.NeighSet(n); err != nil {
+			t.Fatalf("error queueing neigh: %v", err)
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		t.Fatalf("unexpected error from Flush: %v", err)
+	}
+
+	actual, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatalf("error listing neighbours: %v", err)
+	}
+	actualMap := make(map[string]*netlink.Neigh)
+	for i := range actual {
+		actualMap[actual[i].IP.String()] = &actual[i]
+	}
+	for _, e := range expected {
+		a := actualMap[e.IP.String()]
+		if a == nil {
+			t.Errorf("neighbour %s not found", e.IP)
+			continue
+		}
+		if !a.IP.Equal(e.IP) || a.HardwareAddr.String() != e.HardwareAddr.String() || a.State != e.State {
+			t.Errorf("neighbour not programmed as expected:\n\ta: %v\n\te: %v", a, e)
+		}
+	}
+}
+
+func buildTestNeigh(link netlink.Link, i int) *netlink.Neigh {
+	mac, err := net.ParseMAC(fmt.Sprintf("00:53:00:00:%02x:%02x", i/256, i%256))
+	if err != nil {
+		panic(err)
+	}
+	return &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       netlink.FAMILY_V4,
+		State:        netlink.NUD_PERMANENT,
+		Type:         syscall.RTN_UNICAST,
+		IP:           net.IPv4(10, 1, byte(1+i/256), byte(i%256)),
+		HardwareAddr: mac,
+	}
+}
+
+const benchmarkEntries = 1000
+
+func buildBenchmarkRoutes(link netlink.Link) []*netlink.Route {
+	var routes []*netlink.Route
+	for i := 0; i < benchmarkEntries; i++ {
+		dst := fmt.Sprintf("100.%d.%d.0/24", 64+i/256, i%256)
+		routes = append(routes, buildTestRoute(link, syscall.RT_TABLE_MAIN, dst, "10.1.0.2"))
+	}
+	return routes
+}
+
+// BenchmarkRouteProgramming compares one syscall per route with the pipelined NetlinkBatch
+func BenchmarkRouteProgramming(b *testing.B) {
+	b.Run("individual", func(b *testing.B) {
+		testutil.EnterNetNS(b)
+		routes := buildBenchmarkRoutes(setupTestLink(b, "veth0", "10.1.0.1/24"))
+		b.ResetTimer()
+
+		for n := 0; n < b.N; n++ {
+			for _, r := range routes {
+				if err := netlink.RouteReplace(r); err != nil {
+					b.Fatalf("error replacing route: %v", err)
+				}
+			}
+		}
+	})
+
+	b.Run("batched", func(b *testing.B) {
+		testutil.EnterNetNS(b)
+		routes := buildBenchmarkRoutes(setupTestLink(b, "veth0", "10.1.0.1/24"))
+		b.ResetTimer()
+
+		for n := 0; n < b.N; n++ {
+			batch := &NetlinkBatch{}
+			for _, r := range routes {
+				if err := batch.RouteReplace(r); err != nil {
+					b.Fatalf("error queueing route: %v", err)
+				}
+			}
+			if err := batch.Flush(); err != nil {
+				b.Fatalf("error applying routes: %v", err)
+			}
+		}
+	})
+}
+
+// BenchmarkNeighProgramming compares one syscall per neighbour entry with the pipelined NetlinkBatch
+func BenchmarkNeighProgramming(b *testing.B) {
+	b.Run("individual", func(b *testing.B) {
+		testutil.EnterNetNS(b)
+		link := setupTestLink(b, "veth0", "10.1.0.1/16")
+		b.ResetTimer()
+
+		for n := 0; n < b.N; n++ {
+			for i := 0; i < benchmarkEntries; i++ {
+				if err := netlink.NeighSet(buildTestNeigh(link, i)); err != nil {
+					b.Fatalf("error setting neigh: %v", err)
+				}
+			}
+		}
+	})
+
+	b.Run("batched", func(b *testing.B) {
+		testutil.EnterNetNS(b)
+		link := setupTestLink(b, "veth0", "10.1.0.1/16")
+		b.ResetTimer()
+
+		for n := 0; n < b.N; n++ {
+			batch := &NetlinkBatch{}
+			for i := 0; i < benchmarkEntries; i++ {
+				if err := batch.NeighSet(buildTestNeigh(link, i)); err != nil {
+					b.Fatalf("error queueing neigh: %v", err)
+				}
+			}
+			if err := batch.Flush(); err != nil {
+				b.Fatalf("error applying neighbours: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,361 @@
+package netutil
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"k8s.io/klog/v2"
+	"kope.io/networking/pkg/util"
+)
+
+// NftTable reconciles a single nftables table, which we own entirely, or a section of a table that is shared with other NftTables.
+// The table (or our section of it) is replaced in a single netlink batch, so the kernel applies the change atomically.
+type NftTable struct {
+	family nftables.TableFamily
+	name   string
+
+	// owns reports whether a chain or set in the table belongs to us; if nil we own the whole table
+	owns func(name string) bool
+
+	// netns is the fd of the network namespace to configure; 0 means the current namespace
+	netns int
+
+	lastApplied string
+}
+
+// NftState is the expected contents of an NftTable
+type NftState struct {
+	Sets   []*NftSet
+	Chains []*NftChain
+}
+
+// NftSet is a named set in the table
+type NftSet struct {
+	Name     string
+	KeyType  nftables.SetDatatype
+	Interval bool
+	Elements []nftables.SetElement
+}
+
+// NftChain is a chain in the table; base chains have a Hook, Type and Priority
+type NftChain struct {
+	Name     string
+	Type     nftables.ChainType
+	Hook     *nftables.ChainHook
+	Priority *nftables.ChainPriority
+	Policy   *nftables.ChainPolicy
+	Rules    []*NftRule
+}
+
+// NftRule is a rule in a chain; expr.Lookup expressions can reference sets in the table by name.
+type NftRule struct {
+	Exprs []expr.Any
+}
+
+// NewNftTable builds an NftTable that owns the table with the given family and name
+func NewNftTable(family nftables.TableFamily, name string) *NftTable {
+	return &NftTable{
+		family: family,
+		name:   name,
+	}
+}
+
+// NewNftTableSection builds an NftTable that owns the chains and sets for which owns returns true, in the table with the given family and name.
+// Several sections can share a table, as long as their chains and sets have different names.
+func NewNftTableSection(family nftables.TableFamily, name string, owns func(name string) bool) *NftTable {
+	return &NftTable{
+		family: family,
+		name:   name,
+		owns:   owns,
+	}
+}
+
+// nftContents is what we found in the kernel for an NftTable
+type nftContents struct {
+	// table is nil if the table does not exist
+	table *nftables.Table
+
+	// chains and sets are the ones that we own
+	chains []*nftables.Chain
+	sets   []*nftables.Set
+
+	// foreign is true if the table also holds chains or sets that we do not own
+	foreign bool
+}
+
+// Ensure replaces the contents of the table (or our section of it) with expected, if they differ.
+// We compare against the last state we applied, and check that the table still has the expected chains, sets and rule counts;
+// this detects the table being flushed or edited by something else without having to decode the kernel's expressions.
+func (t *NftTable) Ensure(expected *NftState) error {
+	key := expected.fingerprint()
+
+	conn := &nftables.Conn{NetNS: t.netns}
+
+	actual, err := t.listActual(conn)
+	if err != nil {
+		return err
+	}
+
+	if key == t.lastApplied {
+		matches, err := t.actualMatches(conn, actual, expected)
+		if err != nil {
+			return err
+		}
+		if matches {
+			return nil
+		}
+		klog.Warningf("nftables table %q was changed outside of our control; will replace", t.name)
+	}
+
+	table := &nftables.Table{
+		Name:   t.name,
+		Family: t.family,
+	}
+
+	if t.owns == nil {
+		// Adding the table first ensures the delete succeeds even if the table does not exist.
+		conn.AddTable(table)
+		conn.DelTable(table)
+		conn.AddTable(table)
+	} else {
+		conn.AddTable(table)
+		t.deleteOwned(conn, table, actual)
+	}
+
+	setIDs := make(map[string]uint32)
+	for _, e := range expected.Sets {
+		set := &nftables.Set{
+			Table:    table,
+			Name:     e.Name,
+			KeyType:  e.KeyType,
+			Interval: e.Interval,
+		}
+		if err := conn.AddSet(set, e.Elements); err != nil {
+			return fmt.Errorf("error building nftables set %q: %w", e.Name, err)
+		}
+		setIDs[set.Name] = set.ID
+	}
+
+	// We create all the chains before any rules, so rules can jump to chains defined later
+	chains := make([]*nftables.Chain, len(expected.Chains))
+	for i, e := range expected.Chains {
+		chains[i] = conn.AddChain(&nftables.Chain{
+			Name:     e.Name,
+			Table:    table,
+			Type:     e.Type,
+			Hooknum:  e.Hook,
+			Priority: e.Priority,
+			Policy:   e.Policy,
+		})
+	}
+
+	for i, e := range expected.Chains {
+		chain := chains[i]
+		for _, r := range e.Rules {
+			exprs := make([]expr.Any, 0, len(r.Exprs))
+			for _, x := range r.Exprs {
+				// Sets created in the same batch are referenced by ID; we copy so we don't change the caller's state
+				if lookup, ok := x.(*expr.Lookup); ok {
+					if id, found := setIDs[lookup.SetName]; found {
+						l := *lookup
+						l.SetID = id
+						x = &l
+					}
+				}
+				exprs = append(exprs, x)
+			}
+			conn.AddRule(&nftables.Rule{
+				Table: table,
+				Chain: chain,
+				Exprs: exprs,
+			})
+		}
+	}
+
+	klog.Infof("NETLINK: nft replace table %s (%d sets, %d chains)", t.name, len(expected.Sets), len(expected.Chains))
+	klog.V(4).Infof("Expected nftables table %s:\n%s", t.name, key)
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("error applying nftables table %q: %w", t.name, err)
+	}
+
+	t.lastApplied = key
+	return nil
+}
+
+// Delete removes the table (or our section of it), if it exists; a shared table is removed once it is empty.
+func (t *NftTable) Delete() error {
+	conn := &nftables.Conn{NetNS: t.netns}
+
+	table := &nftables.Table{
+		Name:   t.name,
+		Family: t.family,
+	}
+
+	if t.owns != nil {
+		actual, err := t.listActual(conn)
+		if err != nil {
+			return err
+		}
+		if actual.table == nil || (actual.foreign && len(actual.chains) == 0 && len(actual.sets) == 0) {
+			t.lastApplied = ""
+			return nil
+		}
+		if actual.foreign {
+			t.deleteOwned(conn, table, actual)
+			klog.Infof("NETLINK: nft delete %d chains and %d sets from table %s", len(actual.chains), len(actual.sets), t.name)
+			if err := conn.Flush(); err != nil {
+				return fmt.Errorf("error deleting from nftables table %q: %w", t.name, err)
+			}
+			t.lastApplied = ""
+			return nil
+		}
+	}
+
+	// As in Ensure, adding the table first ensures the delete succeeds even if the table does not exist.
+	conn.AddTable(table)
+	conn.DelTable(table)
+
+	klog.Infof("NETLINK: nft delete table %s", t.name)
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("error deleting nftables table %q: %w", t.name, err)
+	}
+
+	t.lastApplied = ""
+	return nil
+}
+
+// fingerprint returns a string that changes when the state changes.
+// We include the expression types, because different expressions can have the same fields.
+func (s *NftState) fingerprint() string {
+	var b strings.Builder
+	for _, set := range s.Sets {
+		fmt.Fprintf(&b, "set %s\n", util.AsJsonString(set))
+	}
+	for _, chain := range s.Chains {
+		fmt.Fprintf(&b, "chain %s %s %s %s %s\n", chain.Name, chain.Type, util.AsJsonString(chain.Hook), util.AsJsonString(chain.Priority), util.AsJsonString(chain.Policy))
+		for _, rule := range chain.Rules {
+			b.WriteString("rule")
+			for _, x := range rule.Exprs {
+				fmt.Fprintf(&b, " %T%s", x, util.AsJsonString(x))
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+// listActual lists the table in the kernel, and the chains and sets in it that we own
+func (t *NftTable) listActual(conn *nftables.Conn) (*nftContents, error) {
+	klog.V(4).Infof("NETLINK: nft list table %s", t.name)
+
+	actual := &nftContents{}
+
+	tables, err := conn.ListTablesOfFamily(t.family)
+	if err != nil {
+		return nil, fmt.Errorf("error listing nftables tables: %w", err)
+	}
+	for _, a := range tables {
+		if a.Name == t.name {
+			actual.table = a
+		}
+	}
+	if actual.table == nil {
+		return actual, nil
+	}
+
+	sets, err := conn.GetSets(actual.table)
+	if err != nil {
+		return nil, fmt.Errorf("error listing sets in nftables table %q: %w", t.name, err)
+	}
+	for _, a := range sets {
+		if t.owns != nil && !t.owns(a.Name) {
+			actual.foreign = true
+			continue
+		}
+		actual.sets = append(actual.sets, a)
+	}
+
+	chains, err := conn.ListChainsOfTableFamily(t.family)
+	if err != nil {
+		return nil, fmt.Errorf("error listing nftables chains: %w", err)
+	}
+	for _, a := range chains {
+		if a.Table.Name != t.name {
+			continue
+		}
+		if t.owns != nil && !t.owns(a.Name) {
+			actual.foreign = true
+			continue
+		}
+		actual.chains = append(actual.chains, a)
+	}
+
+	return actual, nil
+}
+
+// deleteOwned queues the removal of the chains and sets that we own from a shared table.
+// We flush all the chains before deleting any, so that jumps between them and lookups of our sets do not keep them in use.
+func (t *NftTable) deleteOwned(conn *nftables.Conn, table *nftables.Table, actual *nftContents) {
+	for _, a := range actual.chains {
+		conn.FlushChain(&nftables.Chain{Name: a.Name, Table: table})
+	}
+	for _, a := range actual.chains {
+		conn.DelChain(&nftables.Chain{Name: a.Name, Table: table})
+	}
+	for _, a := range actual.sets {
+		conn.DelSet(&nftables.Set{Name: a.Name, Table: table})
+	}
+}
+
+// actualMatches checks that our chains and sets in the kernel still have the shape of expected
+func (t *NftTable) actualMatches(conn *nftables.Conn, actual *nftContents, expected *NftState) (bool, error) {
+	if actual.table == nil {
+		return false, nil
+	}
+
+	if len(actual.sets) != len(expected.Sets) {
+		return false, nil
+	}
+	actualSetMap := make(map[string]*nftables.Set)
+	for _, a := range actual.sets {
+		actualSetMap[a.Name] = a
+	}
+	for _, e := range expected.Sets {
+		a := actualSetMap[e.Name]
+		if a == nil {
+			return false, nil
+		}
+		elements, err := conn.GetSetElements(a)
+		if err != nil {
+			return false, fmt.Errorf("error listing elements of nftables set %q: %w", e.Name, err)
+		}
+		if len(elements) != len(e.Elements) {
+			return false, nil
+		}
+	}
+
+	if len(actual.chains) != len(expected.Chains) {
+		return false, nil
+	}
+	actualChains := make(map[string]*nftables.Chain)
+	for _, a := range actual.chains {
+		actualChains[a.Name] = a
+	}
+	for _, e := range expected.Chains {
+		a := actualChains[e.Name]
+		if a == nil {
+			return false, nil
+		}
+		rules, err := conn.GetRules(actual.table, a)
+		if err != nil {
+			return false, fmt.Errorf("error listing rules in nftables chain %q: %w", e.Name, err)
+		}
+		if len(rules) != len(e.Rules) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,264 @@
+package netutil
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"kope.io/networking/pkg/testutil"
+)
+
+func buildTestNftState(elements ...string) *NftState {
+	set := &NftSet{
+		Name:    "addresses",
+		KeyType: nftables.TypeIPAddr,
+	}
+	for _, e := range elements {
+		set.Elements = append(set.Elements, nftables.SetElement{Key: net.ParseIP(e).To4()})
+	}
+
+	chain := &NftChain{
+		Name:     "input",
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Rules: []*NftRule{
+			{
+				// ip saddr @addresses counter accept
+				Exprs: []expr.Any{
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+					&expr.Lookup{SourceRegister: 1, SetName: set.Name},
+					&expr.Counter{},
+					&expr.Verdict{Kind: expr.VerdictAccept},
+				},
+			},
+		},
+	}
+
+	return &NftState{
+		Sets:   []*NftSet{set},
+		Chains: []*NftChain{chain},
+	}
+}
+
+func TestNftTableEnsure(t *testing.T) {
+	ns := testutil.EnterNetNS(t)
+
+	table := NewNftTable(nftables.TableFamilyIPv4, "kopeio-test")
+	table.netns = int(ns)
+
+	conn := &nftables.Conn{NetNS: int(ns)}
+
+	if err := table.Ensure(buildTestNftState("10.0.0.1", "10.0.0.2")); err != nil {
+		t.Fatalf("error from Ensure: %v", err)
+	}
+
+	chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("error listing chains: %v", err)
+	}
+	if len(chains) != 1 || chains[0].Name != "input" || chains[0].Table.Name != "kopeio-test" {
+		t.Fatalf("unexpected chains after Ensure: %+v", chains)
+	}
+	rules, err := conn.GetRules(chains[0].Table, chains[0])
+	if err != nil {
+		t.Fatalf("error listing rules: %v", err)
+	}
+	if len(rules) != 1 {
+		t.Fatalf("expected 1 rule, got %d", len(rules))
+	}
+	handle := rules[0].Handle
+
+	// Applying the same state should not replace the table
+	if err := table.Ensure(buildTestNftState("10.0.0.1", "10.0.0.2")); err != nil {
+		t.Fatalf("error from second Ensure: %v", err)
+	}
+	rules, err = conn.GetRules(chains[0].Table, chains[0])
+	if err != nil {
+		t.Fatalf("error listing rules: %v", err)
+	}
+	if len(rules) != 1 || rules[0].Handle != handle {
+		t.Errorf("expected rule to be unchanged when state is unchanged; got %+v", rules)
+	}
+
+	// Changing the state should replace the set contents
+	if err := table.Ensure(buildTestNftState("10.0.0.3")); err != nil {
+		t.Fatalf("error from Ensure with changed state: %v", err)
+	}
+	set, err := conn.GetSetByName(chains[0].Table, "addresses")
+	if err != nil {
+		t.Fatalf("error getting set: %v", err)
+	}
+	elements, err := conn.GetSetElements(set)
+	if err != nil {
+		t.Fatalf("error getting set elements: %v", err)
+	}
+	if len(elements) != 1 || !net.IP(elements[0].Key).Equal(net.ParseIP("10.0.0.3")) {
+		t.Errorf("unexpected set elements after change: %+v", elements)
+	}
+}
+
+func TestNftTableRepairsExternalChanges(t *testing.T) {
+	ns := testutil.EnterNetNS(t)
+
+	table := NewNftTable(nftables.TableFamilyIPv4, "kopeio-test")
+	table.netns = int(ns)
+
+	conn := &nftables.Conn{NetNS: int(ns)}
+
+	if err := table.Ensure(buildTestNftState("10.0.0.1")); err != nil {
+		t.Fatalf("error from Ensure: %v", err)
+	}
+
+	// Simulate `nft flush ruleset`
+	conn.FlushRuleset()
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("error flushing ruleset: %v", err)
+	}
+
+	if err := table.Ensure(buildTestNftState("10.0.0.1")); err != nil {
+		t.Fatalf("error from Ensure after flush: %v", err)
+	}
+
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("error listing tables: %v", err)
+	}
+	if len(tables) != 1 || tables[0].Name != "kopeio-test" {
+		t.Fatalf("expected table to be recreated, got %+v", tables)
+	}
+	rules, err := conn.GetRules(tables[0], &nftables.Chain{Name: "input", Table: tables[0]})
+	if err != nil {
+		t.Fatalf("error listing rules: %v", err)
+	}
+	if len(rules) != 1 {
+		t.Errorf("expected 1 rule after repair, got %d", len(rules))
+	}
+}
+
+func TestNftTableDelete(t *testing.T) {
+	ns := testutil.EnterNetNS(t)
+
+	table := NewNftTable(nftables.TableFamilyIPv4, "kopeio-test")
+	table.netns = int(ns)
+
+	conn := &nftables.Conn{NetNS: int(ns)}
+
+	// Deleting a table that does not exist is not an error
+	if err := table.Delete(); err != nil {
+		t.Fatalf("error from Delete of missing table: %v", err)
+	}
+
+	if err := table.Ensure(buildTestNftState("10.0.0.1")); err != nil {
+		t.Fatalf("error from Ensure: %v", err)
+	}
+	if err := table.Delete(); err != nil {
+		t.Fatalf("error from Delete: %v", err)
+	}
+
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("error listing tables: %v", err)
+	}
+	if len(tables) != 0 {
+		t.Errorf("expected table to be deleted, got %+v", tables)
+	}
+
+	// Ensure after Delete recreates the table, even though the state is unchanged
+	if err := table.Ensure(buildTestNftState("10.0.0.1")); err != nil {
+		t.Fatalf("error from Ensure after Delete: %v", err)
+	}
+	tables, err = conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("error listing tables: %v", err)
+	}
+	if len(tables) != 1 {
+		t.Errorf("expected table to be recreated, got %+v", tables)
+	}
+}
+
+// buildTestNftSection is buildTestNftState with the set and chain names prefixed, so that several sections can share a table
+func buildTestNftSection(prefix string, elements ...string) *NftState {
+	state := buildTestNftState(elements...)
+	state.Sets[0].Name = prefix + state.Sets[0].Name
+	state.Chains[0].Name = prefix + state.Chains[0].Name
+	state.Chains[0].Rules[0].Exprs[1].(*expr.Lookup).SetName = state.Sets[0].Name
+	return state
+}
+
+func TestNftTableSections(t *testing.T) {
+	ns := testutil.EnterNetNS(t)
+
+	newSection := func(prefix string) *NftTable {
+		table := NewNftTableSection(nftables.TableFamilyIPv4, "kopeio-test", func(name string) bool {
+			return strings.HasPrefix(name, prefix)
+		})
+		table.netns = int(ns)
+		return table
+	}
+	a := newSection("a-")
+	b := newSection("b-")
+
+	conn := &nftables.Conn{NetNS: int(ns)}
+
+	listChains := func() []string {
+		chains, err := conn.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+		if err != nil {
+			t.Fatalf("error listing chains: %v", err)
+		}
+		var names []string
+		for _, chain := range chains {
+			names = append(names, chain.Table.Name+"/"+chain.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if err := a.Ensure(buildTestNftSection("a-", "10.0.0.1")); err != nil {
+		t.Fatalf("error from Ensure of a: %v", err)
+	}
+	if err := b.Ensure(buildTestNftSection("b-", "10.0.0.2")); err != nil {
+		t.Fatalf("error from Ensure of b: %v", err)
+	}
+
+	// Replacing one section must not touch the other
+	if err := a.Ensure(buildTestNftSection("a-", "10.0.0.3")); err != nil {
+		t.Fatalf("error from Ensure of a with changed state: %v", err)
+	}
+	if got, want := listChains(), []string{"kopeio-test/a-input", "kopeio-test/b-input"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected chains after Ensure: got %v, want %v", got, want)
+	}
+	table := &nftables.Table{Name: "kopeio-test", Family: nftables.TableFamilyIPv4}
+	for _, name := range []string{"a-addresses", "b-addresses"} {
+		if _, err := conn.GetSetByName(table, name); err != nil {
+			t.Errorf("error getting set %q: %v", name, err)
+		}
+	}
+
+	// Deleting a section leaves the table while another section is in it
+	if err := a.Delete(); err != nil {
+		t.Fatalf("error from Delete of a: %v", err)
+	}
+	if got, want := listChains(), []string{"kopeio-test/b-input"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected chains after Delete of a: got %v, want %v", got, want)
+	}
+	if err := b.Delete(); err != nil {
+		t.Fatalf("error from Delete of b: %v", err)
+	}
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("error listing tables: %v", err)
+	}
+	if len(tables) != 0 {
+		t.Errorf("expected table to be deleted with its last section, got %+v", tables)
+	}
+
+	// Deleting a section of a table that does not exist is not an error
+	if err := a.Delete(); err != nil {
+		t.Fatalf("error from Delete of missing table: %v", err)
+	}
+}
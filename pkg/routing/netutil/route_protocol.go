@@ -0,0 +1,51 @@
+package netutil
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog/v2"
+)
+
+// RouteProtocol is the rtm_protocol value we set on every route we install.
+// Routes with any other protocol (kernel, boot, static, other daemons) are never deleted by RouteTable.
+const RouteProtocol = 107
+
+// RouteProtocolName is the name we register for RouteProtocol, so that `ip route` shows `proto kopeio`
+const RouteProtocolName = "kopeio"
+
+// RouteProtocolsDir is the directory from which iproute2 reads additional protocol names
+const RouteProtocolsDir = "/etc/iproute2/rt_protos.d"
+
+// RegisterRouteProtocol writes the iproute2 protocol name mapping for RouteProtocol into dir.
+// This is cosmetic: routes are identified by number, so failure here does not affect reconciliation.
+func RegisterRouteProtocol(dir string) error {
+	p := filepath.Join(dir, RouteProtocolName+".conf")
+	data := []byte(fmt.Sprintf("%d\t%s\n", RouteProtocol, RouteProtocolName))
+
+	existing, err := os.ReadFile(p)
+	if err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating directory %q: %w", dir, err)
+	}
+
+	klog.Infof("registering route protocol %d as %q in %s", RouteProtocol, RouteProtocolName, p)
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		return fmt.Errorf("error writing file %q: %w", p, err)
+	}
+	return nil
+}
+
+// UnregisterRouteProtocol removes the mapping written by RegisterRouteProtocol, if it exists
+func UnregisterRouteProtocol(dir string) error {
+	p := filepath.Join(dir, RouteProtocolName+".conf")
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing file %q: %w", p, err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package netutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegisterRouteProtocol(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "rt_protos.d")
+
+	// Registration is idempotent, and creates the directory if needed
+	for i := 0; i < 2; i++ {
+		if err := RegisterRouteProtocol(dir); err != nil {
+			t.Fatalf("error from RegisterRouteProtocol: %v", err)
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "kopeio.conf"))
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if got, want := string(b), "107\tkopeio\n"; got != want {
+		t.Errorf("unexpected file contents; got %q, want %q", got, want)
+	}
+}
+
+func TestUnregisterRouteProtocol(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "rt_protos.d")
+
+	// Unregistering when not registered is not an error
+	if err := UnregisterRouteProtocol(dir); err != nil {
+		t.Fatalf("error from UnregisterRouteProtocol: %v", err)
+	}
+
+	if err := RegisterRouteProtocol(dir); err != nil {
+		t.Fatalf("error from RegisterRouteProtocol: %v", err)
+	}
+	if err := UnregisterRouteProtocol(dir); err != nil {
+		t.Fatalf("error from UnregisterRouteProtocol: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "kopeio.conf")); !os.IsNotExist(err) {
+		t.Errorf("expected file to be removed, got %v", err)
+	}
+}
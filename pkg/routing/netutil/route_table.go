@@ -2,51 +2,103 @@ package netutil
 
 import (
 	"fmt"
+	"syscall"
 
 	"github.com/vishvananda/netlink"
 	"k8s.io/klog/v2"
 	"kope.io/networking/pkg/util"
 )
 
+// RouteTable reconciles the routes we own in one or more routing tables
 type RouteTable struct {
+	// Tables are the routing tables we manage; if empty, we manage only the main table
+	Tables []int
+
+	// Owns restricts the routes we remove as extra routes to those for which it returns true; optional.
+	// It lets a provider share a link with routes that another provider installed with RouteProtocol.
+	Owns func(route *netlink.Route) bool
+
+	// LegacyBootRoute recognises the routes that versions before RouteProtocol installed with RTPROT_BOOT; optional.
+	// The first time Ensure removes extra routes, it also removes the unexpected boot routes for which it returns true,
+	// so that routes to nodes deleted before the upgrade do not leak.
+	LegacyBootRoute func(route *netlink.Route) bool
+
+	// bootRoutesMigrated is set once Ensure has removed the legacy boot routes
+	bootRoutesMigrated bool
 }
 
-func (t *RouteTable) Ensure(link netlink.Link, expected []*netlink.Route, deleteExtraRoutes bool) error {
-	klog.V(2).Infof("NETLINK: ip route show")
-	actualList, err := netlink.RouteList(link, netlink.FAMILY_ALL)
-	if err != nil {
-		return fmt.Errorf("error doing `ip route show`: %v", err)
-	}
+// routeKey identifies a route the way the kernel does: two routes with the same key cannot coexist
+type routeKey struct {
+	table    int
+	dst      string
+	tos      int
+	priority int
+}
 
-	klog.V(2).Infof("TODO: using strings as ipnet key is inefficient")
-	actualMap := make(map[string]*netlink.Route)
-	for i := range actualList {
-		a := &actualList[i]
-		if a.Dst == nil {
-			// Probably the default gateway
-			klog.V(2).Infof("ignoring route with no dst: %v", util.AsJsonString(a))
-			continue
-		}
-		k := a.Dst.String()
-		actualMap[k] = a
-		klog.V(4).Infof("Actual route: %v", util.AsJsonString(a))
+func (k routeKey) String() string {
+	return fmt.Sprintf("%s table %d tos %d metric %d", k.dst, k.table, k.tos, k.priority)
+}
+
+func keyForRoute(r *netlink.Route) routeKey {
+	return routeKey{
+		table:    normalizeTable(r.Table),
+		dst:      r.Dst.String(),
+		tos:      r.Tos,
+		priority: r.Priority,
 	}
+}
 
-	expectedMap := make(map[string]*netlink.Route)
+// normalizeTable maps the unspecified table to the main table, which is where the kernel puts such routes
+func normalizeTable(table int) int {
+	if table == syscall.RT_TABLE_UNSPEC {
+		return syscall.RT_TABLE_MAIN
+	}
+	return table
+}
 
-	var create []*netlink.Route
-	var remove []*netlink.Route
+// Ensure makes the routes in our tables match expected.
+// If link is non-nil, only routes via that link are considered.
+// If deleteExtraRoutes is true, routes we installed (those with RouteProtocol, and accepted by Owns) that are not expected are removed.
+func (t *RouteTable) Ensure(link netlink.Link, expected []*netlink.Route, deleteExtraRoutes bool) error {
+	tables := make(map[int]bool)
+	for _, table := range t.Tables {
+		tables[normalizeTable(table)] = true
+	}
+	if len(tables) == 0 {
+		tables[syscall.RT_TABLE_MAIN] = true
+	}
 
+	expectedMap := make(map[routeKey]*netlink.Route)
 	for _, e := range expected {
 		if e.Dst == nil {
 			return fmt.Errorf("expected route did not have dst: %v", util.AsJsonString(e))
 		}
-		k := e.Dst.String()
+		if e.Protocol != RouteProtocol {
+			return fmt.Errorf("expected route did not have protocol %d: %v", RouteProtocol, util.AsJsonString(e))
+		}
+		k := keyForRoute(e)
+		if !tables[k.table] {
+			return fmt.Errorf("expected route is in table %d, which we do not manage: %v", k.table, util.AsJsonString(e))
+		}
+		if expectedMap[k] != nil {
+			return fmt.Errorf("duplicate expected route for %s", k)
+		}
 		expectedMap[k] = e
 		klog.V(4).Infof("Expected route: %v", util.AsJsonString(e))
+	}
+
+	actualMap, err := t.listRoutes(link, tables)
+	if err != nil {
+		return err
+	}
+
+	var create []*netlink.Route
+	var replace []*netlink.Route
+	var remove []*netlink.Route
 
-		// Note that we process expected in order
-		// TODO: I guess we could sort via dependencies?
+	// Note that we process expected in order
+	for _, e := range expected {
+		k := keyForRoute(e)
 		a := actualMap[k]
 
 		if a == nil {
@@ -56,48 +108,117 @@ func (t *RouteTable) Ensure(link netlink.Link, expected []*netlink.Route, delete
 
 		if !routeEqual(a, e) {
 			klog.Infof("change for %s:\n\ta: %s\n\te: %s", k, util.AsJsonString(a), util.AsJsonString(e))
-			remove = append(remove, a)
-			create = append(create, e)
+			replace = append(replace, e)
 		}
 	}
 
 	if deleteExtraRoutes {
+		migrateBootRoutes := t.LegacyBootRoute != nil && !t.bootRoutesMigrated
 		for k, a := range actualMap {
-			e := expectedMap[k]
-
-			if e == nil {
+			if expectedMap[k] != nil {
+				continue
+			}
+			if migrateBootRoutes && a.Protocol == syscall.RTPROT_BOOT && t.LegacyBootRoute(a) {
+				klog.Infof("removing route %s installed by an earlier version", k)
 				remove = append(remove, a)
 				continue
 			}
-		}
-
-		if len(remove) != 0 {
-			for _, r := range remove {
-				klog.Infof("NETLINK: ip route del %v", util.AsJsonString(r))
-				err := netlink.RouteDel(r)
-				if err != nil {
-					return fmt.Errorf("error removing route: %v", err)
-				}
+			if a.Protocol != RouteProtocol {
+				klog.V(4).Infof("ignoring route %s with protocol %d", k, a.Protocol)
+				continue
+			}
+			if t.Owns != nil && !t.Owns(a) {
+				klog.V(4).Infof("ignoring route %s, which is not ours", k)
+				continue
 			}
+			remove = append(remove, a)
 		}
 	}
 
-	if len(create) != 0 {
-		for _, r := range create {
-			klog.Infof("NETLINK: ip route add %s via %s", r.Dst, r.Gw)
-			klog.V(2).Infof(" full route object: %v", util.AsJsonString(r))
-			err := netlink.RouteAdd(r)
-			if err != nil {
-				return fmt.Errorf("error creating route %v: %v", r, err)
-			}
+	batch := &NetlinkBatch{}
+	for _, r := range remove {
+		klog.Infof("NETLINK: ip route del %v", util.AsJsonString(r))
+		if err := batch.RouteDel(r); err != nil {
+			return err
 		}
 	}
+	for _, r := range replace {
+		klog.Infof("NETLINK: ip route replace %s via %s table %d", r.Dst, r.Gw, normalizeTable(r.Table))
+		klog.V(2).Infof(" full route object: %v", util.AsJsonString(r))
+		if err := batch.RouteReplace(r); err != nil {
+			return err
+		}
+	}
+	for _, r := range create {
+		klog.Infof("NETLINK: ip route add %s via %s table %d", r.Dst, r.Gw, normalizeTable(r.Table))
+		klog.V(2).Infof(" full route object: %v", util.AsJsonString(r))
+		if err := batch.RouteAdd(r); err != nil {
+			return err
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		return fmt.Errorf("error applying routes: %w", err)
+	}
 
+	if deleteExtraRoutes {
+		t.bootRoutesMigrated = true
+	}
 	return nil
 }
 
+// listRoutes returns the routes in the given tables, optionally restricted to those via link
+func (t *RouteTable) listRoutes(link netlink.Link, tables map[int]bool) (map[routeKey]*netlink.Route, error) {
+	filter := &netlink.Route{}
+	var filterMask uint64
+
+	if len(tables) == 1 {
+		for table := range tables {
+			filter.Table = table
+		}
+	} else {
+		// RT_TABLE_UNSPEC returns routes from all tables; we filter below
+		filter.Table = syscall.RT_TABLE_UNSPEC
+	}
+	filterMask |= netlink.RT_FILTER_TABLE
+
+	if link != nil {
+		filter.LinkIndex = link.Attrs().Index
+		filterMask |= netlink.RT_FILTER_OIF
+	}
+
+	klog.V(2).Infof("NETLINK: ip route show table %d", filter.Table)
+	actualList, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, filter, filterMask)
+	if err != nil {
+		return nil, fmt.Errorf("error doing `ip route show`: %v", err)
+	}
+
+	actualMap := make(map[routeKey]*netlink.Route)
+	for i := range actualList {
+		a := &actualList[i]
+		if !tables[normalizeTable(a.Table)] {
+			continue
+		}
+		if a.Dst == nil {
+			// Probably the default gateway
+			klog.V(2).Infof("ignoring route with no dst: %v", util.AsJsonString(a))
+			continue
+		}
+		k := keyForRoute(a)
+		if existing := actualMap[k]; existing != nil {
+			// Multiple routes can share a key when they differ in attributes we don't key on (e.g. type);
+			// prefer the one we own so that we reconcile it
+			if existing.Protocol == RouteProtocol || a.Protocol != RouteProtocol {
+				continue
+			}
+		}
+		actualMap[k] = a
+		klog.V(4).Infof("Actual route: %v", util.AsJsonString(a))
+	}
+	return actualMap, nil
+}
+
 func routeEqual(a, e *netlink.Route) bool {
-	if a.LinkIndex != e.LinkIndex || a.ILinkIndex != e.ILinkIndex || a.Scope != e.Scope || a.Protocol != e.Protocol || a.Priority != e.Priority || a.Table != e.Table || a.Type != e.Type || a.Tos != e.Tos || a.Flags != e.Flags {
+	if a.LinkIndex != e.LinkIndex || a.ILinkIndex != e.ILinkIndex || a.Scope != e.Scope || a.Protocol != e.Protocol || a.Priority != e.Priority || normalizeTable(a.Table) != normalizeTable(e.Table) || a.Type != e.Type || a.Tos != e.Tos || a.Flags != e.Flags || a.MTU != e.MTU {
 		return false
 	}
 	if !ipnetEqual(a.Dst, e.Dst) {
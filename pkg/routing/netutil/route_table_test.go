@@ -0,0 +1,220 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"kope.io/networking/pkg/testutil"
+)
+
+// setupTestLink creates a veth pair in the test namespace, and returns the end named name with cidr assigned
+func setupTestLink(t testing.TB, name string, cidr string) netlink.Link {
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "-peer"}
+	if err := netlink.LinkAdd(link); err != nil {
+		t.Fatalf("error creating veth link: %v", err)
+	}
+	if err := netlink.LinkSetUp(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: link.PeerName}}); err != nil {
+		t.Fatalf("error setting peer link up: %v", err)
+	}
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		t.Fatalf("error parsing address: %v", err)
+	}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		t.Fatalf("error adding address: %v", err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		t.Fatalf("error setting link up: %v", err)
+	}
+	actual, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatalf("error getting link: %v", err)
+	}
+	return actual
+}
+
+func buildTestRoute(link netlink.Link, table int, dst string, gw string) *netlink.Route {
+	_, ipnet, err := net.ParseCIDR(dst)
+	if err != nil {
+		panic(err)
+	}
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       ipnet,
+		Gw:        net.ParseIP(gw),
+		Protocol:  RouteProtocol,
+		Table:     table,
+		Type:      syscall.RTN_UNICAST,
+	}
+}
+
+// listTestRoutes returns "table dst via gw proto N" for every route with a gateway
+func listTestRoutes(t *testing.T) []string {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatalf("error listing routes: %v", err)
+	}
+	var out []string
+	for _, r := range routes {
+		if r.Gw == nil {
+			continue
+		}
+		out = append(out, fmt.Sprintf("%s table %d via %s proto %d", r.Dst, r.Table, r.Gw, r.Protocol))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestRouteTableEnsure(t *testing.T) {
+	testutil.EnterNetNS(t)
+
+	link := setupTestLink(t, "veth0", "10.1.0.1/24")
+
+	// A route we don't own, which must never be deleted
+	foreign := buildTestRoute(link, syscall.RT_TABLE_MAIN, "10.200.0.0/16", "10.1.0.254")
+	foreign.Protocol = syscall.RTPROT_BOOT
+	if err := netlink.RouteAdd(foreign); err != nil {
+		t.Fatalf("error adding foreign route: %v", err)
+	}
+
+	routeTable := &RouteTable{Tables: []int{syscall.RT_TABLE_MAIN, 100}}
+
+	// The same destination in two tables must not collide
+	expected := []*netlink.Route{
+		buildTestRoute(link, syscall.RT_TABLE_MAIN, "10.2.0.0/24", "10.1.0.2"),
+		buildTestRoute(link, 100, "10.2.0.0/24", "10.1.0.3"),
+		buildTestRoute(link, 100, "10.3.0.0/24", "10.1.0.3"),
+	}
+	if err := routeTable.Ensure(link, expected, true); err != nil {
+		t.Fatalf("error from Ensure: %v", err)
+	}
+	assertRoutes(t, []string{
+		"10.2.0.0/24 table 100 via 10.1.0.3 proto 107",
+		"10.2.0.0/24 table 254 via 10.1.0.2 proto 107",
+		"10.200.0.0/16 table 254 via 10.1.0.254 proto 3",
+		"10.3.0.0/24 table 100 via 10.1.0.3 proto 107",
+	})
+
+	// Changing a gateway replaces the route; dropping a route removes it, but leaves the foreign route alone
+	expected = []*netlink.Route{
+		buildTestRoute(link, syscall.RT_TABLE_MAIN, "10.2.0.0/24", "10.1.0.4"),
+		buildTestRoute(link, 100, "10.2.0.0/24", "10.1.0.3"),
+	}
+	if err := routeTable.Ensure(link, expected, true); err != nil {
+		t.Fatalf("error from Ensure: %v", err)
+	}
+	assertRoutes(t, []string{
+		"10.2.0.0/24 table 100 via 10.1.0.3 proto 107",
+		"10.2.0.0/24 table 254 via 10.1.0.4 proto 107",
+		"10.200.0.0/16 table 254 via 10.1.0.254 proto 3",
+	})
+
+	// Without deleteExtraRoutes, nothing is removed
+	if err := routeTable.Ensure(link, expected[:1], false); err != nil {
+		t.Fatalf("error from Ensure: %v", err)
+	}
+	assertRoutes(t, []string{
+		"10.2.0.0/24 table 100 via 10.1.0.3 proto 107",
+		"10.2.0.0/24 table 254 via 10.1.0.4 proto 107",
+		"10.200.0.0/16 table 254 via 10.1.0.254 proto 3",
+	})
+}
+
+func TestRouteTableOwns(t *testing.T) {
+	testutil.EnterNetNS(t)
+
+	link := setupTestLink(t, "veth0", "10.1.0.1/24")
+
+	// Only host routes are ours; the /24 was installed by another provider
+	routeTable := &RouteTable{Owns: func(route *netlink.Route) bool {
+		ones, _ := route.Dst.Mask.Size()
+		return ones == 32
+	}}
+	other := buildTestRoute(link, syscall.RT_TABLE_MAIN, "10.2.0.0/24", "10.1.0.2")
+	if err := netlink.RouteAdd(other); err != nil {
+		t.Fatalf("error adding route: %v", err)
+	}
+	if err := routeTable.Ensure(link, []*netlink.Route{buildTestRoute(link, syscall.RT_TABLE_MAIN, "10.3.0.1/32", "10.1.0.3")}, true); err != nil {
+		t.Fatalf("error from Ensure: %v", err)
+	}
+	assertRoutes(t, []string{
+		"10.2.0.0/24 table 254 via 10.1.0.2 proto 107",
+		"10.3.0.1/32 table 254 via 10.1.0.3 proto 107",
+	})
+
+	if err := routeTable.Ensure(link, nil, true); err != nil {
+		t.Fatalf("error from Ensure: %v", err)
+	}
+	assertRoutes(t, []string{
+		"10.2.0.0/24 table 254 via 10.1.0.2 proto 107",
+	})
+}
+
+func TestRouteTableLegacyBootRoutes(t *testing.T) {
+	testutil.EnterNetNS(t)
+
+	link := setupTestLink(t, "veth0", "10.1.0.1/24")
+
+	addBootRoute := func(dst string) {
+		r := buildTestRoute(link, syscall.RT_TABLE_MAIN, dst, "10.1.0.2")
+		r.Protocol = syscall.RTPROT_BOOT
+		if err := netlink.RouteAdd(r); err != nil {
+			t.Fatalf("error adding boot route: %v", err)
+		}
+	}
+
+	// Earlier versions installed routes into the pod network with RTPROT_BOOT; the 10.200.0.0/16 route is not ours
+	_, podNetwork, _ := net.ParseCIDR("10.0.0.0/12")
+	routeTable := &RouteTable{LegacyBootRoute: func(route *netlink.Route) bool {
+		return podNetwork.Contains(route.Dst.IP)
+	}}
+	addBootRoute("10.2.0.0/24")
+	addBootRoute("10.3.0.0/24")
+	addBootRoute("10.200.0.0/16")
+
+	// An expected route replaces the boot route with the same destination; the other legacy route is removed
+	if err := routeTable.Ensure(link, []*netlink.Route{buildTestRoute(link, syscall.RT_TABLE_MAIN, "10.2.0.0/24", "10.1.0.2")}, true); err != nil {
+		t.Fatalf("error from Ensure: %v", err)
+	}
+	assertRoutes(t, []string{
+		"10.2.0.0/24 table 254 via 10.1.0.2 proto 107",
+		"10.200.0.0/16 table 254 via 10.1.0.2 proto 3",
+	})
+
+	// The migration only happens once, so boot routes added later by hand are left alone
+	addBootRoute("10.4.0.0/24")
+	if err := routeTable.Ensure(link, nil, true); err != nil {
+		t.Fatalf("error from Ensure: %v", err)
+	}
+	assertRoutes(t, []string{
+		"10.200.0.0/16 table 254 via 10.1.0.2 proto 3",
+		"10.4.0.0/24 table 254 via 10.1.0.2 proto 3",
+	})
+}
+
+func TestRouteTableRejectsUnmanagedTable(t *testing.T) {
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Index: 1}}
+	routeTable := &RouteTable{}
+	err := routeTable.Ensure(link, []*netlink.Route{buildTestRoute(link, 100, "10.2.0.0/24", "10.1.0.2")}, true)
+	if err == nil {
+		t.Fatalf("expected error for route in unmanaged table")
+	}
+}
+
+func assertRoutes(t *testing.T, expected []string) {
+	t.Helper()
+	actual := listTestRoutes(t)
+	if len(actual) != len(expected) {
+		t.Fatalf("unexpected routes:\n\tactual:   %v\n\texpected: %v", actual, expected)
+	}
+	for i := range actual {
+		if actual[i] != expected[i] {
+			t.Fatalf("unexpected routes:\n\tactual:   %v\n\texpected: %v", actual, expected)
+		}
+	}
+}
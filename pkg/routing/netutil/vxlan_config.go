@@ -0,0 +1,116 @@
+package netutil
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// maxVNI is the largest VXLAN network identifier (24 bits)
+const maxVNI = 1<<24 - 1
+
+// VxlanConfig holds the settings of the vxlan device created by the vxlan providers
+type VxlanConfig struct {
+	// VNI is the VXLAN network identifier
+	VNI int `json:"vni"`
+
+	// Port is the UDP destination port
+	Port int `json:"port"`
+
+	// DeviceName is the name of the vxlan device; if empty, vxlan<VNI> is used
+	DeviceName string `json:"deviceName"`
+
+	// SourcePortLow and SourcePortHigh restrict the UDP source ports; if zero the kernel chooses the range
+	SourcePortLow  int `json:"sourcePortLow"`
+	SourcePortHigh int `json:"sourcePortHigh"`
+
+	// UDPChecksum requests UDP checksums over IPv4 (udpcsum); if false they are turned off
+	UDPChecksum bool `json:"udpChecksum"`
+
+	// UDP6ZeroChecksumTx and UDP6ZeroChecksumRx allow zero UDP checksums over IPv6 (udp6zerocsumtx/rx)
+	UDP6ZeroChecksumTx bool `json:"udp6ZeroChecksumTx"`
+	UDP6ZeroChecksumRx bool `json:"udp6ZeroChecksumRx"`
+}
+
+// DefaultVxlanConfig returns the settings we have always used: VNI 1 on the IANA port, device vxlan1
+func DefaultVxlanConfig() VxlanConfig {
+	return VxlanConfig{
+		VNI:  1,
+		Port: 4789,
+	}
+}
+
+// SetDefaults fills in the VNI and port from DefaultVxlanConfig if they are not set
+func (c *VxlanConfig) SetDefaults() {
+	defaults := DefaultVxlanConfig()
+	if c.VNI == 0 {
+		c.VNI = defaults.VNI
+	}
+	if c.Port == 0 {
+		c.Port = defaults.Port
+	}
+}
+
+// Name returns the name of the vxlan device
+func (c *VxlanConfig) Name() string {
+	if c.DeviceName != "" {
+		return c.DeviceName
+	}
+	return fmt.Sprintf("vxlan%d", c.VNI)
+}
+
+// Validate checks the settings, returning all the problems found
+func (c *VxlanConfig) Validate() error {
+	var errs []error
+
+	if c.VNI < 1 || c.VNI > maxVNI {
+		errs = append(errs, fmt.Errorf("vni must be between 1 and %d, was %d", maxVNI, c.VNI))
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port must be between 1 and 65535, was %d", c.Port))
+	}
+
+	name := c.Name()
+	if len(name) >= 16 {
+		errs = append(errs, fmt.Errorf("deviceName %q must be shorter than 16 characters", name))
+	}
+	if strings.ContainsAny(name, "/: \t\n") || name == "." || name == ".." {
+		errs = append(errs, fmt.Errorf("deviceName %q is not a valid interface name", name))
+	}
+
+	if c.SourcePortLow != 0 || c.SourcePortHigh != 0 {
+		if c.SourcePortLow < 1 || c.SourcePortHigh > 65535 || c.SourcePortLow > c.SourcePortHigh {
+			errs = append(errs, fmt.Errorf("source port range must satisfy 1 <= sourcePortLow <= sourcePortHigh <= 65535, was %d-%d", c.SourcePortLow, c.SourcePortHigh))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ValidateFields is Validate, reporting each problem as an error on fldPath
+func (c *VxlanConfig) ValidateFields(fldPath *field.Path) field.ErrorList {
+	err := c.Validate()
+	if err == nil {
+		return nil
+	}
+	var errs field.ErrorList
+	for _, line := range strings.Split(err.Error(), "\n") {
+		errs = append(errs, field.Invalid(fldPath, field.OmitValueType{}, line))
+	}
+	return errs
+}
+
+// Apply sets the configured attributes on link
+func (c *VxlanConfig) Apply(link *netlink.Vxlan) {
+	link.Name = c.Name()
+	link.VxlanId = c.VNI
+	link.Port = c.Port
+	link.PortLow = c.SourcePortLow
+	link.PortHigh = c.SourcePortHigh
+	link.UDPCSum = c.UDPChecksum
+	link.UDP6ZeroCSumTx = c.UDP6ZeroChecksumTx
+	link.UDP6ZeroCSumRx = c.UDP6ZeroChecksumRx
+}
@@ -0,0 +1,96 @@
+package netutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVxlanConfigValidate(t *testing.T) {
+	grid := []struct {
+		name   string
+		mutate func(c *VxlanConfig)
+		errors []string
+	}{
+		{
+			name:   "defaults",
+			mutate: func(c *VxlanConfig) {},
+		},
+		{
+			name: "custom",
+			mutate: func(c *VxlanConfig) {
+				c.VNI = 42
+				c.Port = 8472
+				c.DeviceName = "kopeio-vx"
+				c.SourcePortLow = 32768
+				c.SourcePortHigh = 61000
+			},
+		},
+		{
+			name: "out of range",
+			mutate: func(c *VxlanConfig) {
+				c.VNI = 1 << 24
+				c.Port = 0
+			},
+			errors: []string{"vni must be between", "port must be between"},
+		},
+		{
+			name: "bad device name",
+			mutate: func(c *VxlanConfig) {
+				c.DeviceName = "a/very/long/device/name"
+			},
+			errors: []string{"shorter than 16 characters", "not a valid interface name"},
+		},
+		{
+			name: "inverted source port range",
+			mutate: func(c *VxlanConfig) {
+				c.SourcePortLow = 2000
+				c.SourcePortHigh = 1000
+			},
+			errors: []string{"source port range"},
+		},
+		{
+			name: "half source port range",
+			mutate: func(c *VxlanConfig) {
+				c.SourcePortHigh = 1000
+			},
+			errors: []string{"source port range"},
+		},
+	}
+
+	for _, g := range grid {
+		t.Run(g.name, func(t *testing.T) {
+			c := DefaultVxlanConfig()
+			g.mutate(&c)
+			err := c.Validate()
+			if len(g.errors) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected error")
+			}
+			for _, e := range g.errors {
+				if !strings.Contains(err.Error(), e) {
+					t.Errorf("error %q did not contain %q", err, e)
+				}
+			}
+		})
+	}
+}
+
+func TestVxlanConfigName(t *testing.T) {
+	c := DefaultVxlanConfig()
+	if got := c.Name(); got != "vxlan1" {
+		t.Errorf("unexpected default name %q", got)
+	}
+	c.VNI = 7
+	if got := c.Name(); got != "vxlan7" {
+		t.Errorf("unexpected name %q", got)
+	}
+	c.DeviceName = "overlay0"
+	if got := c.Name(); got != "overlay0" {
+		t.Errorf("unexpected name %q", got)
+	}
+}
@@ -0,0 +1,114 @@
+package netutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// LinkAdd is the equivalent of `ip link add`.
+// netlink.LinkAdd only sends udpcsum when it is set, so a vxlan device would get the kernel's default (checksums on)
+// and could never match a configuration that turns checksums off; we create vxlan devices ourselves, always sending it.
+// Every other attribute that LinkDiff compares is sent too, so a device we create always matches what we asked for.
+func LinkAdd(link netlink.Link) error {
+	vxlan, ok := link.(*netlink.Vxlan)
+	if !ok {
+		return netlink.LinkAdd(link)
+	}
+
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	if vxlan.Flags&net.FlagUp != 0 {
+		msg.Change = unix.IFF_UP
+		msg.Flags = unix.IFF_UP
+	}
+	req.AddData(msg)
+
+	req.AddData(nl.NewRtAttr(unix.IFLA_IFNAME, nl.ZeroTerminated(vxlan.Name)))
+	if vxlan.MTU > 0 {
+		req.AddData(nl.NewRtAttr(unix.IFLA_MTU, nl.Uint32Attr(uint32(vxlan.MTU))))
+	}
+	if len(vxlan.HardwareAddr) != 0 {
+		req.AddData(nl.NewRtAttr(unix.IFLA_ADDRESS, []byte(vxlan.HardwareAddr)))
+	}
+
+	linkInfo := nl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	linkInfo.AddRtAttr(nl.IFLA_INFO_KIND, nl.NonZeroTerminated(vxlan.Type()))
+	data := linkInfo.AddRtAttr(nl.IFLA_INFO_DATA, nil)
+	vni := vxlan.VxlanId
+	if vxlan.FlowBased {
+		vni = 0
+	}
+	data.AddRtAttr(nl.IFLA_VXLAN_ID, nl.Uint32Attr(uint32(vni)))
+	if vxlan.VtepDevIndex != 0 {
+		data.AddRtAttr(nl.IFLA_VXLAN_LINK, nl.Uint32Attr(uint32(vxlan.VtepDevIndex)))
+	}
+	if vxlan.SrcAddr != nil {
+		if ip := vxlan.SrcAddr.To4(); ip != nil {
+			data.AddRtAttr(nl.IFLA_VXLAN_LOCAL, []byte(ip))
+		} else {
+			data.AddRtAttr(nl.IFLA_VXLAN_LOCAL6, []byte(vxlan.SrcAddr.To16()))
+		}
+	}
+	if vxlan.Group != nil {
+		if ip := vxlan.Group.To4(); ip != nil {
+			data.AddRtAttr(nl.IFLA_VXLAN_GROUP, []byte(ip))
+		} else {
+			data.AddRtAttr(nl.IFLA_VXLAN_GROUP6, []byte(vxlan.Group.To16()))
+		}
+	}
+	data.AddRtAttr(nl.IFLA_VXLAN_TTL, nl.Uint8Attr(uint8(vxlan.TTL)))
+	data.AddRtAttr(nl.IFLA_VXLAN_TOS, nl.Uint8Attr(uint8(vxlan.TOS)))
+	data.AddRtAttr(nl.IFLA_VXLAN_LEARNING, boolAttr(vxlan.Learning))
+	data.AddRtAttr(nl.IFLA_VXLAN_PROXY, boolAttr(vxlan.Proxy))
+	data.AddRtAttr(nl.IFLA_VXLAN_RSC, boolAttr(vxlan.RSC))
+	data.AddRtAttr(nl.IFLA_VXLAN_L2MISS, boolAttr(vxlan.L2miss))
+	data.AddRtAttr(nl.IFLA_VXLAN_L3MISS, boolAttr(vxlan.L3miss))
+	data.AddRtAttr(nl.IFLA_VXLAN_UDP_CSUM, boolAttr(vxlan.UDPCSum))
+	data.AddRtAttr(nl.IFLA_VXLAN_UDP_ZERO_CSUM6_TX, boolAttr(vxlan.UDP6ZeroCSumTx))
+	data.AddRtAttr(nl.IFLA_VXLAN_UDP_ZERO_CSUM6_RX, boolAttr(vxlan.UDP6ZeroCSumRx))
+	if vxlan.GBP {
+		// GBP is a flag attribute: its presence turns it on
+		data.AddRtAttr(nl.IFLA_VXLAN_GBP, []byte{})
+	}
+	if vxlan.FlowBased {
+		data.AddRtAttr(nl.IFLA_VXLAN_FLOWBASED, boolAttr(true))
+	}
+	if vxlan.NoAge {
+		data.AddRtAttr(nl.IFLA_VXLAN_AGEING, nl.Uint32Attr(0))
+	} else if vxlan.Age > 0 {
+		data.AddRtAttr(nl.IFLA_VXLAN_AGEING, nl.Uint32Attr(uint32(vxlan.Age)))
+	}
+	if vxlan.Limit > 0 {
+		data.AddRtAttr(nl.IFLA_VXLAN_LIMIT, nl.Uint32Attr(uint32(vxlan.Limit)))
+	}
+	if vxlan.Port > 0 {
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, uint16(vxlan.Port))
+		data.AddRtAttr(nl.IFLA_VXLAN_PORT, port)
+	}
+	if vxlan.PortLow > 0 || vxlan.PortHigh > 0 {
+		portRange := make([]byte, 4)
+		binary.BigEndian.PutUint16(portRange[0:2], uint16(vxlan.PortLow))
+		binary.BigEndian.PutUint16(portRange[2:4], uint16(vxlan.PortHigh))
+		data.AddRtAttr(nl.IFLA_VXLAN_PORT_RANGE, portRange)
+	}
+	req.AddData(linkInfo)
+
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("error creating vxlan link %q: %w", vxlan.Name, err)
+	}
+	return nil
+}
+
+func boolAttr(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{0}
+}
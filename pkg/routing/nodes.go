@@ -3,7 +3,7 @@ package routing
 import (
 	"bytes"
 	"net"
-	"sort"
+	"reflect"
 	"sync"
 
 	corev1 "k8s.io/api/core/v1"
@@ -13,13 +13,17 @@ import (
 type NodePredicate func(node *corev1.Node) bool
 
 type NodeMap struct {
-	mePredicate NodePredicate
+	mePredicate     NodePredicate
+	addressSelector *AddressSelector
 
 	mutex   sync.Mutex
 	ready   bool
 	nodes   map[string]*NodeInfo
 	version uint64
 	me      *NodeInfo
+
+	// poolCIDRs are the CIDRs of the IPPools, which are part of the pod network along with the configured podCIDR
+	poolCIDRs []*net.IPNet
 }
 
 func (m *NodeMap) IsVersion(version uint64) bool {
@@ -55,6 +59,19 @@ func (m *NodeMap) Snapshot() (*NodeInfo, []NodeInfo, uint64) {
 	return &me, nodes, m.version
 }
 
+// Self returns a copy of our own node, or nil if we have not yet identified it.
+// The fields of a NodeInfo are replaced rather than modified when the node changes, so the copy can be read without locking.
+func (m *NodeMap) Self() *NodeInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.me == nil {
+		return nil
+	}
+	me := *m.me
+	return &me
+}
+
 func (m *NodeMap) MarkReady() {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -95,7 +112,7 @@ func (m *NodeMap) updateNode(src *corev1.Node) bool {
 		m.nodes[name] = node
 		changed = true
 	}
-	if node.update(src) {
+	if node.update(src, m.addressSelector) {
 		changed = true
 	}
 
@@ -143,23 +160,121 @@ func (m *NodeMap) ReplaceAllNodes(nodes []corev1.Node) bool {
 	return changed
 }
 
-func NewNodeMap(mePredicate NodePredicate) *NodeMap {
+// SetPoolCIDRs replaces the CIDRs of the IPPools, returning true if they changed
+func (m *NodeMap) SetPoolCIDRs(cidrs []*net.IPNet) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if cidrsEqual(m.poolCIDRs, cidrs) {
+		return false
+	}
+	m.poolCIDRs = cidrs
+	m.version++
+	return true
+}
+
+// PoolCIDRs returns a copy of the CIDRs of the IPPools
+func (m *NodeMap) PoolCIDRs() []*net.IPNet {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return append([]*net.IPNet(nil), m.poolCIDRs...)
+}
+
+func cidrsEqual(a, b []*net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// CopyFrom replaces the contents of m with the nodes in src for which include returns true, along with our own node.
+// This lets a provider handle a subset of the nodes: the version of m changes only when that subset changes.
+func (m *NodeMap) CopyFrom(src *NodeMap, include func(node *NodeInfo) bool) {
+	me, nodes, _ := src.Snapshot()
+	if me == nil {
+		return
+	}
+	poolCIDRs := src.PoolCIDRs()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	changed := !m.ready
+	m.ready = true
+
+	if !cidrsEqual(m.poolCIDRs, poolCIDRs) {
+		m.poolCIDRs = poolCIDRs
+		changed = true
+	}
+
+	names := make(map[string]bool)
+	for i := range nodes {
+		node := &nodes[i]
+		if node.Name != me.Name && !include(node) {
+			continue
+		}
+		names[node.Name] = true
+
+		if existing := m.nodes[node.Name]; existing == nil || !reflect.DeepEqual(existing, node) {
+			m.nodes[node.Name] = node
+			changed = true
+		}
+	}
+	for name := range m.nodes {
+		if !names[name] {
+			delete(m.nodes, name)
+			changed = true
+		}
+	}
+
+	var newMe *NodeInfo
+	if me.Name != "" {
+		newMe = m.nodes[me.Name]
+	}
+	if newMe != m.me {
+		m.me = newMe
+		changed = true
+	}
+
+	if changed {
+		m.version++
+	}
+}
+
+// NewNodeMap builds a NodeMap; addressSelector chooses the address of each node, and if nil the default priority is used
+func NewNodeMap(mePredicate NodePredicate, addressSelector *AddressSelector) *NodeMap {
+	if addressSelector == nil {
+		addressSelector, _ = ParseAddressSelector(nil)
+	}
 	m := &NodeMap{
-		nodes:       make(map[string]*NodeInfo),
-		mePredicate: mePredicate,
+		nodes:           make(map[string]*NodeInfo),
+		mePredicate:     mePredicate,
+		addressSelector: addressSelector,
 	}
 	return m
 }
 
 // NodeInfo contains the subset of the node information that we care about
 type NodeInfo struct {
-	Name             string
-	Address          net.IP
+	Name    string
+	Address net.IP
+	// Endpoint is set if the node has a TunnelEndpointAnnotation, e.g. because it is behind NAT
+	Endpoint *Endpoint
+	// Agent is what the node's agent advertises in the AgentAnnotation; nil if the agent has not yet set it
+	Agent            *AgentInfo
 	PodCIDR          *net.IPNet
 	NetworkAvailable bool
+	// NetworkReason is the reason of the NetworkUnavailable condition; empty if the node does not have the condition
+	NetworkReason string
 }
 
-func (n *NodeInfo) update(src *corev1.Node) bool {
+func (n *NodeInfo) update(src *corev1.Node, addressSelector *AddressSelector) bool {
 	changed := false
 
 	name := src.Name
@@ -187,50 +302,53 @@ func (n *NodeInfo) update(src *corev1.Node) bool {
 		}
 	}
 
-	var internalIPs []string
-	for i := range src.Status.Addresses {
-		address := &src.Status.Addresses[i]
-		if address.Type == corev1.NodeInternalIP {
-			internalIPs = append(internalIPs, address.Address)
-		}
+	if a := addressSelector.Select(src); !n.Address.Equal(a) {
+		n.Address = a
+		changed = true
 	}
 
-	if len(internalIPs) == 0 {
-		if n.Address != nil {
-			n.Address = nil
-			changed = true
-		}
-	} else {
-		if len(internalIPs) != 1 {
-			klog.Infof("arbitrarily choosing IP for node: %q", name)
-			sort.Strings(internalIPs) // At least choose consistently
+	var endpoint *Endpoint
+	if s := src.Annotations[TunnelEndpointAnnotation]; s != "" {
+		e, err := ParseEndpoint(s)
+		if err != nil {
+			klog.Warningf("Ignoring %s annotation on node %q: %v", TunnelEndpointAnnotation, name, err)
+		} else {
+			endpoint = e
 		}
+	}
+	if !endpointEqual(n.Endpoint, endpoint) {
+		n.Endpoint = endpoint
+		changed = true
+	}
 
-		internalIP := internalIPs[0]
-		a := net.ParseIP(internalIP)
-		if a == nil {
-			klog.Warningf("Unable to parse node address %q", internalIP)
-			if n.Address != nil {
-				n.Address = nil
-				changed = true
-			}
-		} else if !n.Address.Equal(a) {
-			n.Address = a
-			changed = true
+	var agent *AgentInfo
+	if s := src.Annotations[AgentAnnotation]; s != "" {
+		a, err := ParseAgentInfo(s)
+		if err != nil {
+			klog.Warningf("Ignoring %s annotation on node %q: %v", AgentAnnotation, name, err)
+		} else {
+			agent = a
 		}
 	}
+	if !reflect.DeepEqual(n.Agent, agent) {
+		n.Agent = agent
+		changed = true
+	}
 
 	{
 		networkAvailable := true
+		networkReason := ""
 		for _, condition := range src.Status.Conditions {
 			if condition.Type == corev1.NodeNetworkUnavailable {
 				switch condition.Status {
 				case corev1.ConditionFalse:
 					// Double negative: Not unavailable
 					networkAvailable = true
+					networkReason = condition.Reason
 				case corev1.ConditionTrue:
 					// It is true that it is unavailable => available=false
 					networkAvailable = false
+					networkReason = condition.Reason
 				case corev1.ConditionUnknown:
 					klog.V(2).Infof("NodeNetworkAvailable status was ConditionUnknown - assuming available")
 				default:
@@ -238,8 +356,9 @@ func (n *NodeInfo) update(src *corev1.Node) bool {
 				}
 			}
 		}
-		if networkAvailable != n.NetworkAvailable {
+		if networkAvailable != n.NetworkAvailable || networkReason != n.NetworkReason {
 			n.NetworkAvailable = networkAvailable
+			n.NetworkReason = networkReason
 			changed = true
 		}
 	}
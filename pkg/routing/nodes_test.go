@@ -0,0 +1,101 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// recordingCNIWriter records the PodCIDRs it was asked to write
+type recordingCNIWriter struct {
+	cidrs []string
+}
+
+func (w *recordingCNIWriter) WriteCNIConfig(podCIDR *net.IPNet) error {
+	w.cidrs = append(w.cidrs, podCIDR.String())
+	return nil
+}
+
+func TestSelf(t *testing.T) {
+	m := NewNodeMap(func(node *corev1.Node) bool { return node.Name == "node1" }, nil)
+	if me := m.Self(); me != nil {
+		t.Errorf("expected nil before our node is known, got %+v", me)
+	}
+
+	node := migrationTestNode("node1")
+	m.UpdateNode(node)
+	me := m.Self()
+	if me == nil || me.PodCIDR.String() != "100.96.0.0/24" {
+		t.Fatalf("unexpected self %+v", me)
+	}
+
+	// The copy is not affected by later changes
+	node.Spec.PodCIDR = "100.96.1.0/24"
+	m.UpdateNode(node)
+	if me.PodCIDR.String() != "100.96.0.0/24" {
+		t.Errorf("copy changed to %s", me.PodCIDR)
+	}
+	if m.Self().PodCIDR.String() != "100.96.1.0/24" {
+		t.Errorf("expected update to be visible, got %s", m.Self().PodCIDR)
+	}
+}
+
+// TestConcurrentUpdates runs the controller while the node watch updates the NodeMap; it is meant to be run with -race
+func TestConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	kubeClient := fake.NewSimpleClientset(migrationTestNode("node1"))
+
+	m := NewNodeMap(func(node *corev1.Node) bool { return node.Name == "node1" }, nil)
+	m.UpdateNode(migrationTestNode("node1"))
+	m.MarkReady()
+
+	cniWriter := &recordingCNIWriter{}
+	c, err := NewController(kubeClient, m, "fake", &fakeProvider{}, cniWriter, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.recorder = record.NewFakeRecorder(1000)
+
+	migrated := NewNodeMap(nil, nil)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			node := migrationTestNode("node1", "fake")
+			node.Spec.PodCIDR = fmt.Sprintf("100.96.%d.0/24", i%2)
+			if i%3 == 0 {
+				node.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeNetworkUnavailable, Status: corev1.ConditionTrue}}
+			}
+			m.UpdateNode(node)
+			m.ReplaceAllNodes([]corev1.Node{*node, *migrationTestNode(fmt.Sprintf("node%d", i%5+2))})
+			m.SetPoolCIDRs([]*net.IPNet{{IP: net.IPv4(100, 97, byte(i), 0), Mask: net.CIDRMask(24, 32)}})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			err := c.reconcile()
+			c.reportNetworkCondition(ctx, err)
+			if err := c.advertiseAgent(ctx); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			migrated.CopyFrom(m, func(node *NodeInfo) bool { return node.SupportsProvider("fake") })
+			if me := m.Self(); me != nil && me.PodCIDR == nil {
+				t.Errorf("unexpected self without PodCIDR")
+			}
+		}
+	}()
+	wg.Wait()
+
+	if len(cniWriter.cidrs) != 200 {
+		t.Errorf("expected the CNI config to be written on every reconcile, got %d", len(cniWriter.cidrs))
+	}
+}
@@ -1,5 +1,55 @@
 package routing
 
+import (
+	"net"
+
+	"kope.io/networking/pkg/routing/netutil"
+)
+
 type Provider interface {
 	EnsureCIDRs(nodeMap *NodeMap) error
+
+	// Teardown removes the devices, routes and other state the provider created.
+	// The provider is not used again afterwards.
+	Teardown() error
+}
+
+// MultiProvider is implemented by providers that run more than one provider at once, such as MigrationProvider
+type MultiProvider interface {
+	// ActiveProviders returns the names of the providers we are running
+	ActiveProviders() []string
+}
+
+// AgentDescriber is implemented by providers that can describe what they are running, for the AgentAnnotation
+type AgentDescriber interface {
+	// DescribeAgent adds the encapsulations, MTU and keys of the provider to info
+	DescribeAgent(info *AgentInfo)
+}
+
+// MTUConfigurable is implemented by providers whose overlay MTU can be changed without rebuilding them
+type MTUConfigurable interface {
+	// SetMTU sets the MTU of the overlay; zero means the MTU computed from the underlay
+	SetMTU(mtu int)
+}
+
+// ProviderEnvironment is what the agent knows about the node when it builds a provider.
+// The target links and path MTU prober can change while we are running; see EnvironmentConfigurable.
+type ProviderEnvironment struct {
+	// OverlayCIDR is the address space allocated to pod networking
+	OverlayCIDR *net.IPNet
+
+	// TargetLinkNames are the network interfaces that carry traffic between nodes
+	TargetLinkNames []string
+
+	// MTUProber is set if path MTU discovery is enabled
+	MTUProber *netutil.PathMTUProber
+}
+
+// EnvironmentConfigurable is implemented by providers whose target links and path MTU prober can be changed without rebuilding them,
+// so that the change does not interrupt traffic
+type EnvironmentConfigurable interface {
+	// SetEnvironment changes the target links and path MTU prober; the overlay CIDR is unchanged.
+	// The change is applied in place on the next call to EnsureCIDRs.
+	// If it returns an error the provider cannot apply the change, and must be rebuilt.
+	SetEnvironment(env *ProviderEnvironment) error
 }
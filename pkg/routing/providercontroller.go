@@ -1,38 +1,124 @@
 package routing
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
+	"kope.io/networking"
 	"kope.io/networking/pkg/cni"
+	"kope.io/networking/pkg/routing/netutil"
 )
 
 // Controller updates the routing provider, if any changes have been made
 type Controller struct {
 	nodeMap         *NodeMap
-	provider        Provider
 	kubeClient      kubernetes.Interface
 	cniConfigWriter cni.ConfigWriter
+
+	// mutex guards provider and masqueradeTable, which can be replaced when the configuration changes.
+	// It is held while we reconcile, so a replaced provider is never in use.
+	mutex           sync.Mutex
+	providerName    string
+	provider        Provider
+	masqueradeTable *netutil.MasqueradeTable
+
+	// lastAdvertised and lastAdvertiseAttempt record our last update to the AgentAnnotation on our node
+	lastAdvertised       string
+	lastAdvertiseAttempt time.Time
+
+	// recorder publishes events on our node
+	recorder record.EventRecorder
+	// lastReconciled is when we last reconciled successfully; zero if we have not yet done so
+	lastReconciled time.Time
+	// lastCondition and lastConditionAttempt record our last update to the NetworkUnavailable condition on our node
+	lastCondition        string
+	lastConditionAttempt time.Time
 }
 
+// advertiseRetryInterval is how often we retry updating the AgentAnnotation, if it does not match what we are running
+const advertiseRetryInterval = time.Minute
+
 // NewController creates a routing.Controller
-func NewController(kubeClient kubernetes.Interface, nodeMap *NodeMap, provider Provider, cniConfigWriter cni.ConfigWriter) (*Controller, error) {
+// masqueradeTable is optional; if nil we do not configure masquerade.
+func NewController(kubeClient kubernetes.Interface, nodeMap *NodeMap, providerName string, provider Provider, cniConfigWriter cni.ConfigWriter, masqueradeTable *netutil.MasqueradeTable) (*Controller, error) {
 	c := &Controller{
 		kubeClient:      kubeClient,
 		nodeMap:         nodeMap,
+		providerName:    providerName,
 		provider:        provider,
 		cniConfigWriter: cniConfigWriter,
+		masqueradeTable: masqueradeTable,
+		recorder:        newEventRecorder(kubeClient),
 	}
 
 	return c, nil
 }
 
+// SwitchProvider replaces the routing provider.
+// The old provider is torn down first, so that it does not conflict with the new provider.
+// If teardown fails we still switch; the new provider reconciles the state it owns.
+func (c *Controller) SwitchProvider(providerName string, provider Provider) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	klog.Infof("tearing down previous routing provider")
+	if err := c.provider.Teardown(); err != nil {
+		klog.Warningf("error tearing down previous routing provider: %v", err)
+	}
+	c.providerName = providerName
+	c.provider = provider
+}
+
+// SetMTU changes the MTU of the provider in place, returning false if the provider does not support that
+func (c *Controller) SetMTU(mtu int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	configurable, ok := c.provider.(MTUConfigurable)
+	if !ok {
+		return false
+	}
+	configurable.SetMTU(mtu)
+	return true
+}
+
+// SetEnvironment changes the target links and path MTU prober of the provider in place.
+// It returns an error if the provider cannot do that, in which case it must be rebuilt.
+func (c *Controller) SetEnvironment(env *ProviderEnvironment) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	configurable, ok := c.provider.(EnvironmentConfigurable)
+	if !ok {
+		return fmt.Errorf("provider %q cannot change its target links or path MTU discovery in place", c.providerName)
+	}
+	return configurable.SetEnvironment(env)
+}
+
+// SetMasqueradeTable replaces the masquerade configuration; if masqueradeTable is nil our masquerade rules are removed
+func (c *Controller) SetMasqueradeTable(masqueradeTable *netutil.MasqueradeTable) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if masqueradeTable == nil && c.masqueradeTable != nil {
+		if err := c.masqueradeTable.Delete(); err != nil {
+			return err
+		}
+	}
+	c.masqueradeTable = masqueradeTable
+	return nil
+}
+
 // Run starts the NodeController.
 func (c *Controller) Run(ctx context.Context) error {
 	klog.Infof("starting node controller")
@@ -55,54 +141,138 @@ func (c *Controller) runWatcher(ctx context.Context) error {
 			return err
 		}
 
-		err := c.provider.EnsureCIDRs(c.nodeMap)
+		err := c.reconcile()
+		c.reportNetworkCondition(ctx, err)
 		if err != nil {
-			klog.Warningf("Unexpected error in provider controller, will retry: %v", err)
+			klog.Warningf("%v, will retry", err)
 			time.Sleep(10 * time.Second)
 			continue
-		} else {
-			time.Sleep(1 * time.Second)
 		}
 
-		if c.cniConfigWriter != nil && c.nodeMap.me != nil {
-			if err := c.cniConfigWriter.WriteCNIConfig(c.nodeMap.me.PodCIDR); err != nil {
-				klog.Warningf("unexpected error writing CNI config, will retry: %v", err)
-				time.Sleep(10 * time.Second)
-				continue
-			}
+		if err := c.advertiseAgent(ctx); err != nil {
+			klog.Warningf("error updating %s annotation on node: %v", AgentAnnotation, err)
 		}
 
-		if c.nodeMap.me != nil && !c.nodeMap.me.NetworkAvailable {
-			nodeName := c.nodeMap.me.Name
-			klog.Infof("marking node %q as network-ready in node status", nodeName)
-			currentTime := metav1.Now()
-			err = setNodeCondition(ctx, c.kubeClient, nodeName, corev1.NodeCondition{
-				Type:               corev1.NodeNetworkUnavailable,
-				Status:             corev1.ConditionFalse,
-				Reason:             "RouteCreated",
-				Message:            "kope.io network controller initialized node routes",
-				LastTransitionTime: currentTime,
-			})
-			if err != nil {
-				// Very small chance of conflict
-				if !errors.IsConflict(err) {
-					klog.Errorf("Error updating node %s: %v", nodeName, err)
-				}
-				klog.Errorf("Error updating node %s, will retry: %v", nodeName, err)
-			}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// reconcile applies the provider, CNI and masquerade configuration once
+func (c *Controller) reconcile() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	me := c.nodeMap.Self()
+	known := me != nil
+	if known && me.PodCIDR == nil {
+		return &networkError{reason: ReasonNoPodCIDR, err: fmt.Errorf("node %q has no PodCIDR", me.Name)}
+	}
+	if known && me.Address == nil {
+		return &networkError{reason: ReasonNoAddress, err: fmt.Errorf("node %q has no usable address", me.Name)}
+	}
+
+	if err := c.provider.EnsureCIDRs(c.nodeMap); err != nil {
+		return &networkError{reason: ReasonProviderError, err: fmt.Errorf("unexpected error in provider controller: %w", err)}
+	}
 
+	if c.cniConfigWriter != nil && known {
+		if err := c.cniConfigWriter.WriteCNIConfig(me.PodCIDR); err != nil {
+			return &networkError{reason: ReasonCNIConfigWriteFailed, err: fmt.Errorf("unexpected error writing CNI config: %w", err)}
 		}
 	}
+
+	if c.masqueradeTable != nil && known {
+		if err := c.masqueradeTable.Ensure(me.PodCIDR, c.nodeMap.PoolCIDRs()); err != nil {
+			return &networkError{reason: ReasonMasqueradeFailed, err: fmt.Errorf("unexpected error configuring masquerade: %w", err)}
+		}
+	}
+
+	return nil
+}
+
+// describeAgent builds the AgentInfo we advertise, describing what we are running
+func (c *Controller) describeAgent(me *NodeInfo) *AgentInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	info := &AgentInfo{
+		Version:   networking.Version,
+		Providers: []string{c.providerName},
+	}
+	if multi, ok := c.provider.(MultiProvider); ok {
+		info.Providers = multi.ActiveProviders()
+	}
+	if me.Endpoint != nil {
+		info.TunnelEndpoint = me.Endpoint.String()
+	} else if me.Address != nil {
+		info.TunnelEndpoint = me.Address.String()
+	}
+	if describer, ok := c.provider.(AgentDescriber); ok {
+		describer.DescribeAgent(info)
+	}
+	return info
+}
+
+// advertiseAgent sets the AgentAnnotation on our node to describe what we are running,
+// so that peers know how they can reach us.
+func (c *Controller) advertiseAgent(ctx context.Context) error {
+	me := c.nodeMap.Self()
+	if me == nil {
+		return nil
+	}
+
+	desired, err := json.Marshal(c.describeAgent(me))
+	if err != nil {
+		return err
+	}
+	if me.Agent != nil {
+		// We compare the serialized form, as it ignores the difference between nil and empty fields
+		current, err := json.Marshal(me.Agent)
+		if err == nil && bytes.Equal(current, desired) {
+			return nil
+		}
+	}
+
+	if string(desired) == c.lastAdvertised && time.Since(c.lastAdvertiseAttempt) < advertiseRetryInterval {
+		// Wait for the watch to catch up with our last update
+		return nil
+	}
+	c.lastAdvertised = string(desired)
+	c.lastAdvertiseAttempt = time.Now()
+
+	klog.Infof("setting %s=%s on node %q", AgentAnnotation, desired, me.Name)
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				AgentAnnotation: string(desired),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.kubeClient.CoreV1().Nodes().Patch(ctx, me.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
 }
 
 // Borrowed from k8s.io/kubernetes/pkg/util/node/node.go
 
 // SetNodeCondition updates specific node condition with patch operation.
+// If condition.LastTransitionTime is zero, the existing transition time is kept.
 func setNodeCondition(ctx context.Context, c kubernetes.Interface, node string, condition corev1.NodeCondition) error {
-	condition.LastHeartbeatTime = metav1.NewTime(time.Now())
+	patchCondition := map[string]interface{}{
+		"type":              condition.Type,
+		"status":            condition.Status,
+		"reason":            condition.Reason,
+		"message":           condition.Message,
+		"lastHeartbeatTime": metav1.NewTime(time.Now()),
+	}
+	if !condition.LastTransitionTime.IsZero() {
+		patchCondition["lastTransitionTime"] = condition.LastTransitionTime
+	}
 	patch, err := json.Marshal(map[string]interface{}{
 		"status": map[string]interface{}{
-			"conditions": []corev1.NodeCondition{condition},
+			"conditions": []interface{}{patchCondition},
 		},
 	})
 	if err != nil {
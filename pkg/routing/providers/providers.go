@@ -0,0 +1,12 @@
+// Package providers registers the routing providers built into the agent.
+// A custom build can register its own providers by importing their packages alongside this one.
+package providers
+
+import (
+	// Each package registers its providers in init
+	_ "kope.io/networking/pkg/routing/gre"
+	_ "kope.io/networking/pkg/routing/ipsec"
+	_ "kope.io/networking/pkg/routing/layer2"
+	_ "kope.io/networking/pkg/routing/vxlan"
+	_ "kope.io/networking/pkg/routing/vxlan2"
+)
@@ -0,0 +1,244 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ConfigSections looks up a section of the agent configuration as JSON, returning nil if the section is not set
+type ConfigSections func(section string) json.RawMessage
+
+// ProviderFactory describes a routing provider, and how to build it from its section of the agent configuration.
+// C is the type of the section; providers without configuration can use struct{}.
+type ProviderFactory[C any] struct {
+	// Name selects the provider in the agent configuration
+	Name string
+
+	// ConfigSection is the section of the agent configuration that configures the provider; empty if it has none.
+	// Providers may share a section, in which case they must use the same type for it.
+	ConfigSection string
+
+	// Migratable is set if the provider can run alongside another provider during a migration,
+	// which means it must only remove routes to nodes that it handles.
+	Migratable bool
+
+	// SetDefaults fills in the fields of the section that are not set; optional
+	SetDefaults func(config *C)
+
+	// Validate checks the defaulted section, whose path is fldPath; optional
+	Validate func(config *C, fldPath *field.Path) field.ErrorList
+
+	// New builds the provider
+	New func(config *C, env *ProviderEnvironment) (Provider, error)
+
+	// Cleanup removes everything the provider may have left on the node, even if it is not running; optional
+	Cleanup func(config *C) error
+
+	// CleanupOnlyIfSelected is set if Cleanup removes state that the provider does not own exclusively,
+	// so that we only run it if the provider is configured
+	CleanupOnlyIfSelected bool
+}
+
+// registeredProvider is a ProviderFactory with the type of its section erased
+type registeredProvider struct {
+	name                  string
+	configSection         string
+	migratable            bool
+	cleanupOnlyIfSelected bool
+
+	validate func(raw json.RawMessage, fldPath *field.Path) field.ErrorList
+	build    func(raw json.RawMessage, env *ProviderEnvironment) (Provider, error)
+	cleanup  func(raw json.RawMessage) error
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      = make(map[string]*registeredProvider)
+)
+
+// RegisterProvider makes a provider available to the agent; provider packages call it from init.
+// It panics if a provider with the same name is already registered.
+func RegisterProvider[C any](factory ProviderFactory[C]) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if _, found := registry[factory.Name]; found {
+		panic(fmt.Sprintf("routing provider %q registered twice", factory.Name))
+	}
+
+	decode := func(raw json.RawMessage) (*C, error) {
+		config := new(C)
+		if len(raw) != 0 {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(config); err != nil {
+				return nil, err
+			}
+		}
+		if factory.SetDefaults != nil {
+			factory.SetDefaults(config)
+		}
+		return config, nil
+	}
+
+	registry[factory.Name] = &registeredProvider{
+		name:                  factory.Name,
+		configSection:         factory.ConfigSection,
+		migratable:            factory.Migratable,
+		cleanupOnlyIfSelected: factory.CleanupOnlyIfSelected,
+		validate: func(raw json.RawMessage, fldPath *field.Path) field.ErrorList {
+			config, err := decode(raw)
+			if err != nil {
+				return field.ErrorList{field.Invalid(fldPath, field.OmitValueType{}, err.Error())}
+			}
+			if factory.Validate == nil {
+				return nil
+			}
+			return factory.Validate(config, fldPath)
+		},
+		build: func(raw json.RawMessage, env *ProviderEnvironment) (Provider, error) {
+			config, err := decode(raw)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing %s configuration: %w", factory.ConfigSection, err)
+			}
+			return factory.New(config, env)
+		},
+		cleanup: func(raw json.RawMessage) error {
+			if factory.Cleanup == nil {
+				return nil
+			}
+			config, err := decode(raw)
+			if err != nil {
+				return fmt.Errorf("error parsing %s configuration: %w", factory.ConfigSection, err)
+			}
+			return factory.Cleanup(config)
+		},
+	}
+}
+
+// registeredProviders returns the registered providers, sorted by name
+func registeredProviders() []*registeredProvider {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	providers := make([]*registeredProvider, 0, len(registry))
+	for _, p := range registry {
+		providers = append(providers, p)
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].name < providers[j].name })
+	return providers
+}
+
+// lookupProvider returns the provider called name, or nil
+func lookupProvider(name string) *registeredProvider {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	return registry[name]
+}
+
+// ProviderNames returns the names of the registered providers, sorted
+func ProviderNames() []string {
+	var names []string
+	for _, p := range registeredProviders() {
+		names = append(names, p.name)
+	}
+	return names
+}
+
+// MigratableProviderNames returns the names of the registered providers that can be migrated between, sorted
+func MigratableProviderNames() []string {
+	var names []string
+	for _, p := range registeredProviders() {
+		if p.migratable {
+			names = append(names, p.name)
+		}
+	}
+	return names
+}
+
+// ProviderConfigSection returns the section of the agent configuration that configures the provider called name;
+// empty if it has none or is not registered
+func ProviderConfigSection(name string) string {
+	if p := lookupProvider(name); p != nil {
+		return p.configSection
+	}
+	return ""
+}
+
+// ProviderConfigSectionNames returns the sections of the agent configuration used by the registered providers, sorted
+func ProviderConfigSectionNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, p := range registeredProviders() {
+		if p.configSection != "" && !seen[p.configSection] {
+			seen[p.configSection] = true
+			names = append(names, p.configSection)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateProviderConfig checks a section of the agent configuration, whose path is fldPath, against the providers that use it
+func ValidateProviderConfig(section string, raw json.RawMessage, fldPath *field.Path) field.ErrorList {
+	// Providers sharing a section use the same type, so we only need to validate it once
+	for _, p := range registeredProviders() {
+		if p.configSection == section {
+			return p.validate(raw, fldPath)
+		}
+	}
+	return nil
+}
+
+// NewProvider builds the registered provider called name
+func NewProvider(name string, sections ConfigSections, env *ProviderEnvironment) (Provider, error) {
+	p := lookupProvider(name)
+	if p == nil {
+		return nil, fmt.Errorf("provider not known: %q", name)
+	}
+
+	var raw json.RawMessage
+	if p.configSection != "" {
+		raw = sections(p.configSection)
+	}
+	provider, err := p.build(raw, env)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build provider %q: %w", name, err)
+	}
+	return provider, nil
+}
+
+// CleanupProviders removes what every registered provider may have left on the node;
+// providers whose cleanup is not exclusive to their own state are only cleaned up if they are in selected.
+func CleanupProviders(selected []string, sections ConfigSections) error {
+	var errs []error
+	for _, p := range registeredProviders() {
+		if p.cleanupOnlyIfSelected && !containsString(selected, p.name) {
+			continue
+		}
+		var raw json.RawMessage
+		if p.configSection != "" {
+			raw = sections(p.configSection)
+		}
+		if err := p.cleanup(raw); err != nil {
+			errs = append(errs, fmt.Errorf("error cleaning up provider %q: %w", p.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package routing
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// testProviderConfig is the section of the providers registered by TestRegistry
+type testProviderConfig struct {
+	Color string `json:"color"`
+}
+
+func TestRegistry(t *testing.T) {
+	var built, cleanedUp []string
+	register := func(name string, cleanupOnlyIfSelected bool) {
+		RegisterProvider(ProviderFactory[testProviderConfig]{
+			Name:          name,
+			ConfigSection: "testRegistry",
+			SetDefaults: func(config *testProviderConfig) {
+				if config.Color == "" {
+					config.Color = "red"
+				}
+			},
+			Validate: func(config *testProviderConfig, fldPath *field.Path) field.ErrorList {
+				if config.Color != "red" && config.Color != "blue" {
+					return field.ErrorList{field.NotSupported(fldPath.Child("color"), config.Color, []string{"red", "blue"})}
+				}
+				return nil
+			},
+			New: func(config *testProviderConfig, env *ProviderEnvironment) (Provider, error) {
+				built = append(built, name+"/"+config.Color)
+				return &fakeProvider{}, nil
+			},
+			Cleanup: func(config *testProviderConfig) error {
+				cleanedUp = append(cleanedUp, name+"/"+config.Color)
+				return nil
+			},
+			CleanupOnlyIfSelected: cleanupOnlyIfSelected,
+		})
+	}
+	register("test-registry-a", false)
+	register("test-registry-b", true)
+	t.Cleanup(func() {
+		registryMutex.Lock()
+		defer registryMutex.Unlock()
+		delete(registry, "test-registry-a")
+		delete(registry, "test-registry-b")
+	})
+
+	sections := func(config string) ConfigSections {
+		return func(section string) json.RawMessage {
+			if section == "testRegistry" && config != "" {
+				return json.RawMessage(config)
+			}
+			return nil
+		}
+	}
+
+	if _, err := NewProvider("test-registry-a", sections(""), &ProviderEnvironment{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := NewProvider("test-registry-b", sections(`{"color":"blue"}`), &ProviderEnvironment{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(built, []string{"test-registry-a/red", "test-registry-b/blue"}) {
+		t.Errorf("unexpected providers built: %v", built)
+	}
+	if _, err := NewProvider("test-registry-c", sections(""), &ProviderEnvironment{}); err == nil {
+		t.Errorf("expected error building an unknown provider")
+	}
+
+	path := field.NewPath("testRegistry")
+	if errs := ValidateProviderConfig("testRegistry", json.RawMessage(`{"color":"green"}`), path); len(errs) != 1 || !strings.Contains(errs.ToAggregate().Error(), "testRegistry.color") {
+		t.Errorf("expected an error for testRegistry.color, got %v", errs)
+	}
+	if errs := ValidateProviderConfig("testRegistry", json.RawMessage(`{"colour":"red"}`), path); len(errs) != 1 {
+		t.Errorf("expected an error for an unknown field, got %v", errs)
+	}
+
+	if err := CleanupProviders([]string{"vxlan"}, sections("")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := CleanupProviders([]string{"test-registry-b"}, sections("")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(cleanedUp, []string{"test-registry-a/red", "test-registry-a/red", "test-registry-b/red"}) {
+		t.Errorf("unexpected providers cleaned up: %v", cleanedUp)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected registering a provider twice to panic")
+		}
+	}()
+	register("test-registry-a", false)
+}
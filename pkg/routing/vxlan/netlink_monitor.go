@@ -3,6 +3,7 @@ package vxlan
 import (
 	"fmt"
 	"net"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -14,6 +15,9 @@ import (
 type NetlinkMonitor struct {
 	socket    *nl.NetlinkSocket
 	linkIndex int
+
+	// stopped is set by Stop, so that watch exits rather than reporting the closed socket
+	stopped atomic.Bool
 }
 
 func NewNetlinkMonitor(linkIndex int) (*NetlinkMonitor, error) {
@@ -35,9 +39,20 @@ func (m *NetlinkMonitor) Start() error {
 	return nil
 }
 
+// Stop closes the netlink socket, ending the watch
+func (m *NetlinkMonitor) Stop() {
+	m.stopped.Store(true)
+	if m.socket != nil {
+		m.socket.Close()
+	}
+}
+
 func (m *NetlinkMonitor) watch() {
 	for {
 		messages, _, err := m.socket.Receive()
+		if m.stopped.Load() {
+			return
+		}
 		if err != nil {
 			klog.Errorf("error reading from netlink monitor: %v ", err)
 			time.Sleep(1 * time.Second)
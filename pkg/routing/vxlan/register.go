@@ -0,0 +1,28 @@
+package vxlan
+
+import (
+	"fmt"
+
+	"kope.io/networking/pkg/routing"
+	"kope.io/networking/pkg/routing/netutil"
+)
+
+func init() {
+	routing.RegisterProvider(routing.ProviderFactory[netutil.VxlanConfig]{
+		Name:          "vxlan-legacy",
+		ConfigSection: "vxlan",
+		Migratable:    true,
+		SetDefaults:   (*netutil.VxlanConfig).SetDefaults,
+		Validate:      (*netutil.VxlanConfig).ValidateFields,
+		New: func(config *netutil.VxlanConfig, env *routing.ProviderEnvironment) (routing.Provider, error) {
+			if len(env.TargetLinkNames) != 1 {
+				return nil, fmt.Errorf("expected exactly one target link with vxlan-legacy; got %v", env.TargetLinkNames)
+			}
+			return NewVxlanRoutingProvider(env.OverlayCIDR, env.TargetLinkNames[0], *config)
+		},
+		// Routes are removed with the device
+		Cleanup: func(config *netutil.VxlanConfig) error {
+			return netutil.DeleteLink(config.Name())
+		},
+	})
+}
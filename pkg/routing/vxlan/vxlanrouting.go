@@ -17,11 +17,12 @@ type VxlanRoutingProvider struct {
 
 	monitor *NetlinkMonitor
 
-	vxlanID   int
-	vtepIndex int
-	vxlanPort int
+	vxlanConfig netutil.VxlanConfig
+	vtepIndex   int
 
-	mtu int
+	// deviceName is the target link, from which we take the MTU
+	deviceName string
+	mtu        int
 
 	link       *netlink.Vxlan
 	routeTable *netutil.RouteTable
@@ -31,8 +32,14 @@ type VxlanRoutingProvider struct {
 }
 
 var _ routing.Provider = &VxlanRoutingProvider{}
+var _ routing.AgentDescriber = &VxlanRoutingProvider{}
+var _ routing.EnvironmentConfigurable = &VxlanRoutingProvider{}
+
+func NewVxlanRoutingProvider(overlayCIDR *net.IPNet, deviceName string, vxlanConfig netutil.VxlanConfig) (*VxlanRoutingProvider, error) {
+	if err := vxlanConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid vxlan configuration: %w", err)
+	}
 
-func NewVxlanRoutingProvider(overlayCIDR *net.IPNet, deviceName string) (*VxlanRoutingProvider, error) {
 	underlyingLink, err := netlink.LinkByName(deviceName)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching target link %q: %v", deviceName, err)
@@ -41,26 +48,55 @@ func NewVxlanRoutingProvider(overlayCIDR *net.IPNet, deviceName string) (*VxlanR
 		return nil, fmt.Errorf("target link not found %q", deviceName)
 	}
 
-	mtu := underlyingLink.Attrs().MTU - 100
-	klog.Warningf("MTU hard-coded to underlying interface %s MTU - 100 = %d", deviceName, mtu)
+	mtu := underlyingLink.Attrs().MTU - netutil.VxlanOverhead
+	klog.Infof("using MTU %d (underlying interface %s MTU - vxlan overhead %d)", mtu, deviceName, netutil.VxlanOverhead)
 
 	p := &VxlanRoutingProvider{
 		overlayCIDR: overlayCIDR,
 
-		vxlanID:   1,
-		vtepIndex: 0,
-		vxlanPort: 4789,
+		vxlanConfig: vxlanConfig,
+		vtepIndex:   0,
 
-		mtu: mtu,
+		deviceName: deviceName,
+		mtu:        mtu,
 	}
 
 	return p, nil
 }
 
+// DescribeAgent advertises our vxlan device
+func (p *VxlanRoutingProvider) DescribeAgent(info *routing.AgentInfo) {
+	info.Encapsulations = append(info.Encapsulations, routing.Encapsulation{Type: "vxlan", Port: p.vxlanConfig.Port, VNI: p.vxlanConfig.VNI})
+	info.MTU = p.mtu
+}
+
+// SetEnvironment accepts a change to path MTU discovery, which we don't use; our MTU comes from the target link,
+// so changing it requires rebuilding the provider
+func (p *VxlanRoutingProvider) SetEnvironment(env *routing.ProviderEnvironment) error {
+	if len(env.TargetLinkNames) != 1 || env.TargetLinkNames[0] != p.deviceName {
+		return fmt.Errorf("cannot change target link from %q to %v in place", p.deviceName, env.TargetLinkNames)
+	}
+	return nil
+}
+
 func (p *VxlanRoutingProvider) Close() error {
 	return nil
 }
 
+// Teardown removes the vxlan device, and with it our routes and neighbour entries
+func (p *VxlanRoutingProvider) Teardown() error {
+	if p.monitor != nil {
+		p.monitor.Stop()
+		p.monitor = nil
+	}
+	if err := netutil.DeleteLink(p.vxlanConfig.Name()); err != nil {
+		return err
+	}
+	p.link = nil
+	p.lastVersionApplied = 0
+	return nil
+}
+
 func listenArp(link netlink.Link) error {
 	sysctlPath := "/proc/sys/net/ipv4/neigh/" + link.Attrs().Name + "/app_solicit"
 	err := ioutil.WriteFile(sysctlPath, []byte("3"), 0666)
@@ -71,24 +107,20 @@ func listenArp(link netlink.Link) error {
 }
 
 func (p *VxlanRoutingProvider) EnsureLink(me net.IP, cidr *net.IPNet) (netlink.Link, error) {
-	name := fmt.Sprintf("vxlan%d", p.vxlanID)
-
 	macAddress := mapToMAC(cidr.IP)
 
 	// TODO: Check if exists first?
 	link := &netlink.Vxlan{
 		LinkAttrs: netlink.LinkAttrs{
-			Name:         name,
 			MTU:          p.mtu,
 			HardwareAddr: macAddress,
 		},
-		VxlanId:      p.vxlanID,
 		VtepDevIndex: p.vtepIndex,
 		SrcAddr:      me,
-		Port:         p.vxlanPort,
 	}
+	p.vxlanConfig.Apply(link)
 
-	err := netlink.LinkAdd(link)
+	err := netutil.LinkAdd(link)
 	if err != nil {
 		// TODO: Reconfigure link?
 		klog.Warningf("Unable to create link; will reuse existing link: %v", err)
@@ -160,7 +192,8 @@ func (p *VxlanRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 	}
 
 	if p.link == nil {
-		p.routeTable = &netutil.RouteTable{}
+		// Every route via our device is ours, including those that earlier versions installed with RTPROT_BOOT
+		p.routeTable = &netutil.RouteTable{LegacyBootRoute: func(*netlink.Route) bool { return true }}
 
 		link, err := p.EnsureLink(me.Address, me.PodCIDR)
 		if err != nil {
@@ -190,15 +223,15 @@ func (p *VxlanRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 
 	linkIndex := p.link.Attrs().Index
 
-	var neighs []*netlink.Neigh
+	var neighs []*netutil.Neigh
 	var routes []*netlink.Route
 
-	// route whole overlay CIDR to vxlan
-	{
+	// route whole overlay CIDR, and any IPPools, to vxlan
+	for _, cidr := range append([]*net.IPNet{p.overlayCIDR}, nodeMap.PoolCIDRs()...) {
 		r := &netlink.Route{
 			LinkIndex: linkIndex,
-			Dst:       p.overlayCIDR,
-			Protocol:  syscall.RTPROT_BOOT,
+			Dst:       cidr,
+			Protocol:  netutil.RouteProtocol,
 			Table:     syscall.RT_TABLE_MAIN,
 			Type:      syscall.RTN_UNICAST,
 		}
@@ -225,14 +258,14 @@ func (p *VxlanRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 
 		// bridge fdb add to <remote-mac> dst <remote-ip> dev vxlan1
 		{
-			n := &netlink.Neigh{
+			n := &netutil.Neigh{Neigh: netlink.Neigh{
 				LinkIndex:    linkIndex,
 				State:        netlink.NUD_PERMANENT,
 				Family:       syscall.AF_BRIDGE,
 				Flags:        netlink.NTF_SELF,
 				IP:           remote.Address,
 				HardwareAddr: remoteMAC,
-			}
+			}}
 
 			neighs = append(neighs, n)
 		}
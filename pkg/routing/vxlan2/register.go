@@ -0,0 +1,23 @@
+package vxlan2
+
+import (
+	"kope.io/networking/pkg/routing"
+	"kope.io/networking/pkg/routing/netutil"
+)
+
+func init() {
+	routing.RegisterProvider(routing.ProviderFactory[netutil.VxlanConfig]{
+		Name:          "vxlan",
+		ConfigSection: "vxlan",
+		Migratable:    true,
+		SetDefaults:   (*netutil.VxlanConfig).SetDefaults,
+		Validate:      (*netutil.VxlanConfig).ValidateFields,
+		New: func(config *netutil.VxlanConfig, env *routing.ProviderEnvironment) (routing.Provider, error) {
+			return NewVxlanRoutingProvider(env.OverlayCIDR, env.TargetLinkNames, *config, env.MTUProber)
+		},
+		// Routes and neighbour entries are removed with the device
+		Cleanup: func(config *netutil.VxlanConfig) error {
+			return netutil.DeleteLink(config.Name())
+		},
+	})
+}
@@ -0,0 +1,161 @@
+package vxlan2
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"kope.io/networking/pkg/routing/netutil"
+)
+
+// underlayLink is a local interface that can carry vxlan traffic, with its IPv4 addresses and routes
+type underlayLink struct {
+	link  netlink.Link
+	addrs []*net.IPNet
+	// routes are the main-table routes via this link, excluding the ones we installed
+	routes []netlink.Route
+}
+
+// underlayPath is how we reach a remote node: the local interface, source address and (if not on-link) gateway
+type underlayPath struct {
+	link *underlayLink
+	src  net.IP
+	gw   net.IP
+}
+
+// loadUnderlayLinks reads the current addresses and routes of the named links
+func loadUnderlayLinks(names []string) ([]*underlayLink, error) {
+	var links []*underlayLink
+	for _, name := range names {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching target link %q: %w", name, err)
+		}
+
+		u := &underlayLink{link: link}
+
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return nil, fmt.Errorf("error listing addresses on %q: %w", name, err)
+		}
+		for _, addr := range addrs {
+			if addr.IPNet == nil || addr.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			u.addrs = append(u.addrs, addr.IPNet)
+		}
+
+		filter := &netlink.Route{LinkIndex: link.Attrs().Index, Table: syscall.RT_TABLE_MAIN}
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, fmt.Errorf("error listing routes via %q: %w", name, err)
+		}
+		for _, route := range routes {
+			// Ignore our own per-peer routes, otherwise a choice would stick after the underlying routes change
+			if route.Protocol == netutil.RouteProtocol {
+				continue
+			}
+			u.routes = append(u.routes, route)
+		}
+
+		links = append(links, u)
+	}
+	return links, nil
+}
+
+// selectUnderlay chooses how to reach remote: the link with an address on the same subnet,
+// otherwise the link with the most specific route (including a default route) to remote.
+// Ties go to the link listed first.  It returns nil if no link reaches remote.
+func selectUnderlay(links []*underlayLink, remote net.IP) *underlayPath {
+	var best *underlayPath
+	bestLen := -1
+
+	for _, u := range links {
+		for _, addr := range u.addrs {
+			ones, _ := addr.Mask.Size()
+			if addr.Contains(remote) && ones > bestLen {
+				best = &underlayPath{link: u, src: addr.IP}
+				bestLen = ones
+			}
+		}
+	}
+
+	for _, u := range links {
+		for i := range u.routes {
+			route := &u.routes[i]
+			ones := 0
+			if route.Dst != nil {
+				if !route.Dst.Contains(remote) {
+					continue
+				}
+				ones, _ = route.Dst.Mask.Size()
+			}
+			if ones <= bestLen {
+				continue
+			}
+			src := route.Src
+			if src == nil {
+				src = u.sourceFor(route.Gw)
+			}
+			if src == nil {
+				continue
+			}
+			best = &underlayPath{link: u, src: src, gw: route.Gw}
+			bestLen = ones
+		}
+	}
+
+	return best
+}
+
+// sourceFor returns the address on the link in the same subnet as gw, or the first address if there is none
+func (u *underlayLink) sourceFor(gw net.IP) net.IP {
+	if len(u.addrs) == 0 {
+		return nil
+	}
+	if gw != nil {
+		for _, addr := range u.addrs {
+			if addr.Contains(gw) {
+				return addr.IP
+			}
+		}
+	}
+	return u.addrs[0].IP
+}
+
+// buildRoute returns the host route that pins traffic to remote to this path
+func (p *underlayPath) buildRoute(remote net.IP) *netlink.Route {
+	route := &netlink.Route{
+		LinkIndex: p.link.link.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       &net.IPNet{IP: remote.To4(), Mask: net.CIDRMask(32, 32)},
+		Src:       p.src,
+		Gw:        p.gw,
+		Protocol:  netutil.RouteProtocol,
+		Table:     syscall.RT_TABLE_MAIN,
+		Type:      syscall.RTN_UNICAST,
+	}
+	if p.gw == nil {
+		route.Scope = netlink.SCOPE_LINK
+	}
+	return route
+}
+
+// ownsUnderlayRoute is true if route is one of our host routes pinning a peer to a target link.
+// Other providers may install routes with our protocol on the target links, for example layer2 during a migration;
+// theirs go into the pod network and do not set a source address.
+func (p *VxlanRoutingProvider) ownsUnderlayRoute(route *netlink.Route) bool {
+	if route.Dst == nil || route.Src == nil {
+		return false
+	}
+	if ones, bits := route.Dst.Mask.Size(); ones != 32 || bits != 32 {
+		return false
+	}
+	for _, cidr := range p.podCIDRs {
+		if cidr != nil && cidr.Contains(route.Dst.IP) {
+			return false
+		}
+	}
+	return true
+}
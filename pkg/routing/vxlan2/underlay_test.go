@@ -0,0 +1,78 @@
+package vxlan2
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func buildTestUnderlay(name string, index int, addrs []string, routes map[string]string) *underlayLink {
+	u := &underlayLink{
+		link: &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: name, Index: index}},
+	}
+	for _, addr := range addrs {
+		ip, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			panic(err)
+		}
+		ipnet.IP = ip
+		u.addrs = append(u.addrs, ipnet)
+	}
+	for dst, gw := range routes {
+		route := netlink.Route{LinkIndex: index, Gw: net.ParseIP(gw)}
+		if dst != "default" {
+			_, route.Dst, _ = net.ParseCIDR(dst)
+		}
+		u.routes = append(u.routes, route)
+	}
+	return u
+}
+
+func TestSelectUnderlay(t *testing.T) {
+	cluster := buildTestUnderlay("eth0", 2, []string{"10.0.0.5/24"}, map[string]string{
+		"default": "10.0.0.1",
+	})
+	storage := buildTestUnderlay("eth1", 3, []string{"192.168.10.5/24"}, map[string]string{
+		"192.168.0.0/16": "192.168.10.1",
+	})
+	links := []*underlayLink{cluster, storage}
+
+	grid := []struct {
+		remote string
+		link   string
+		src    string
+		gw     string
+	}{
+		// Same subnet as an interface
+		{remote: "10.0.0.9", link: "eth0", src: "10.0.0.5"},
+		{remote: "192.168.10.9", link: "eth1", src: "192.168.10.5"},
+		// A more specific route beats the default route
+		{remote: "192.168.20.9", link: "eth1", src: "192.168.10.5", gw: "192.168.10.1"},
+		// Only the default route matches
+		{remote: "172.16.0.9", link: "eth0", src: "10.0.0.5", gw: "10.0.0.1"},
+	}
+	for _, g := range grid {
+		path := selectUnderlay(links, net.ParseIP(g.remote))
+		if path == nil {
+			t.Errorf("no path selected for %s", g.remote)
+			continue
+		}
+		if path.link.link.Attrs().Name != g.link || path.src.String() != g.src || (g.gw != "" && path.gw.String() != g.gw) || (g.gw == "" && path.gw != nil) {
+			t.Errorf("unexpected path for %s: %s src %s via %s", g.remote, path.link.link.Attrs().Name, path.src, path.gw)
+		}
+
+		route := path.buildRoute(net.ParseIP(g.remote))
+		if route.Dst.String() != g.remote+"/32" || route.LinkIndex != path.link.link.Attrs().Index {
+			t.Errorf("unexpected route for %s: %v", g.remote, route)
+		}
+		if (g.gw == "") != (route.Scope == netlink.SCOPE_LINK) {
+			t.Errorf("unexpected scope for %s: %v", g.remote, route.Scope)
+		}
+	}
+
+	// Without a default route, an unknown destination is not reachable through any link
+	if path := selectUnderlay([]*underlayLink{storage}, net.ParseIP("172.16.0.9")); path != nil {
+		t.Errorf("unexpected path for unreachable destination: %s", path.link.link.Attrs().Name)
+	}
+}
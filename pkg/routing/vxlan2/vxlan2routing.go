@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"strings"
 	"syscall"
 
 	"github.com/vishvananda/netlink"
@@ -15,11 +16,27 @@ import (
 type VxlanRoutingProvider struct {
 	overlayCIDR *net.IPNet
 
-	vxlanID   int
-	vtepIndex int
-	vxlanPort int
+	vxlanConfig netutil.VxlanConfig
+	vtepIndex   int
 
-	mtu int
+	// underlayNames are the target links.  With more than one, we choose the link and source address per peer,
+	// and pin the choice with a host route to the peer, because the vxlan device has no fixed source address.
+	underlayNames      []string
+	underlayRouteTable *netutil.RouteTable
+	// staleUnderlayNames are target links we no longer use, from which we must remove our host routes
+	staleUnderlayNames []string
+
+	// podCIDRs is the pod network, the overlay CIDR and the IPPool CIDRs, as last seen in EnsureCIDRs.
+	// Routes into it on the target links belong to other providers, for example during a migration.
+	podCIDRs []*net.IPNet
+
+	// underlayMTU is the smallest MTU of the target links; mtu is the MTU of the vxlan device
+	underlayMTU int
+	mtu         int
+
+	// mtuProber is optional; if set we lower the MTU of routes to peers with a smaller path MTU
+	mtuProber            *netutil.PathMTUProber
+	lastMTUProberVersion uint64
 
 	link       *netlink.Vxlan
 	routeTable *netutil.RouteTable
@@ -29,17 +46,55 @@ type VxlanRoutingProvider struct {
 }
 
 var _ routing.Provider = &VxlanRoutingProvider{}
+var _ routing.MTUConfigurable = &VxlanRoutingProvider{}
+var _ routing.AgentDescriber = &VxlanRoutingProvider{}
+var _ routing.EnvironmentConfigurable = &VxlanRoutingProvider{}
+
+// NewVxlanRoutingProvider builds a VxlanRoutingProvider.
+// mtuProber is optional; if nil we don't probe the path MTU to peers.
+func NewVxlanRoutingProvider(overlayCIDR *net.IPNet, deviceNames []string, vxlanConfig netutil.VxlanConfig, mtuProber *netutil.PathMTUProber) (*VxlanRoutingProvider, error) {
+	if err := vxlanConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid vxlan configuration: %w", err)
+	}
 
-func NewVxlanRoutingProvider(overlayCIDR *net.IPNet, deviceNames []string) (*VxlanRoutingProvider, error) {
-	minMTU := 0
+	minMTU, err := loadUnderlayMTU(deviceNames)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &VxlanRoutingProvider{
+		overlayCIDR: overlayCIDR,
 
+		vxlanConfig: vxlanConfig,
+		vtepIndex:   0,
+
+		underlayNames: deviceNames,
+
+		underlayMTU: minMTU,
+		mtu:         minMTU - netutil.VxlanOverhead,
+		mtuProber:   mtuProber,
+
+		podCIDRs: []*net.IPNet{overlayCIDR},
+	}
+	p.underlayRouteTable = &netutil.RouteTable{Owns: p.ownsUnderlayRoute}
+	klog.Infof("using MTU %d (min underlay MTU %d - vxlan overhead %d)", p.mtu, minMTU, netutil.VxlanOverhead)
+	if p.multiUnderlay() {
+		klog.Infof("choosing underlay link per peer from %v", deviceNames)
+	}
+
+	return p, nil
+}
+
+// loadUnderlayMTU returns the smallest MTU of the target links
+func loadUnderlayMTU(deviceNames []string) (int, error) {
+	minMTU := 0
 	for _, deviceName := range deviceNames {
 		underlyingLink, err := netlink.LinkByName(deviceName)
 		if err != nil {
-			return nil, fmt.Errorf("error fetching target link %q: %v", deviceName, err)
+			return 0, fmt.Errorf("error fetching target link %q: %v", deviceName, err)
 		}
 		if underlyingLink == nil {
-			return nil, fmt.Errorf("target link not found %q", deviceName)
+			return 0, fmt.Errorf("target link not found %q", deviceName)
 		}
 
 		mtu := underlyingLink.Attrs().MTU
@@ -48,43 +103,110 @@ func NewVxlanRoutingProvider(overlayCIDR *net.IPNet, deviceNames []string) (*Vxl
 		}
 		klog.Infof("link %q has mtu %d", deviceName, mtu)
 	}
+	return minMTU, nil
+}
 
-	p := &VxlanRoutingProvider{
-		overlayCIDR: overlayCIDR,
+// multiUnderlay is true if we have more than one target link, and so choose the underlay per peer
+func (p *VxlanRoutingProvider) multiUnderlay() bool {
+	return len(p.underlayNames) > 1
+}
+
+// SetMTU sets the MTU of the vxlan device; zero means the smallest underlay MTU less the vxlan overhead.
+// The change is applied in place on the next call to EnsureCIDRs.
+func (p *VxlanRoutingProvider) SetMTU(mtu int) {
+	if mtu == 0 {
+		mtu = p.underlayMTU - netutil.VxlanOverhead
+	}
+	if mtu == p.mtu {
+		return
+	}
+	klog.Infof("changing MTU from %d to %d", p.mtu, mtu)
+	p.mtu = mtu
 
-		vxlanID:   1,
-		vtepIndex: 0,
-		vxlanPort: 4789,
+	// Re-ensuring the link corrects its MTU; rebuilding the routes corrects any per-peer MTUs
+	p.link = nil
+	p.lastVersionApplied = 0
+}
 
-		mtu: minMTU - 100,
+// SetEnvironment changes the target links and the path MTU prober.
+// The change is applied in place on the next call to EnsureCIDRs; the vxlan device is only recreated if it must change,
+// which is when we move between one and several target links.  The MTU is not changed: callers should call SetMTU afterwards.
+func (p *VxlanRoutingProvider) SetEnvironment(env *routing.ProviderEnvironment) error {
+	underlayMTU, err := loadUnderlayMTU(env.TargetLinkNames)
+	if err != nil {
+		return err
 	}
-	klog.Warningf("MTU hard-coded to min MTU - 100 = %d", p.mtu)
 
-	return p, nil
+	if p.multiUnderlay() {
+		p.staleUnderlayNames = append(p.staleUnderlayNames, p.underlayNames...)
+	}
+	p.underlayNames = env.TargetLinkNames
+	p.underlayMTU = underlayMTU
+	p.mtuProber = env.MTUProber
+	p.lastMTUProberVersion = 0
+
+	p.link = nil
+	p.lastVersionApplied = 0
+	return nil
+}
+
+// DescribeAgent advertises our vxlan device
+func (p *VxlanRoutingProvider) DescribeAgent(info *routing.AgentInfo) {
+	info.Encapsulations = append(info.Encapsulations, routing.Encapsulation{Type: "vxlan", Port: p.vxlanConfig.Port, VNI: p.vxlanConfig.VNI})
+	info.MTU = p.mtu
 }
 
 func (p *VxlanRoutingProvider) Close() error {
 	return nil
 }
 
+// Teardown removes the vxlan device, and with it our routes and neighbour entries,
+// along with the host routes pinning peers to an underlay link.
+func (p *VxlanRoutingProvider) Teardown() error {
+	if err := netutil.DeleteLink(p.vxlanConfig.Name()); err != nil {
+		return err
+	}
+	p.link = nil
+	p.lastVersionApplied = 0
+
+	underlayNames := p.staleUnderlayNames
+	if p.multiUnderlay() {
+		underlayNames = append(underlayNames, p.underlayNames...)
+	}
+	for _, name := range underlayNames {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("error fetching target link %q: %w", name, err)
+		}
+		if err := p.underlayRouteTable.Ensure(link, nil, true); err != nil {
+			return fmt.Errorf("error removing underlay routes via %q: %w", name, err)
+		}
+	}
+	p.staleUnderlayNames = nil
+	return nil
+}
+
 func (p *VxlanRoutingProvider) EnsureLink(me net.IP, cidr *net.IPNet) (netlink.Link, error) {
-	name := fmt.Sprintf("vxlan%d", p.vxlanID)
+	name := p.vxlanConfig.Name()
 
 	macAddress := mapToMAC(cidr.IP)
 
-	// TODO: Check if exists first?
+	// With multiple underlay links, the source address depends on the peer, and comes from the host route to it
+	srcAddr := me
+	if p.multiUnderlay() {
+		srcAddr = nil
+	}
+
 	expected := &netlink.Vxlan{
 		LinkAttrs: netlink.LinkAttrs{
-			Name:         name,
 			MTU:          p.mtu,
 			HardwareAddr: macAddress,
 		},
 		Learning:     false,
-		VxlanId:      p.vxlanID,
 		VtepDevIndex: p.vtepIndex,
-		SrcAddr:      me,
-		Port:         p.vxlanPort,
+		SrcAddr:      srcAddr,
 	}
+	p.vxlanConfig.Apply(expected)
 
 	actual, err := netlink.LinkByName(name)
 	if err != nil {
@@ -96,8 +218,28 @@ func (p *VxlanRoutingProvider) EnsureLink(me net.IP, cidr *net.IPNet) (netlink.L
 		}
 	}
 
+	if actual != nil {
+		// MTU and MAC address are corrected in place below; anything else requires recreating the device
+		diffs, _ := netutil.LinkDiff(actual, expected)
+		if v, ok := actual.(*netlink.Vxlan); ok && srcAddr == nil && v.SrcAddr != nil {
+			diffs = append(diffs, fmt.Sprintf("local is %s, expected none", v.SrcAddr))
+		}
+		if len(diffs) != 0 {
+			klog.Warningf("existing link %q does not match our configuration and will be recreated: %s", name, strings.Join(diffs, ", "))
+			klog.V(2).Infof("existing link is %#v", actual)
+
+			klog.Infof("NETLINK: ip link del %s", name)
+			if err := netlink.LinkDel(actual); err != nil {
+				return nil, fmt.Errorf("unable to delete misconfigured link %q: %w", name, err)
+			}
+			actual = nil
+		} else {
+			klog.Infof("reusing existing link %q", name)
+		}
+	}
+
 	if actual == nil {
-		if err := netlink.LinkAdd(expected); err != nil {
+		if err := netutil.LinkAdd(expected); err != nil {
 			klog.Infof("failed to create link %#v", expected)
 			return nil, fmt.Errorf("unable to create link %q: %w", name, err)
 		}
@@ -108,10 +250,6 @@ func (p *VxlanRoutingProvider) EnsureLink(me net.IP, cidr *net.IPNet) (netlink.L
 			return nil, fmt.Errorf("error retrieving link %q after creation: %w", expected.Name, err)
 		}
 		actual = found
-	} else {
-		// TODO: Check for differences and reconfigure?
-		klog.V(2).Infof("existing link is %#v", actual)
-		klog.Infof("reusing existing link %q", name)
 	}
 
 	if !bytes.Equal(actual.Attrs().HardwareAddr, macAddress) {
@@ -157,11 +295,16 @@ func (p *VxlanRoutingProvider) EnsureLink(me net.IP, cidr *net.IPNet) (netlink.L
 }
 
 func (p *VxlanRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
-	if p.lastVersionApplied != 0 && nodeMap.IsVersion(p.lastVersionApplied) {
+	var mtuProberVersion uint64
+	if p.mtuProber != nil {
+		mtuProberVersion = p.mtuProber.Version()
+	}
+	if p.lastVersionApplied != 0 && nodeMap.IsVersion(p.lastVersionApplied) && mtuProberVersion == p.lastMTUProberVersion {
 		return nil
 	}
 
 	me, allNodes, version := nodeMap.Snapshot()
+	p.podCIDRs = append([]*net.IPNet{p.overlayCIDR}, nodeMap.PoolCIDRs()...)
 
 	if me == nil {
 		return fmt.Errorf("Cannot find local node")
@@ -176,7 +319,8 @@ func (p *VxlanRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 	}
 
 	if p.link == nil {
-		p.routeTable = &netutil.RouteTable{}
+		// Every route via our device is ours, including those that earlier versions installed with RTPROT_BOOT
+		p.routeTable = &netutil.RouteTable{LegacyBootRoute: func(*netlink.Route) bool { return true }}
 
 		link, err := p.EnsureLink(me.Address, me.PodCIDR)
 		if err != nil {
@@ -191,7 +335,21 @@ func (p *VxlanRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 
 	linkIndex := p.link.Attrs().Index
 
-	var neighs []*netlink.Neigh
+	// We re-read the underlay links each time, as addresses and routes can change.
+	// Note that we only notice such changes when the node map or path MTUs change.
+	var underlays []*underlayLink
+	underlayRoutes := make(map[int][]*netlink.Route)
+	// Several nodes behind the same NAT share an endpoint IP, which needs only one route
+	pinnedEndpoints := make(map[string]bool)
+	if p.multiUnderlay() {
+		var err error
+		underlays, err = loadUnderlayLinks(p.underlayNames)
+		if err != nil {
+			return err
+		}
+	}
+
+	var neighs []*netutil.Neigh
 	var routes []*netlink.Route
 
 	for i := range allNodes {
@@ -212,22 +370,32 @@ func (p *VxlanRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 
 		remoteMAC := mapToMAC(remote.PodCIDR.IP)
 
-		arp := &netlink.Neigh{
+		// Nodes behind NAT are reached at their public endpoint rather than their address
+		endpointIP, endpointPort := remote.TunnelEndpoint(p.vxlanConfig.Port)
+		if endpointPort == p.vxlanConfig.Port {
+			// The kernel reports the device's port as no port
+			endpointPort = 0
+		}
+
+		arp := &netutil.Neigh{Neigh: netlink.Neigh{
 			LinkIndex:    linkIndex,
 			Family:       netlink.FAMILY_V4,
 			State:        netlink.NUD_PERMANENT,
 			Type:         syscall.RTN_UNICAST,
 			IP:           remote.PodCIDR.IP,
 			HardwareAddr: remoteMAC,
-		}
+		}}
 		neighs = append(neighs, arp)
-		fdb := &netlink.Neigh{
-			LinkIndex:    linkIndex,
-			State:        netlink.NUD_PERMANENT,
-			Family:       syscall.AF_BRIDGE,
-			Flags:        netlink.NTF_SELF,
-			IP:           remote.Address,
-			HardwareAddr: remoteMAC,
+		fdb := &netutil.Neigh{
+			Neigh: netlink.Neigh{
+				LinkIndex:    linkIndex,
+				State:        netlink.NUD_PERMANENT,
+				Family:       syscall.AF_BRIDGE,
+				Flags:        netlink.NTF_SELF,
+				IP:           endpointIP,
+				HardwareAddr: remoteMAC,
+			},
+			Port: endpointPort,
 		}
 		neighs = append(neighs, fdb)
 
@@ -236,11 +404,32 @@ func (p *VxlanRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 			Scope:     netlink.SCOPE_UNIVERSE,
 			Dst:       remote.PodCIDR,
 			Gw:        remote.PodCIDR.IP,
-			Protocol:  syscall.RTPROT_BOOT,
+			Protocol:  netutil.RouteProtocol,
 			Table:     syscall.RT_TABLE_MAIN,
 			Type:      syscall.RTN_UNICAST,
 		}
 		route.SetFlag(syscall.RTNH_F_ONLINK)
+		underlayMTU := p.underlayMTU
+		if p.multiUnderlay() {
+			path := selectUnderlay(underlays, endpointIP)
+			if path == nil {
+				klog.Warningf("no target link reaches node %q at %s; using the kernel's choice", remote.Name, endpointIP)
+			} else {
+				klog.V(2).Infof("reaching node %q at %s via %s from %s", remote.Name, endpointIP, path.link.link.Attrs().Name, path.src)
+				if !pinnedEndpoints[endpointIP.String()] {
+					pinnedEndpoints[endpointIP.String()] = true
+					index := path.link.link.Attrs().Index
+					underlayRoutes[index] = append(underlayRoutes[index], path.buildRoute(endpointIP))
+				}
+				underlayMTU = path.link.link.Attrs().MTU
+			}
+		}
+
+		if p.mtuProber != nil {
+			if pathMTU, ok := p.mtuProber.PathMTU(endpointIP, underlayMTU); ok && pathMTU-netutil.VxlanOverhead < p.mtu {
+				route.MTU = pathMTU - netutil.VxlanOverhead
+			}
+		}
 		routes = append(routes, route)
 	}
 
@@ -256,7 +445,34 @@ func (p *VxlanRoutingProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
 		return fmt.Errorf("error applying route table: %v", err)
 	}
 
+	// Each underlay link only holds the host routes to the peers we reach through it
+	inUse := make(map[string]bool)
+	for _, u := range underlays {
+		inUse[u.link.Attrs().Name] = true
+		err = p.underlayRouteTable.Ensure(u.link, underlayRoutes[u.link.Attrs().Index], deleteExtraRoutes)
+		if err != nil {
+			return fmt.Errorf("error applying underlay routes via %q: %v", u.link.Attrs().Name, err)
+		}
+	}
+	for _, name := range p.staleUnderlayNames {
+		if inUse[name] {
+			continue
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				continue
+			}
+			return fmt.Errorf("error fetching target link %q: %w", name, err)
+		}
+		if err := p.underlayRouteTable.Ensure(link, nil, deleteExtraRoutes); err != nil {
+			return fmt.Errorf("error removing underlay routes via %q: %v", name, err)
+		}
+	}
+	p.staleUnderlayNames = nil
+
 	p.lastVersionApplied = version
+	p.lastMTUProberVersion = mtuProberVersion
 
 	return nil
 }
@@ -0,0 +1,215 @@
+package vxlan2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"kope.io/networking/pkg/routing"
+	"kope.io/networking/pkg/routing/netutil"
+	"kope.io/networking/pkg/testutil"
+)
+
+// podRouteProvider stands in for a provider like layer2, routing PodCIDRs over the target links with our protocol
+type podRouteProvider struct {
+	link netlink.Link
+}
+
+func (p *podRouteProvider) EnsureCIDRs(nodeMap *routing.NodeMap) error {
+	me, nodes, _ := nodeMap.Snapshot()
+	for _, node := range nodes {
+		if node.Name == me.Name {
+			continue
+		}
+		route := &netlink.Route{
+			LinkIndex: p.link.Attrs().Index,
+			Dst:       node.PodCIDR,
+			Gw:        node.Address,
+			Protocol:  netutil.RouteProtocol,
+			Table:     syscall.RT_TABLE_MAIN,
+			Type:      syscall.RTN_UNICAST,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *podRouteProvider) Teardown() error {
+	return nil
+}
+
+func setupTestTargetLink(t *testing.T, name string, cidr string) netlink.Link {
+	link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "-peer"}
+	if err := netlink.LinkAdd(link); err != nil {
+		t.Fatalf("error creating veth link: %v", err)
+	}
+	if err := netlink.LinkSetUp(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: link.PeerName}}); err != nil {
+		t.Fatalf("error setting peer link up: %v", err)
+	}
+	addr, err := netlink.ParseAddr(cidr)
+	if err != nil {
+		t.Fatalf("error parsing address: %v", err)
+	}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		t.Fatalf("error adding address: %v", err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		t.Fatalf("error setting link up: %v", err)
+	}
+	actual, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatalf("error getting link: %v", err)
+	}
+	return actual
+}
+
+func buildTestNode(name string, address string, podCIDR string, providers ...string) *corev1.Node {
+	b, _ := json.Marshal(&routing.AgentInfo{Providers: providers})
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{routing.AgentAnnotation: string(b)}},
+		Spec:       corev1.NodeSpec{PodCIDR: podCIDR},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: address}},
+		},
+	}
+}
+
+// listTargetLinkRoutes returns the routes with our protocol on the target links
+func listTargetLinkRoutes(t *testing.T, links ...netlink.Link) []string {
+	var out []string
+	for _, link := range links {
+		routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+		if err != nil {
+			t.Fatalf("error listing routes: %v", err)
+		}
+		for _, r := range routes {
+			if r.Protocol != netutil.RouteProtocol {
+				continue
+			}
+			s := fmt.Sprintf("%s dev %s", r.Dst, link.Attrs().Name)
+			if r.Gw != nil {
+				s += fmt.Sprintf(" via %s", r.Gw)
+			}
+			if r.Src != nil {
+				s += fmt.Sprintf(" src %s", r.Src)
+			}
+			out = append(out, s)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// TestUnderlayRoutesDuringMigration checks that we only remove our own host routes from the target links,
+// and not the routes of the provider we are migrating from.
+func TestUnderlayRoutesDuringMigration(t *testing.T) {
+	testutil.EnterNetNS(t)
+
+	eth0 := setupTestTargetLink(t, "eth0", "10.1.0.1/24")
+	eth1 := setupTestTargetLink(t, "eth1", "10.2.0.1/24")
+
+	m := routing.NewNodeMap(func(node *corev1.Node) bool { return node.Name == "node1" }, nil)
+	m.UpdateNode(buildTestNode("node1", "10.1.0.1", "100.96.0.0/24", "layer2", "vxlan"))
+	m.UpdateNode(buildTestNode("node2", "10.1.0.2", "100.96.1.0/24", "layer2", "vxlan"))
+	m.UpdateNode(buildTestNode("node3", "10.1.0.3", "100.96.2.0/24", "layer2"))
+	m.SetPoolCIDRs([]*net.IPNet{{IP: net.IPv4(100, 97, 0, 0), Mask: net.CIDRMask(24, 32)}})
+	m.MarkReady()
+
+	_, overlayCIDR, _ := net.ParseCIDR("100.96.0.0/16")
+	to, err := NewVxlanRoutingProvider(overlayCIDR, []string{"eth0", "eth1"}, netutil.DefaultVxlanConfig(), nil)
+	if err != nil {
+		t.Fatalf("error building provider: %v", err)
+	}
+	p := routing.NewMigrationProvider("layer2", &podRouteProvider{link: eth0}, "vxlan", to)
+
+	// A host route we installed for a node that has since gone away
+	if err := to.underlayRouteTable.Ensure(eth1, []*netlink.Route{{
+		LinkIndex: eth1.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       &net.IPNet{IP: net.IPv4(10, 2, 0, 9).To4(), Mask: net.CIDRMask(32, 32)},
+		Src:       net.IPv4(10, 2, 0, 1),
+		Protocol:  netutil.RouteProtocol,
+		Table:     syscall.RT_TABLE_MAIN,
+		Type:      syscall.RTN_UNICAST,
+	}}, false); err != nil {
+		t.Fatalf("error adding stale route: %v", err)
+	}
+
+	if err := p.EnsureCIDRs(m); err != nil {
+		t.Fatalf("error from EnsureCIDRs: %v", err)
+	}
+	expected := []string{
+		"10.1.0.2/32 dev eth0 src 10.1.0.1",
+		"100.96.2.0/24 dev eth0 via 10.1.0.3",
+	}
+	if actual := listTargetLinkRoutes(t, eth0, eth1); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected routes after EnsureCIDRs:\n\tactual:   %v\n\texpected: %v", actual, expected)
+	}
+
+	if err := to.Teardown(); err != nil {
+		t.Fatalf("error from Teardown: %v", err)
+	}
+	expected = []string{
+		"100.96.2.0/24 dev eth0 via 10.1.0.3",
+	}
+	if actual := listTargetLinkRoutes(t, eth0, eth1); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected routes after Teardown:\n\tactual:   %v\n\texpected: %v", actual, expected)
+	}
+}
+
+// TestSetEnvironment checks that changing the target links keeps the vxlan device, and moves our host routes
+func TestSetEnvironment(t *testing.T) {
+	testutil.EnterNetNS(t)
+
+	eth0 := setupTestTargetLink(t, "eth0", "10.1.0.1/24")
+	eth1 := setupTestTargetLink(t, "eth1", "10.2.0.1/24")
+	eth2 := setupTestTargetLink(t, "eth2", "10.3.0.1/24")
+
+	m := routing.NewNodeMap(func(node *corev1.Node) bool { return node.Name == "node1" }, nil)
+	m.UpdateNode(buildTestNode("node1", "10.1.0.1", "100.96.0.0/24", "vxlan"))
+	m.UpdateNode(buildTestNode("node2", "10.2.0.2", "100.96.1.0/24", "vxlan"))
+	m.UpdateNode(buildTestNode("node3", "10.3.0.3", "100.96.2.0/24", "vxlan"))
+	m.MarkReady()
+
+	_, overlayCIDR, _ := net.ParseCIDR("100.96.0.0/16")
+	p, err := NewVxlanRoutingProvider(overlayCIDR, []string{"eth0", "eth1", "eth2"}, netutil.DefaultVxlanConfig(), nil)
+	if err != nil {
+		t.Fatalf("error building provider: %v", err)
+	}
+	if err := p.EnsureCIDRs(m); err != nil {
+		t.Fatalf("error from EnsureCIDRs: %v", err)
+	}
+	expected := []string{
+		"10.2.0.2/32 dev eth1 src 10.2.0.1",
+		"10.3.0.3/32 dev eth2 src 10.3.0.1",
+	}
+	if actual := listTargetLinkRoutes(t, eth0, eth1, eth2); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected routes:\n\tactual:   %v\n\texpected: %v", actual, expected)
+	}
+	index := p.link.Attrs().Index
+
+	if err := p.SetEnvironment(&routing.ProviderEnvironment{TargetLinkNames: []string{"eth0", "eth1"}}); err != nil {
+		t.Fatalf("error from SetEnvironment: %v", err)
+	}
+	if err := p.EnsureCIDRs(m); err != nil {
+		t.Fatalf("error from EnsureCIDRs: %v", err)
+	}
+	expected = []string{
+		"10.2.0.2/32 dev eth1 src 10.2.0.1",
+	}
+	if actual := listTargetLinkRoutes(t, eth0, eth1, eth2); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected routes after SetEnvironment:\n\tactual:   %v\n\texpected: %v", actual, expected)
+	}
+	if p.link.Attrs().Index != index {
+		t.Errorf("vxlan device was recreated")
+	}
+}
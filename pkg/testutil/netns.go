@@ -0,0 +1,44 @@
+// Package testutil holds helpers shared by the tests of several packages.
+package testutil
+
+import (
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netns"
+)
+
+// EnterNetNS moves the calling goroutine into a new, empty network namespace for the duration of the test.
+// The goroutine is locked to its thread, so netlink calls made from the test affect only the throwaway namespace.
+func EnterNetNS(t testing.TB) netns.NsHandle {
+	if os.Geteuid() != 0 {
+		t.Skip("test requires root to create a network namespace")
+	}
+
+	runtime.LockOSThread()
+
+	original, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Fatalf("error getting current network namespace: %v", err)
+	}
+
+	ns, err := netns.New()
+	if err != nil {
+		original.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("unable to create network namespace: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if err := netns.Set(original); err != nil {
+			t.Errorf("error restoring network namespace: %v", err)
+		}
+		original.Close()
+		ns.Close()
+		runtime.UnlockOSThread()
+	})
+
+	return ns
+}
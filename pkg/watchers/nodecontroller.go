@@ -3,6 +3,7 @@ package watchers
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -17,18 +18,36 @@ import (
 type NodeController struct {
 	kubeClient kubernetes.Interface
 	nodeMap    *routing.NodeMap
+
+	// resyncPeriod is how often we relist all nodes, as a time.Duration; zero means we only relist when the watch ends
+	resyncPeriod atomic.Int64
+	// resyncChanged is signalled when resyncPeriod changes
+	resyncChanged chan struct{}
 }
 
 // newNodeController creates a nodeController
-func NewNodeController(kubeClient kubernetes.Interface, nodeMap *routing.NodeMap) (*NodeController, error) {
+func NewNodeController(kubeClient kubernetes.Interface, nodeMap *routing.NodeMap, resyncPeriod time.Duration) (*NodeController, error) {
 	c := &NodeController{
-		kubeClient: kubeClient,
-		nodeMap:    nodeMap,
+		kubeClient:    kubeClient,
+		nodeMap:       nodeMap,
+		resyncChanged: make(chan struct{}, 1),
 	}
+	c.resyncPeriod.Store(int64(resyncPeriod))
 
 	return c, nil
 }
 
+// SetResyncPeriod changes how often we relist all nodes; we relist immediately and then on the new period
+func (c *NodeController) SetResyncPeriod(resyncPeriod time.Duration) {
+	if time.Duration(c.resyncPeriod.Swap(int64(resyncPeriod))) == resyncPeriod {
+		return
+	}
+	select {
+	case c.resyncChanged <- struct{}{}:
+	default:
+	}
+}
+
 // Run starts the NodeController.
 func (c *NodeController) Run(ctx context.Context) {
 	klog.Infof("starting node controller")
@@ -64,12 +83,25 @@ func (c *NodeController) runWatcher(ctx context.Context) {
 		}
 		defer watcher.Stop()
 
+		var resync <-chan time.Time
+		if resyncPeriod := time.Duration(c.resyncPeriod.Load()); resyncPeriod > 0 {
+			timer := time.NewTimer(resyncPeriod)
+			defer timer.Stop()
+			resync = timer.C
+		}
+
 		ch := watcher.ResultChan()
 		for {
 			select {
 			case <-ctx.Done():
 				klog.Infof("Got stop signal")
 				return true, ctx.Err()
+			case <-resync:
+				klog.V(2).Infof("resync period elapsed; relisting nodes")
+				return false, nil
+			case <-c.resyncChanged:
+				klog.Infof("resync period changed; relisting nodes")
+				return false, nil
 			case event, ok := <-ch:
 				if !ok {
 					klog.Infof("node watch channel closed")
@@ -0,0 +1,152 @@
+package watchers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+	networkingv1alpha1 "kope.io/networking/pkg/apis/networking/v1alpha1"
+)
+
+// crdMissingRetryInterval is how often we check whether the IPPool CRD has been installed
+const crdMissingRetryInterval = time.Minute
+
+// PoolController watches IPPools, calling onChange with all the pools (sorted by name) whenever they change
+type PoolController struct {
+	dynamicClient dynamic.Interface
+	onChange      func(pools []networkingv1alpha1.IPPool)
+
+	pools map[string]networkingv1alpha1.IPPool
+}
+
+// NewPoolController creates a PoolController
+func NewPoolController(dynamicClient dynamic.Interface, onChange func(pools []networkingv1alpha1.IPPool)) (*PoolController, error) {
+	c := &PoolController{
+		dynamicClient: dynamicClient,
+		onChange:      onChange,
+	}
+	return c, nil
+}
+
+// Run starts the PoolController.
+func (c *PoolController) Run(ctx context.Context) {
+	klog.Infof("starting pool controller")
+
+	for {
+		err := c.runOnce(ctx)
+		if ctx.Err() != nil {
+			klog.Infof("exiting pool controller")
+			return
+		}
+
+		retryInterval := time.Duration(0)
+		if apierrors.IsNotFound(err) {
+			klog.V(2).Infof("IPPool CRD is not installed; will check again in %v", crdMissingRetryInterval)
+			retryInterval = crdMissingRetryInterval
+		} else if err != nil {
+			klog.Warningf("Unexpected error in pool watch, will restart watch: %v", err)
+			retryInterval = 10 * time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			klog.Infof("exiting pool controller")
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+func (c *PoolController) runOnce(ctx context.Context) error {
+	client := c.dynamicClient.Resource(networkingv1alpha1.IPPoolResource)
+
+	var listOpts metav1.ListOptions
+	listOpts.AllowWatchBookmarks = true
+
+	list, err := client.List(ctx, listOpts)
+	if err != nil {
+		return err
+	}
+	c.pools = make(map[string]networkingv1alpha1.IPPool)
+	for i := range list.Items {
+		pool, err := convertPool(&list.Items[i])
+		if err != nil {
+			klog.Warningf("ignoring pool: %v", err)
+			continue
+		}
+		c.pools[pool.Name] = *pool
+	}
+	c.notify()
+
+	listOpts.Watch = true
+	listOpts.ResourceVersion = list.GetResourceVersion()
+	klog.Infof("starting pool watch from %s", listOpts.ResourceVersion)
+	watcher, err := client.Watch(ctx, listOpts)
+	if err != nil {
+		return fmt.Errorf("error watching pools: %w", err)
+	}
+	defer watcher.Stop()
+
+	ch := watcher.ResultChan()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-ch:
+			if !ok {
+				klog.Infof("pool watch channel closed")
+				return nil
+			}
+
+			if event.Type == watch.Error {
+				return fmt.Errorf("error from watch: %v", event.Object)
+			}
+			if event.Type == watch.Bookmark {
+				continue
+			}
+
+			u, ok := event.Object.(*unstructured.Unstructured)
+			if !ok {
+				return fmt.Errorf("object had unexpected type %T", event.Object)
+			}
+			klog.V(4).Infof("pool changed: %s %v", event.Type, u.GetName())
+
+			pool, err := convertPool(u)
+			if err != nil {
+				klog.Warningf("ignoring pool: %v", err)
+				delete(c.pools, u.GetName())
+			} else if event.Type == watch.Deleted {
+				delete(c.pools, pool.Name)
+			} else {
+				c.pools[pool.Name] = *pool
+			}
+			c.notify()
+		}
+	}
+}
+
+// notify calls onChange with the current pools
+func (c *PoolController) notify() {
+	pools := make([]networkingv1alpha1.IPPool, 0, len(c.pools))
+	for _, pool := range c.pools {
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	c.onChange(pools)
+}
+
+func convertPool(u *unstructured.Unstructured) (*networkingv1alpha1.IPPool, error) {
+	pool := &networkingv1alpha1.IPPool{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, pool); err != nil {
+		return nil, fmt.Errorf("error parsing IPPool %q: %w", u.GetName(), err)
+	}
+	return pool, nil
+}